@@ -0,0 +1,173 @@
+package main
+
+import (
+	"strings"
+	"sync"
+)
+
+// SpeakerPolicy decides who in the host voice channel gets broadcasted
+type SpeakerPolicy int
+
+const (
+	// PolicyOpen broadcasts everyone
+	PolicyOpen SpeakerPolicy = iota
+	// PolicyHosts only broadcasts the host and co-hosts
+	PolicyHosts
+	// PolicyAllowList broadcasts the hosts and users on the allow list
+	PolicyAllowList
+	// PolicyDenyList broadcasts everyone except users on the deny list
+	PolicyDenyList
+)
+
+var speakerPolicyNames = map[SpeakerPolicy]string{
+	PolicyOpen:      "open",
+	PolicyHosts:     "hosts",
+	PolicyAllowList: "allowlist",
+	PolicyDenyList:  "denylist",
+}
+
+func (p SpeakerPolicy) String() string {
+	return speakerPolicyNames[p]
+}
+
+// ParseSpeakerPolicy returns the policy by name
+func ParseSpeakerPolicy(name string) (SpeakerPolicy, bool) {
+	name = strings.ToLower(name)
+	for p, n := range speakerPolicyNames {
+		if n == name {
+			return p, true
+		}
+	}
+
+	return PolicyOpen, false
+}
+
+// SpeakerAccess decides which users are let through to the mix, by user ID
+type SpeakerAccess struct {
+	sync.RWMutex
+
+	Policy     SpeakerPolicy
+	IgnoreBots bool
+
+	hosts map[string]bool
+	allow map[string]bool
+	deny  map[string]bool
+	muted map[string]bool
+	bots  map[string]bool
+}
+
+// NewSpeakerAccess returns a new open speaker access
+func NewSpeakerAccess() *SpeakerAccess {
+	return &SpeakerAccess{
+		hosts: make(map[string]bool),
+		allow: make(map[string]bool),
+		deny:  make(map[string]bool),
+		muted: make(map[string]bool),
+		bots:  make(map[string]bool),
+	}
+}
+
+// Allowed returns true if the user should be mixed in, userID is empty if we don't know who it is yet
+func (sa *SpeakerAccess) Allowed(userID string) bool {
+	sa.RLock()
+	defer sa.RUnlock()
+
+	if userID == "" {
+		// Only let unknown speakers through if we would anyways
+		return (sa.Policy == PolicyOpen || sa.Policy == PolicyDenyList) && !sa.IgnoreBots
+	}
+
+	if sa.muted[userID] {
+		return false
+	}
+
+	if sa.hosts[userID] {
+		return true
+	}
+
+	if sa.IgnoreBots && sa.bots[userID] {
+		return false
+	}
+
+	switch sa.Policy {
+	case PolicyHosts:
+		return false
+	case PolicyAllowList:
+		return sa.allow[userID]
+	case PolicyDenyList:
+		return !sa.deny[userID]
+	}
+
+	return true
+}
+
+// SetPolicy sets the policy
+func (sa *SpeakerAccess) SetPolicy(policy SpeakerPolicy) {
+	sa.Lock()
+	sa.Policy = policy
+	sa.Unlock()
+}
+
+// SetIgnoreBots sets whether other bots are kept out of the mix
+func (sa *SpeakerAccess) SetIgnoreBots(ignore bool) {
+	sa.Lock()
+	sa.IgnoreBots = ignore
+	sa.Unlock()
+}
+
+// SetHost marks the user as a host or co-host, they're always allowed unless muted
+func (sa *SpeakerAccess) SetHost(userID string, host bool) {
+	sa.Lock()
+	setOrDelete(sa.hosts, userID, host)
+	sa.Unlock()
+}
+
+// IsHost returns true if the user is a host or co-host
+func (sa *SpeakerAccess) IsHost(userID string) bool {
+	sa.RLock()
+	host := sa.hosts[userID]
+	sa.RUnlock()
+	return host
+}
+
+// SetBot marks the user as a bot
+func (sa *SpeakerAccess) SetBot(userID string) {
+	sa.Lock()
+	sa.bots[userID] = true
+	sa.Unlock()
+}
+
+// SetMuted mutes or unmutes the user
+func (sa *SpeakerAccess) SetMuted(userID string, muted bool) {
+	sa.Lock()
+	setOrDelete(sa.muted, userID, muted)
+	sa.Unlock()
+}
+
+// ToggleAllowed adds the user to the allow list, or removes them if they're on it.
+// Returns true if they were added
+func (sa *SpeakerAccess) ToggleAllowed(userID string) bool {
+	sa.Lock()
+	added := !sa.allow[userID]
+	setOrDelete(sa.allow, userID, added)
+	sa.Unlock()
+	return added
+}
+
+// ToggleDenied adds the user to the deny list, or removes them if they're on it.
+// Returns true if they were added
+func (sa *SpeakerAccess) ToggleDenied(userID string) bool {
+	sa.Lock()
+	added := !sa.deny[userID]
+	setOrDelete(sa.deny, userID, added)
+	sa.Unlock()
+	return added
+}
+
+func setOrDelete(m map[string]bool, key string, set bool) {
+	if set {
+		m[key] = true
+	} else {
+		delete(m, key)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSpeakerAccessAllowed(t *testing.T) {
+	cases := []struct {
+		policy     SpeakerPolicy
+		ignoreBots bool
+		host       bool
+		muted      bool
+		bot        bool
+		listed     bool // On the allow or deny list
+		allowed    bool
+	}{
+		{policy: PolicyOpen, allowed: true},
+		{policy: PolicyOpen, listed: true, allowed: true},
+		{policy: PolicyOpen, muted: true, allowed: false},
+		{policy: PolicyOpen, host: true, allowed: true},
+		{policy: PolicyOpen, host: true, muted: true, allowed: false},
+		{policy: PolicyOpen, bot: true, allowed: true},
+		{policy: PolicyOpen, bot: true, ignoreBots: true, allowed: false},
+		{policy: PolicyOpen, bot: true, ignoreBots: true, host: true, allowed: true},
+
+		{policy: PolicyHosts, allowed: false},
+		{policy: PolicyHosts, listed: true, allowed: false},
+		{policy: PolicyHosts, host: true, allowed: true},
+		{policy: PolicyHosts, host: true, muted: true, allowed: false},
+
+		{policy: PolicyAllowList, allowed: false},
+		{policy: PolicyAllowList, listed: true, allowed: true},
+		{policy: PolicyAllowList, listed: true, muted: true, allowed: false},
+		{policy: PolicyAllowList, listed: true, bot: true, allowed: true},
+		{policy: PolicyAllowList, listed: true, bot: true, ignoreBots: true, allowed: false},
+		{policy: PolicyAllowList, host: true, allowed: true},
+
+		{policy: PolicyDenyList, allowed: true},
+		{policy: PolicyDenyList, listed: true, allowed: false},
+		{policy: PolicyDenyList, listed: true, host: true, allowed: true},
+		{policy: PolicyDenyList, muted: true, allowed: false},
+		{policy: PolicyDenyList, bot: true, ignoreBots: true, allowed: false},
+	}
+
+	for _, c := range cases {
+		name := fmt.Sprintf("%+v", c)
+
+		sa := NewSpeakerAccess()
+		sa.SetPolicy(c.policy)
+		sa.SetIgnoreBots(c.ignoreBots)
+		sa.SetHost("1", c.host)
+		sa.SetMuted("1", c.muted)
+		if c.bot {
+			sa.SetBot("1")
+		}
+		if c.listed {
+			sa.ToggleAllowed("1")
+			sa.ToggleDenied("1")
+		}
+
+		if allowed := sa.Allowed("1"); allowed != c.allowed {
+			t.Errorf("%s: expected allowed to be %v", name, c.allowed)
+		}
+
+		// Nobody else is affected by the user's settings
+		if other := sa.Allowed("2"); other != (c.policy == PolicyOpen || c.policy == PolicyDenyList) {
+			t.Errorf("%s: another user's access changed", name)
+		}
+	}
+}
+
+func TestSpeakerAccessUnknownSpeakers(t *testing.T) {
+	cases := []struct {
+		policy     SpeakerPolicy
+		ignoreBots bool
+		allowed    bool
+	}{
+		{PolicyOpen, false, true},
+		{PolicyOpen, true, false},
+		{PolicyHosts, false, false},
+		{PolicyAllowList, false, false},
+		{PolicyDenyList, false, true},
+		{PolicyDenyList, true, false},
+	}
+
+	for _, c := range cases {
+		sa := NewSpeakerAccess()
+		sa.SetPolicy(c.policy)
+		sa.SetIgnoreBots(c.ignoreBots)
+
+		if allowed := sa.Allowed(""); allowed != c.allowed {
+			t.Errorf("%s (ignoring bots: %v): expected unknown speakers allowed to be %v", c.policy, c.ignoreBots, c.allowed)
+		}
+	}
+}
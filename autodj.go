@@ -0,0 +1,193 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultAutoDJSilence is how long the station has to be silent before the AutoDJ starts
+	DefaultAutoDJSilence = time.Minute
+
+	// The AutoDJ fades in when it starts and out once someone speaks over this many frames, 1 second
+	autoDJFadeFrames = 50
+)
+
+// AutoDJSettings are the settings of a station's AutoDJ
+type AutoDJSettings struct {
+	Enabled bool
+	Shuffle bool
+	Silence time.Duration // How long the station has to be silent before it starts
+}
+
+// AutoDJ fills in with a playlist from the music library when the station has been silent for a while,
+// fading out as soon as anyone speaks. It's a MixerSource and has to be added after the other sources,
+// as it looks at what's in the bus to tell if the station is silent.
+type AutoDJ struct {
+	Dir string
+
+	// Called in a new goroutine with the name of the track whenever a new one starts playing
+	OnTrack func(track string)
+
+	lock     sync.Mutex
+	settings AutoDJSettings
+	player   *playlistPlayer // Decoding ahead while enabled
+
+	quietFrames int
+	playing     bool
+	gain        int // Frames into the fade, from 0 (silent) to autoDJFadeFrames (full volume)
+	current     string
+}
+
+// NewAutoDJ returns a new disabled AutoDJ playing from the library dir
+func NewAutoDJ(dir string) *AutoDJ {
+	return &AutoDJ{
+		Dir: dir,
+		settings: AutoDJSettings{
+			Shuffle: true,
+			Silence: DefaultAutoDJSilence,
+		},
+	}
+}
+
+// Set applies the settings, starting the player on the whole music library if enabled
+func (dj *AutoDJ) Set(settings AutoDJSettings) error {
+	var player *playlistPlayer
+	if settings.Enabled {
+		tracks, err := SoundNames(dj.Dir)
+		if err != nil {
+			return err
+		}
+
+		player, err = newPlaylistPlayer(dj.Dir, tracks, settings.Shuffle)
+		if err != nil {
+			return err
+		}
+	}
+
+	dj.lock.Lock()
+	if dj.player != nil {
+		dj.player.Stop()
+	}
+	dj.player = player
+	dj.settings = settings
+	dj.quietFrames = 0
+	dj.playing = false
+	dj.gain = 0
+	dj.current = ""
+	dj.lock.Unlock()
+	return nil
+}
+
+// Settings returns the current settings
+func (dj *AutoDJ) Settings() AutoDJSettings {
+	dj.lock.Lock()
+	settings := dj.settings
+	dj.lock.Unlock()
+	return settings
+}
+
+// Stop stops the player, disabling the AutoDJ
+func (dj *AutoDJ) Stop() {
+	dj.lock.Lock()
+	if dj.player != nil {
+		dj.player.Stop()
+		dj.player = nil
+	}
+	dj.settings.Enabled = false
+	dj.playing = false
+	dj.lock.Unlock()
+}
+
+// Playing returns the track playing, or an empty string if the AutoDJ isn't playing
+func (dj *AutoDJ) Playing() string {
+	dj.lock.Lock()
+	current := ""
+	if dj.playing {
+		current = dj.current
+	}
+	dj.lock.Unlock()
+	return current
+}
+
+// busSilent returns true if the float bus is below the silence threshold
+func busSilent(bus []float32) bool {
+	const threshold = float32(silencePeak) / 0x8000
+	for _, v := range bus {
+		if v > threshold || v < -threshold {
+			return false
+		}
+	}
+	return true
+}
+
+// MixFrame implements MixerSource
+func (dj *AutoDJ) MixFrame(bus []float32, speaking bool) bool {
+	dj.lock.Lock()
+	defer dj.lock.Unlock()
+
+	if dj.player == nil {
+		return false
+	}
+
+	if !dj.playing {
+		if speaking || !busSilent(bus) {
+			dj.quietFrames = 0
+			return false
+		}
+
+		dj.quietFrames++
+		if dj.quietFrames < int(dj.settings.Silence/FrameDuration) {
+			return false
+		}
+
+		// It may start mid track, so it fades in
+		dj.playing = true
+		dj.gain = 0
+		dj.current = ""
+	}
+
+	frame, ok := dj.player.next()
+	if !ok {
+		return false
+	}
+
+	if frame.track != dj.current {
+		dj.current = frame.track
+		if dj.OnTrack != nil {
+			go dj.OnTrack(frame.track)
+		}
+	}
+
+	// Fades out while anyone speaks, and back in if they stop before it's done
+	from := dj.gain
+	if speaking {
+		if dj.gain > 0 {
+			dj.gain--
+		}
+	} else if dj.gain < autoDJFadeFrames {
+		dj.gain++
+	}
+
+	if from == autoDJFadeFrames && dj.gain == autoDJFadeFrames {
+		for i, v := range frame.pcm {
+			bus[i] += float32(v) / 0x8000
+		}
+	} else {
+		// Ramp over the frame from where the last one left off
+		start := float32(from) / autoDJFadeFrames
+		step := float32(dj.gain-from) / float32(autoDJFadeFrames*len(frame.pcm))
+		for i, v := range frame.pcm {
+			bus[i] += float32(v) / 0x8000 * (start + step*float32(i))
+		}
+	}
+
+	if dj.gain <= 0 {
+		// Picks up where it left off the next time the station goes quiet
+		dj.playing = false
+		dj.quietFrames = 0
+	}
+
+	dj.player.done(frame)
+	return true
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAutoDJ(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autodj")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeTestWAV(t, filepath.Join(dir, "filler.wav"), FrameSize*10, 0x4000)
+
+	tracks := make(chan string, 10)
+	dj := NewAutoDJ(dir)
+	dj.OnTrack = func(track string) { tracks <- track }
+
+	err = dj.Set(AutoDJSettings{Enabled: true, Silence: FrameDuration * 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Let the player decode ahead
+	time.Sleep(time.Millisecond * 50)
+
+	bus := make([]float32, FrameSamples)
+	for i := 0; i < 4; i++ {
+		if dj.MixFrame(bus, false) {
+			t.Fatal("Started before the silence period was over")
+		}
+	}
+	if !dj.MixFrame(bus, false) {
+		t.Fatal("Didn't start after the silence period")
+	}
+
+	select {
+	case track := <-tracks:
+		if track != "filler" {
+			t.Error("Announced ", track)
+		}
+	case <-time.After(time.Second):
+		t.Error("Track not announced")
+	}
+
+	// Fades out once someone speaks
+	frames := 0
+	for dj.MixFrame(bus, true) {
+		frames++
+		if frames > autoDJFadeFrames {
+			t.Fatal("Didn't stop after the fade out")
+		}
+	}
+	if dj.Playing() != "" {
+		t.Error("Still playing after fading out")
+	}
+
+	// Doesn't start over a non silent bus
+	for i := range bus {
+		bus[i] = 0.5
+	}
+	for i := 0; i < 10; i++ {
+		if dj.MixFrame(bus, false) {
+			t.Fatal("Started over audio")
+		}
+	}
+
+	dj.Stop()
+}
+
+func TestAutoDJFades(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autodj")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeTestWAV(t, filepath.Join(dir, "filler.wav"), FrameSize*10, 0x4000)
+
+	dj := NewAutoDJ(dir)
+	err = dj.Set(AutoDJSettings{Enabled: true, Silence: FrameDuration})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dj.Stop()
+
+	// mix plays a frame, waiting for the player if it's behind, and returns the level at the end of it
+	bus := make([]float32, FrameSamples)
+	mix := func(speaking bool) float32 {
+		for i := range bus {
+			bus[i] = 0
+		}
+
+		deadline := time.Now().Add(time.Second)
+		for !dj.MixFrame(bus, speaking) {
+			if time.Now().After(deadline) {
+				t.Fatal("AutoDJ stopped playing")
+			}
+			time.Sleep(time.Millisecond)
+		}
+		return bus[len(bus)-1]
+	}
+
+	// Fades in over the fade length
+	if level := mix(false); level <= 0 || level > 0.5/autoDJFadeFrames*1.01 {
+		t.Error("First frame not faded in, ended at ", level)
+	}
+	for i := 1; i < autoDJFadeFrames-1; i++ {
+		if level := mix(false); level >= 0.49 {
+			t.Fatalf("Full volume after %d frames", i+1)
+		}
+	}
+	if level := mix(false); level < 0.49 {
+		t.Error("Not at full volume after fading in, at ", level)
+	}
+
+	// Speech stopping during the fade out brings it back
+	for i := 0; i < 10; i++ {
+		mix(true)
+	}
+	for i := 0; i < 10; i++ {
+		mix(false)
+	}
+	if level := mix(false); level < 0.49 {
+		t.Error("Not back at full volume after the speech stopped, at ", level)
+	}
+}
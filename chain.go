@@ -0,0 +1,339 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"time"
+)
+
+// ChainStages is a set of enabled speaker processing stages
+type ChainStages uint8
+
+const (
+	StageHighPass ChainStages = 1 << iota
+	StageGate
+	StageAGC
+	StageCompressor
+
+	StagesAll = StageHighPass | StageGate | StageAGC | StageCompressor
+)
+
+var chainStageNames = []struct {
+	Stage ChainStages
+	Names []string
+}{
+	{StageHighPass, []string{"highpass", "hp"}},
+	{StageGate, []string{"gate", "noisegate"}},
+	{StageAGC, []string{"agc", "autogain"}},
+	{StageCompressor, []string{"compressor", "comp"}},
+}
+
+// ParseChainStages returns the stage(s) by name, "all" returns all of them
+func ParseChainStages(name string) (ChainStages, bool) {
+	name = strings.ToLower(name)
+	if name == "all" {
+		return StagesAll, true
+	}
+
+	for _, v := range chainStageNames {
+		for _, n := range v.Names {
+			if n == name {
+				return v.Stage, true
+			}
+		}
+	}
+
+	return 0, false
+}
+
+// Has returns true if all the specified stages are enabled
+func (c ChainStages) Has(stages ChainStages) bool {
+	return c&stages == stages
+}
+
+func (c ChainStages) String() string {
+	enabled := make([]string, 0, len(chainStageNames))
+	for _, v := range chainStageNames {
+		if c.Has(v.Stage) {
+			enabled = append(enabled, v.Names[0])
+		}
+	}
+
+	if len(enabled) < 1 {
+		return "none"
+	}
+
+	return strings.Join(enabled, ", ")
+}
+
+const (
+	HighPassCutoff = 80.0
+
+	GateOpenDB   = -50.0
+	GateCloseDB  = -56.0
+	GateRangeDB  = -40.0
+	GateAttack   = time.Millisecond
+	GateHold     = time.Millisecond * 150
+	GateRelease  = time.Millisecond * 150
+	gateEnvDecay = time.Millisecond * 10
+
+	CompThreshold = -18.0
+	CompRatio     = 4.0
+	CompKneeDB    = 6.0
+	CompMakeupDB  = 4.0
+	CompAttack    = time.Millisecond * 5
+	CompRelease   = time.Millisecond * 120
+
+	// AGCTargetDB is the rms level in dBFS the AGC levels speech towards
+	AGCTargetDB  = -22.0
+	AGCMaxGainDB = 15.0
+	// Frames below this rms level in dBFS are considered silence and don't move the AGC
+	AGCGateDB = -45.0
+	// How fast the AGC changes its gain, in dB per second
+	AGCRate = 6.0
+)
+
+// SpeakerChain is the optional processing applied to a single speaker before it's mixed in:
+// high-pass filter, noise gate, automatic gain control and compressor, in that order.
+// It is not safe for concurrent use.
+type SpeakerChain struct {
+	highPass   [2]biquad
+	gate       *NoiseGate
+	agc        *AGC
+	compressor *Compressor
+}
+
+// NewSpeakerChain returns a new chain with the default settings for speech
+func NewSpeakerChain() *SpeakerChain {
+	hp := newHighPass(HighPassCutoff)
+	return &SpeakerChain{
+		highPass:   [2]biquad{hp, hp},
+		gate:       NewNoiseGate(),
+		agc:        NewAGC(),
+		compressor: NewCompressor(),
+	}
+}
+
+// Process runs the interleaved stereo pcm through the enabled stages in place
+func (c *SpeakerChain) Process(pcm []float32, stages ChainStages) {
+	if stages.Has(StageHighPass) {
+		for i := 0; i+1 < len(pcm); i += 2 {
+			pcm[i] = float32(c.highPass[0].process(float64(pcm[i])))
+			pcm[i+1] = float32(c.highPass[1].process(float64(pcm[i+1])))
+		}
+	}
+
+	if stages.Has(StageGate) {
+		c.gate.Process(pcm)
+	}
+
+	if stages.Has(StageAGC) {
+		c.agc.Process(pcm)
+	}
+
+	if stages.Has(StageCompressor) {
+		c.compressor.Process(pcm)
+	}
+}
+
+// newHighPass returns a 2nd order butterworth high-pass filter
+func newHighPass(cutoff float64) biquad {
+	const q = 1 / math.Sqrt2
+
+	w := 2 * math.Pi * cutoff / SampleRate
+	alpha := math.Sin(w) / (2 * q)
+	cos := math.Cos(w)
+	a0 := 1 + alpha
+
+	return biquad{
+		b0: (1 + cos) / 2 / a0,
+		b1: -(1 + cos) / a0,
+		b2: (1 + cos) / 2 / a0,
+		a1: -2 * cos / a0,
+		a2: (1 - alpha) / a0,
+	}
+}
+
+// NoiseGate attenuates the signal while it's below the threshold, cutting out
+// background noise between words
+type NoiseGate struct {
+	Open  float32
+	Close float32
+	Range float32
+
+	attack   float32
+	release  float32
+	envDecay float32
+	hold     int
+
+	env      float32
+	gain     float32
+	isOpen   bool
+	holdLeft int
+}
+
+func NewNoiseGate() *NoiseGate {
+	return &NoiseGate{
+		Open:     float32(dbToLinear(GateOpenDB)),
+		Close:    float32(dbToLinear(GateCloseDB)),
+		Range:    float32(dbToLinear(GateRangeDB)),
+		attack:   float32(timeCoeff(GateAttack.Seconds(), 1)),
+		release:  float32(timeCoeff(GateRelease.Seconds(), 1)),
+		envDecay: float32(timeCoeff(gateEnvDecay.Seconds(), 1)),
+		hold:     int(GateHold.Seconds() * SampleRate),
+		gain:     float32(dbToLinear(GateRangeDB)),
+	}
+}
+
+func (g *NoiseGate) Process(pcm []float32) {
+	for i := 0; i+1 < len(pcm); i += 2 {
+		level := absf32(pcm[i])
+		if r := absf32(pcm[i+1]); r > level {
+			level = r
+		}
+
+		if level > g.env {
+			g.env = level
+		} else {
+			g.env *= g.envDecay
+		}
+
+		if g.env > g.Open {
+			g.isOpen = true
+			g.holdLeft = g.hold
+		} else if g.env < g.Close {
+			if g.holdLeft > 0 {
+				g.holdLeft--
+			} else {
+				g.isOpen = false
+			}
+		}
+
+		if g.isOpen {
+			g.gain = 1 + (g.gain-1)*g.attack
+		} else {
+			g.gain = g.Range + (g.gain-g.Range)*g.release
+		}
+
+		pcm[i] *= g.gain
+		pcm[i+1] *= g.gain
+	}
+}
+
+// Compressor is a soft knee feed-forward compressor, evening out the peaks of a speaker
+type Compressor struct {
+	Threshold float64 // dBFS
+	Ratio     float64
+	Knee      float64 // dB
+	Makeup    float64 // dB
+
+	attack  float64
+	release float64
+
+	// Current gain reduction in dB, always <= 0
+	envDB float64
+}
+
+func NewCompressor() *Compressor {
+	return &Compressor{
+		Threshold: CompThreshold,
+		Ratio:     CompRatio,
+		Knee:      CompKneeDB,
+		Makeup:    CompMakeupDB,
+		attack:    timeCoeff(CompAttack.Seconds(), 1),
+		release:   timeCoeff(CompRelease.Seconds(), 1),
+	}
+}
+
+// gainReduction returns the static gain reduction in dB for the input level
+func (c *Compressor) gainReduction(levelDB float64) float64 {
+	over := levelDB - c.Threshold
+	slope := 1/c.Ratio - 1
+
+	switch {
+	case 2*over < -c.Knee:
+		return 0
+	case 2*math.Abs(over) <= c.Knee:
+		x := over + c.Knee/2
+		return slope * x * x / (2 * c.Knee)
+	default:
+		return slope * over
+	}
+}
+
+func (c *Compressor) Process(pcm []float32) {
+	for i := 0; i+1 < len(pcm); i += 2 {
+		level := absf32(pcm[i])
+		if r := absf32(pcm[i+1]); r > level {
+			level = r
+		}
+
+		target := 0.0
+		if level > 1e-5 {
+			target = c.gainReduction(linearToDB(float64(level)))
+		}
+
+		if target < c.envDB {
+			c.envDB = target + (c.envDB-target)*c.attack
+		} else {
+			c.envDB = target + (c.envDB-target)*c.release
+		}
+
+		g := float32(dbToLinear(c.envDB + c.Makeup))
+		pcm[i] *= g
+		pcm[i+1] *= g
+	}
+}
+
+// AGC slowly levels a speaker towards a target rms level, holding its gain during silence
+type AGC struct {
+	Target  float64 // dBFS rms
+	MaxGain float64 // dB in either direction
+
+	gainDB float64
+}
+
+func NewAGC() *AGC {
+	return &AGC{
+		Target:  AGCTargetDB,
+		MaxGain: AGCMaxGainDB,
+	}
+}
+
+func (a *AGC) Process(pcm []float32) {
+	if len(pcm) < 2 {
+		return
+	}
+
+	sum := 0.0
+	for _, v := range pcm {
+		sum += float64(v) * float64(v)
+	}
+	rmsDB := 10 * math.Log10(sum/float64(len(pcm)))
+
+	prev := a.gainDB
+	if rmsDB > AGCGateDB {
+		desired := a.Target - rmsDB
+		desired = math.Max(-a.MaxGain, math.Min(a.MaxGain, desired))
+
+		step := AGCRate * float64(len(pcm)/2) / SampleRate
+		switch {
+		case desired > a.gainDB+step:
+			a.gainDB += step
+		case desired < a.gainDB-step:
+			a.gainDB -= step
+		default:
+			a.gainDB = desired
+		}
+	}
+
+	// Ramp over the frame to avoid zipper noise
+	from := dbToLinear(prev)
+	to := dbToLinear(a.gainDB)
+	frames := len(pcm) / 2
+	for i := 0; i < frames; i++ {
+		g := float32(from + (to-from)*float64(i+1)/float64(frames))
+		pcm[i*2] *= g
+		pcm[i*2+1] *= g
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func toneFrame(buf []float32, freq, amplitude float64, offset int) {
+	for i := 0; i < len(buf)/2; i++ {
+		v := float32(amplitude * math.Sin(2*math.Pi*freq*float64(offset+i)/SampleRate))
+		buf[i*2] = v
+		buf[i*2+1] = v
+	}
+}
+
+// processTone runs seconds of the tone through the stages and returns the rms level in dBFS of the last frame
+func processTone(c *SpeakerChain, stages ChainStages, freq, amplitude float64, seconds int) float64 {
+	buf := make([]float32, FrameSamples)
+	frames := seconds * int(SampleRate) / FrameSize
+	for i := 0; i < frames; i++ {
+		toneFrame(buf, freq, amplitude, i*FrameSize)
+		c.Process(buf, stages)
+	}
+
+	sum := 0.0
+	for _, v := range buf {
+		sum += float64(v) * float64(v)
+	}
+	return 10 * math.Log10(sum/float64(len(buf)))
+}
+
+func TestHighPassAttenuatesRumble(t *testing.T) {
+	// rms of a sine is 3 dB below its peak
+	in := linearToDB(0.5) - 3
+
+	rumble := processTone(NewSpeakerChain(), StageHighPass, 50, 0.5, 1)
+	if in-rumble < 6 {
+		t.Errorf("Expected a 50hz tone to be attenuated by at least 6 dB, got %.1f dB", in-rumble)
+	}
+
+	speech := processTone(NewSpeakerChain(), StageHighPass, 1000, 0.5, 1)
+	if math.Abs(in-speech) > 0.5 {
+		t.Errorf("Expected a 1khz tone to pass, got %.1f dB of attenuation", in-speech)
+	}
+}
+
+func TestGateClosesBelowThreshold(t *testing.T) {
+	in := GateCloseDB - 10 - 3
+
+	noise := processTone(NewSpeakerChain(), StageGate, 1000, dbToLinear(GateCloseDB-10), 1)
+	if in-noise < -GateRangeDB-1 {
+		t.Errorf("Expected the gate to be closed attenuating by %.0f dB, got %.1f dB", -GateRangeDB, in-noise)
+	}
+
+	in = GateOpenDB + 20 - 3
+	speech := processTone(NewSpeakerChain(), StageGate, 1000, dbToLinear(GateOpenDB+20), 1)
+	if math.Abs(in-speech) > 0.5 {
+		t.Errorf("Expected the gate to be open, got %.1f dB of attenuation", in-speech)
+	}
+}
+
+func TestCompressorEvensOutLevels(t *testing.T) {
+	loud := processTone(NewSpeakerChain(), StageCompressor, 1000, dbToLinear(-3), 1)
+	quiet := processTone(NewSpeakerChain(), StageCompressor, 1000, dbToLinear(CompThreshold-6), 1)
+
+	// 21 dB apart going in
+	if diff := loud - quiet; diff > 13 || diff < 0 {
+		t.Errorf("Expected the compressor to bring the levels at least 8 dB closer, %.1f dB apart", diff)
+	}
+}
+
+func TestAGCLevelsSpeakers(t *testing.T) {
+	loud := processTone(NewSpeakerChain(), StageAGC, 1000, dbToLinear(-6), 5)
+	quiet := processTone(NewSpeakerChain(), StageAGC, 1000, dbToLinear(-30), 5)
+
+	for name, l := range map[string]float64{"loud": loud, "quiet": quiet} {
+		if math.Abs(l-AGCTargetDB) > 1 {
+			t.Errorf("Expected the %s speaker to be leveled to %.0f dBFS, got %.1f", name, AGCTargetDB, l)
+		}
+	}
+}
@@ -1,9 +1,16 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
+	"github.com/hraban/opus"
 	"github.com/jonas747/dcmd"
 	"github.com/jonas747/discordgo"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
 func InitCommands(sys *dcmd.System) {
@@ -21,10 +28,11 @@ func InitCommands(sys *dcmd.System) {
 
 	sys.Root.AddCommand(&dcmd.SimpleCmd{
 		ShortDesc: "Listen in to specified broadcast",
-		LongDesc:  "Listen in to the specified broadcast by name",
+		LongDesc:  "Listen in to the specified broadcast by name, optionally picking a quality tier (see the tiers command)",
 		RunFunc:   CmdListen,
 		CmdArgDefs: []*dcmd.ArgDef{
 			&dcmd.ArgDef{Name: "Name", Type: dcmd.String},
+			&dcmd.ArgDef{Name: "Quality", Type: dcmd.String},
 		},
 		RequiredArgDefs: 1,
 	}, dcmd.NewTrigger("listen", "tunein", "l"))
@@ -44,6 +52,323 @@ func InitCommands(sys *dcmd.System) {
 		RequiredArgDefs: 2,
 	}, dcmd.NewTrigger("volume", "vol"))
 
+	sys.Root.AddCommand(&dcmd.SimpleCmd{
+		ShortDesc: "Toggles speaker processing for the whole broadcast or a single user",
+		LongDesc: "Toggles speaker processing for the whole broadcast, or a single user if mentioned.\n" +
+			"Stages: highpass, gate, agc, compressor or all",
+		RunFunc: CmdDSP,
+		CmdArgDefs: []*dcmd.ArgDef{
+			&dcmd.ArgDef{Name: "Stage", Type: dcmd.String},
+			&dcmd.ArgDef{Name: "State", Type: dcmd.String},
+			&dcmd.ArgDef{Name: "User", Type: dcmd.UserReqMention},
+		},
+		RequiredArgDefs: 2,
+	}, dcmd.NewTrigger("dsp", "processing"))
+
+	sys.Root.AddCommand(&dcmd.SimpleCmd{
+		ShortDesc: "Shows the loudness and clip readings of your broadcast",
+		RunFunc:   CmdLevels,
+	}, dcmd.NewTrigger("levels", "meter"))
+
+	sys.Root.AddCommand(&dcmd.SimpleCmd{
+		ShortDesc: "Shows the packet loss and jitter buffer depth of every speaker in your broadcast",
+		RunFunc:   CmdLoss,
+	}, dcmd.NewTrigger("loss", "speakerstats"))
+
+	sys.Root.AddCommand(&dcmd.SimpleCmd{
+		ShortDesc: "Normalizes the loudness of your broadcast to the specified target in LUFS, or off",
+		LongDesc:  "Normalizes the loudness of your broadcast to the specified target in LUFS (e.g -16), or disables it with off",
+		RunFunc:   CmdNormalize,
+		CmdArgDefs: []*dcmd.ArgDef{
+			&dcmd.ArgDef{Name: "Target", Type: dcmd.String},
+		},
+		RequiredArgDefs: 1,
+	}, dcmd.NewTrigger("normalize", "norm"))
+
+	sys.Root.AddCommand(&dcmd.SimpleCmd{
+		ShortDesc: "Starts or stops recording your broadcast",
+		LongDesc: "Starts or stops recording your broadcast to Ogg Opus files, usage: record start|stop [mix|tracks|both]\n" +
+			"mix (default) records what listeners hear, tracks records every speaker into their own file with a manifest for loading them in sync",
+		RunFunc: CmdRecord,
+		CmdArgDefs: []*dcmd.ArgDef{
+			&dcmd.ArgDef{Name: "Action", Type: dcmd.String},
+			&dcmd.ArgDef{Name: "Mode", Type: dcmd.String},
+		},
+		RequiredArgDefs: 1,
+	}, dcmd.NewTrigger("record", "rec"))
+
+	sys.Root.AddCommand(&dcmd.SimpleCmd{
+		ShortDesc: "Uploads the last few seconds of the station as a clip",
+		LongDesc:  "Uploads the last few seconds of the station broadcasted or tuned into from this server as a clip",
+		RunFunc:   CmdClip,
+		CmdArgDefs: []*dcmd.ArgDef{
+			&dcmd.ArgDef{Name: "Seconds", Type: &dcmd.IntArg{Min: 1, Max: 3600}},
+		},
+	}, dcmd.NewTrigger("clip", "replay"))
+
+	sys.Root.AddCommand(&dcmd.SimpleCmd{
+		ShortDesc: "Adds or removes a co-host of your broadcast",
+		LongDesc:  "Adds the mentioned user as a co-host of your broadcast, or removes them if they already are one. Co-hosts can dump the broadcast delay.",
+		RunFunc:   CmdCoHost,
+		CmdArgDefs: []*dcmd.ArgDef{
+			&dcmd.ArgDef{Name: "User", Type: dcmd.UserReqMention},
+		},
+		RequiredArgDefs: 1,
+	}, dcmd.NewTrigger("cohost"))
+
+	sys.Root.AddCommand(&dcmd.SimpleCmd{
+		ShortDesc: "Sets the broadcast delay in seconds, 0 to disable it",
+		LongDesc:  "Sets the broadcast delay in seconds, 0 to disable it. Audio is held back this long before it reaches listeners, so it can be dumped.",
+		RunFunc:   CmdDelay,
+		CmdArgDefs: []*dcmd.ArgDef{
+			&dcmd.ArgDef{Name: "Seconds", Type: &dcmd.FloatArg{Min: 0, Max: MaxBroadcastDelay.Seconds()}},
+		},
+		RequiredArgDefs: 1,
+	}, dcmd.NewTrigger("delay"))
+
+	sys.Root.AddCommand(&dcmd.SimpleCmd{
+		ShortDesc: "Dumps the delayed audio before it reaches listeners",
+		RunFunc:   CmdDump,
+	}, dcmd.NewTrigger("dump"))
+
+	sys.Root.AddCommand(&dcmd.SimpleCmd{
+		ShortDesc: "Mutes a user in your broadcast",
+		RunFunc:   CmdMute,
+		CmdArgDefs: []*dcmd.ArgDef{
+			&dcmd.ArgDef{Name: "User", Type: dcmd.UserReqMention},
+		},
+		RequiredArgDefs: 1,
+	}, dcmd.NewTrigger("mute"))
+
+	sys.Root.AddCommand(&dcmd.SimpleCmd{
+		ShortDesc: "Unmutes a user in your broadcast",
+		RunFunc:   CmdUnmute,
+		CmdArgDefs: []*dcmd.ArgDef{
+			&dcmd.ArgDef{Name: "User", Type: dcmd.UserReqMention},
+		},
+		RequiredArgDefs: 1,
+	}, dcmd.NewTrigger("unmute"))
+
+	sys.Root.AddCommand(&dcmd.SimpleCmd{
+		ShortDesc: "Sets who in the voice channel gets broadcasted",
+		LongDesc: "Sets who in the voice channel gets broadcasted:\n" +
+			"open: everyone\nhosts: only the host and co-hosts\n" +
+			"allowlist: the hosts and users on the allow list\ndenylist: everyone except users on the deny list",
+		RunFunc: CmdSpeakers,
+		CmdArgDefs: []*dcmd.ArgDef{
+			&dcmd.ArgDef{Name: "Policy", Type: dcmd.String},
+		},
+		RequiredArgDefs: 1,
+	}, dcmd.NewTrigger("speakers"))
+
+	sys.Root.AddCommand(&dcmd.SimpleCmd{
+		ShortDesc: "Adds or removes a user from the speaker allow list",
+		RunFunc:   CmdAllow,
+		CmdArgDefs: []*dcmd.ArgDef{
+			&dcmd.ArgDef{Name: "User", Type: dcmd.UserReqMention},
+		},
+		RequiredArgDefs: 1,
+	}, dcmd.NewTrigger("allow"))
+
+	sys.Root.AddCommand(&dcmd.SimpleCmd{
+		ShortDesc: "Adds or removes a user from the speaker deny list",
+		RunFunc:   CmdDeny,
+		CmdArgDefs: []*dcmd.ArgDef{
+			&dcmd.ArgDef{Name: "User", Type: dcmd.UserReqMention},
+		},
+		RequiredArgDefs: 1,
+	}, dcmd.NewTrigger("deny"))
+
+	sys.Root.AddCommand(&dcmd.SimpleCmd{
+		ShortDesc: "Only broadcasts the loudest N speakers at once, 0 for everyone",
+		LongDesc:  "Only broadcasts the loudest N speakers at once, 0 for everyone. The host and co-hosts are always broadcasted and don't take up a slot.",
+		RunFunc:   CmdMaxSpeakers,
+		CmdArgDefs: []*dcmd.ArgDef{
+			&dcmd.ArgDef{Name: "N", Type: &dcmd.IntArg{Min: 0, Max: 100}},
+		},
+		RequiredArgDefs: 1,
+	}, dcmd.NewTrigger("maxspeakers"))
+
+	sys.Root.AddCommand(&dcmd.SimpleCmd{
+		ShortDesc: "Places a speaker in the stereo field, from -100 (left) to 100 (right)",
+		RunFunc:   CmdPan,
+		CmdArgDefs: []*dcmd.ArgDef{
+			&dcmd.ArgDef{Name: "User", Type: dcmd.UserReqMention},
+			&dcmd.ArgDef{Name: "Position", Type: &dcmd.IntArg{Min: -100, Max: 100}},
+		},
+		RequiredArgDefs: 2,
+	}, dcmd.NewTrigger("pan"))
+
+	sys.Root.AddCommand(&dcmd.SimpleCmd{
+		ShortDesc: "Turns spreading speakers across the stereo field as they join on or off",
+		LongDesc:  "Turns spreading speakers across the stereo field as they join on or off. Speakers placed with the pan command keep their position.",
+		RunFunc:   CmdAutoPan,
+		CmdArgDefs: []*dcmd.ArgDef{
+			&dcmd.ArgDef{Name: "State", Type: dcmd.String},
+		},
+		RequiredArgDefs: 1,
+	}, dcmd.NewTrigger("autopan"))
+
+	sys.Root.AddCommand(&dcmd.SimpleCmd{
+		ShortDesc: "Adds or removes effects on a speaker or the whole broadcast, or lists them",
+		LongDesc:  "`fx add <effect> [@user]` adds an effect to the user, or the whole broadcast if no user is mentioned. `fx remove <effect> [@user]` removes it again, and `fx list` lists the available effects and the ones in use.",
+		RunFunc:   CmdFx,
+		CmdArgDefs: []*dcmd.ArgDef{
+			&dcmd.ArgDef{Name: "Action", Type: dcmd.String},
+			&dcmd.ArgDef{Name: "Effect", Type: dcmd.String},
+			&dcmd.ArgDef{Name: "User", Type: dcmd.UserReqMention},
+		},
+		RequiredArgDefs: 1,
+	}, dcmd.NewTrigger("fx"))
+
+	sys.Root.AddCommand(&dcmd.SimpleCmd{
+		ShortDesc: "Turns talkover on or off, ducking everyone else while the hosts or priority speakers talk",
+		LongDesc:  "Turns talkover on or off, ducking everyone else while the hosts or priority speakers talk. Optionally sets how many dB they're ducked by, and the attack and release times in milliseconds.",
+		RunFunc:   CmdTalkover,
+		CmdArgDefs: []*dcmd.ArgDef{
+			&dcmd.ArgDef{Name: "State", Type: dcmd.String},
+			&dcmd.ArgDef{Name: "Depth", Type: &dcmd.FloatArg{Min: 1, Max: 60}},
+			&dcmd.ArgDef{Name: "Attack", Type: &dcmd.IntArg{Min: 0, Max: 5000}},
+			&dcmd.ArgDef{Name: "Release", Type: &dcmd.IntArg{Min: 0, Max: 10000}},
+		},
+		RequiredArgDefs: 1,
+	}, dcmd.NewTrigger("talkover"))
+
+	sys.Root.AddCommand(&dcmd.SimpleCmd{
+		ShortDesc: "Makes a user a priority speaker for talkover, or removes them if they are one",
+		RunFunc:   CmdPriority,
+		CmdArgDefs: []*dcmd.ArgDef{
+			&dcmd.ArgDef{Name: "User", Type: dcmd.UserReqMention},
+		},
+		RequiredArgDefs: 1,
+	}, dcmd.NewTrigger("priority"))
+
+	sys.Root.AddCommand(&dcmd.SimpleCmd{
+		ShortDesc: "Sets whether other bots in the voice channel are kept out of the broadcast",
+		RunFunc:   CmdIgnoreBots,
+		CmdArgDefs: []*dcmd.ArgDef{
+			&dcmd.ArgDef{Name: "State", Type: dcmd.String},
+		},
+		RequiredArgDefs: 1,
+	}, dcmd.NewTrigger("ignorebots"))
+
+	sys.Root.AddCommand(&dcmd.SimpleCmd{
+		ShortDesc: "Plays a sound from the soundboard right away, cutting off the one playing",
+		RunFunc:   CmdPlaySound,
+		CmdArgDefs: []*dcmd.ArgDef{
+			&dcmd.ArgDef{Name: "Sound", Type: dcmd.String},
+		},
+		RequiredArgDefs: 1,
+	}, dcmd.NewTrigger("play"))
+
+	sys.Root.AddCommand(&dcmd.SimpleCmd{
+		ShortDesc: "Queues a sound from the soundboard to play after the current ones",
+		RunFunc:   CmdQueueSound,
+		CmdArgDefs: []*dcmd.ArgDef{
+			&dcmd.ArgDef{Name: "Sound", Type: dcmd.String},
+		},
+		RequiredArgDefs: 1,
+	}, dcmd.NewTrigger("queue"))
+
+	sys.Root.AddCommand(&dcmd.SimpleCmd{
+		ShortDesc: "Stops the sound playing and clears the soundboard queue",
+		RunFunc:   CmdStopSound,
+	}, dcmd.NewTrigger("stopsound", "stopsounds"))
+
+	sys.Root.AddCommand(&dcmd.SimpleCmd{
+		ShortDesc: "Sets the volume of the soundboard in percentage",
+		RunFunc:   CmdSoundVolume,
+		CmdArgDefs: []*dcmd.ArgDef{
+			&dcmd.ArgDef{Name: "Volume", Type: &dcmd.FloatArg{Min: 0, Max: 200}},
+		},
+		RequiredArgDefs: 1,
+	}, dcmd.NewTrigger("soundvolume", "soundvol"))
+
+	sys.Root.AddCommand(&dcmd.SimpleCmd{
+		ShortDesc: "Lists the sounds of the soundboard and what's playing",
+		RunFunc:   CmdSounds,
+	}, dcmd.NewTrigger("sounds", "soundboard"))
+
+	sys.Root.AddCommand(&dcmd.SimpleCmd{
+		ShortDesc: "Sets the background music bed, or shows it and the music library",
+		LongDesc:  "Plays a comma separated list of tracks from the music library on repeat under the voices, `all` for the whole library or `off` to stop it. Shows the bed and the library if no tracks are given.",
+		RunFunc:   CmdBed,
+		CmdArgDefs: []*dcmd.ArgDef{
+			&dcmd.ArgDef{Name: "Tracks", Type: dcmd.String},
+		},
+	}, dcmd.NewTrigger("bed", "music"))
+
+	sys.Root.AddCommand(&dcmd.SimpleCmd{
+		ShortDesc: "Sets the level of the music bed in percentage",
+		RunFunc:   CmdBedLevel,
+		CmdArgDefs: []*dcmd.ArgDef{
+			&dcmd.ArgDef{Name: "Level", Type: &dcmd.FloatArg{Min: 0, Max: 200}},
+		},
+		RequiredArgDefs: 1,
+	}, dcmd.NewTrigger("bedlevel"))
+
+	sys.Root.AddCommand(&dcmd.SimpleCmd{
+		ShortDesc: "Sets how many dB the music bed is ducked by while anyone's talking",
+		LongDesc:  "Sets how many dB the music bed is ducked by while anyone's talking, 0 to not duck it. Optionally sets the attack and release times in milliseconds.",
+		RunFunc:   CmdBedDuck,
+		CmdArgDefs: []*dcmd.ArgDef{
+			&dcmd.ArgDef{Name: "Depth", Type: &dcmd.FloatArg{Min: 0, Max: 60}},
+			&dcmd.ArgDef{Name: "Attack", Type: &dcmd.IntArg{Min: 0, Max: 5000}},
+			&dcmd.ArgDef{Name: "Release", Type: &dcmd.IntArg{Min: 0, Max: 10000}},
+		},
+		RequiredArgDefs: 1,
+	}, dcmd.NewTrigger("bedduck"))
+
+	sys.Root.AddCommand(&dcmd.SimpleCmd{
+		ShortDesc: "Turns the AutoDJ on or off, playing the music library when the broadcast has been silent for a while",
+		LongDesc:  "Turns the AutoDJ on or off. While on it plays the music library after the broadcast has been silent for the specified number of seconds, shuffled or in order, and fades out as soon as anyone speaks. Shows the AutoDJ settings if no state is given.",
+		RunFunc:   CmdAutoDJ,
+		CmdArgDefs: []*dcmd.ArgDef{
+			&dcmd.ArgDef{Name: "State", Type: dcmd.String},
+			&dcmd.ArgDef{Name: "Silence", Type: &dcmd.IntArg{Min: 5, Max: 3600}},
+			&dcmd.ArgDef{Name: "Order", Type: dcmd.String},
+		},
+	}, dcmd.NewTrigger("autodj"))
+
+	sys.Root.AddCommand(&dcmd.SimpleCmd{
+		ShortDesc: "Sets the station ident played to servers tuning in, before they get the live broadcast",
+		LongDesc:  "Sets the sound from the soundboard library played to servers tuning in, before they get the live broadcast, `off` to remove it. Shows the ident if no sound is given.",
+		RunFunc:   CmdIdent,
+		CmdArgDefs: []*dcmd.ArgDef{
+			&dcmd.ArgDef{Name: "Sound", Type: dcmd.String},
+		},
+	}, dcmd.NewTrigger("ident"))
+
+	sys.Root.AddCommand(&dcmd.SimpleCmd{
+		ShortDesc: "Lists the quality tiers of a station, your broadcast if no name is given",
+		RunFunc:   CmdTiers,
+		CmdArgDefs: []*dcmd.ArgDef{
+			&dcmd.ArgDef{Name: "Name", Type: dcmd.String},
+		},
+	}, dcmd.NewTrigger("tiers"))
+
+	sys.Root.AddCommand(&dcmd.SimpleCmd{
+		ShortDesc: "Adds or changes a quality tier of your broadcast",
+		LongDesc:  "Adds or changes a quality tier of your broadcast. Options is a comma separated list of: voip (tuned for speech), fec (more resilient to packet loss), dtx (next to nothing is sent during silence), lowcpu (lower encoder complexity)",
+		RunFunc:   CmdTier,
+		CmdArgDefs: []*dcmd.ArgDef{
+			&dcmd.ArgDef{Name: "Name", Type: dcmd.String},
+			&dcmd.ArgDef{Name: "Kbps", Type: &dcmd.IntArg{Min: 6, Max: 510}},
+			&dcmd.ArgDef{Name: "Options", Type: dcmd.String},
+		},
+		RequiredArgDefs: 2,
+	}, dcmd.NewTrigger("tier"))
+
+	sys.Root.AddCommand(&dcmd.SimpleCmd{
+		ShortDesc: "Shows the send queues of your broadcast's listeners and recorders",
+		RunFunc:   CmdOutputs,
+	}, dcmd.NewTrigger("outputs"))
+
+	sys.Root.AddCommand(&dcmd.SimpleCmd{
+		ShortDesc: "Shows how well the mixers are keeping up",
+		RunFunc:   CmdTiming,
+	}, dcmd.NewTrigger("timing"))
+
 	sys.Root.AddCommand(&dcmd.SimpleCmd{
 		ShortDesc: "Lists all stations",
 		RunFunc:   CmdListStations,
@@ -85,12 +410,21 @@ func CmdListen(d *dcmd.Data) (interface{}, error) {
 		return "No station found by that name, or the search had multiple matches, try to be more exact", nil
 	}
 
-	_, err := station.ListenIn(d.Guild.ID, vcID, d.Msg.ChannelID)
+	tier := DefaultTier
+	if d.Args[1].Value != nil {
+		tier = d.Args[1].Str()
+	}
+
+	_, err := station.ListenIn(d.Guild.ID, vcID, d.Msg.ChannelID, tier)
 	if err != nil {
 		if err == ErrGuildHostTaken || err == ErrGuildReceiveTaken {
 			return "There is already a station being broadcasted from here or listening in on a station.", nil
 		}
 
+		if err == ErrUnknownTier {
+			return "That station has no quality tier by that name", nil
+		}
+
 		return err, err
 	}
 
@@ -120,33 +454,1062 @@ func CmdStop(d *dcmd.Data) (interface{}, error) {
 	return "Stopped tuning into " + st.Meta().Name + ", have a nice day!", nil
 }
 
+// hostedStation returns the station broadcasted from the guild, or nil if there is none
+func hostedStation(guildID string) *Station {
+	ActiveLock.RLock()
+	st, ok := ActiveGuilds[guildID]
+	ActiveLock.RUnlock()
+	if !ok || st.Meta().GuildID != guildID {
+		return nil
+	}
+
+	return st
+}
+
 func CmdVolume(d *dcmd.Data) (interface{}, error) {
-	ActiveLock.Lock()
-	st, ok := ActiveGuilds[d.Guild.ID]
-	ActiveLock.Unlock()
-	if !ok {
+	st := hostedStation(d.Guild.ID)
+	if st == nil {
 		return "No broadcast from this server", nil
 	}
 
-	if st.Meta().GuildID != d.Guild.ID {
-		return "No broadcast from this server", nil
+	if !st.IsHost(d.Msg.Author.ID, true) {
+		return "Only the host and co-hosts can change speaker volumes", nil
 	}
 
 	vol := d.Args[1].Value.(float64) / 100
-	// st.Lock()
-	// st.queuedSetVolumes[d.Args[0].Value.(*discordgo.User).ID] = float32(vol)
-	// st.Unlock()
+	st.mixer.SetVolume(d.Args[0].Value.(*discordgo.User).ID, float32(vol))
 
-	st.vc.Lock()
-	ssrc, ok := st.vc.UsersToSSRC[d.Args[0].Value.(*discordgo.User).ID]
-	st.vc.Unlock()
+	return fmt.Sprintf("Set volume of %s to %.1f%%", d.Args[0].Value.(*discordgo.User).Username, vol*100), nil
+}
+
+func CmdDSP(d *dcmd.Data) (interface{}, error) {
+	st := hostedStation(d.Guild.ID)
+	if st == nil {
+		return "No broadcast from this server", nil
+	}
+
+	if !st.IsHost(d.Msg.Author.ID, true) {
+		return "Only the host and co-hosts can change speaker processing", nil
+	}
+
+	stages, ok := ParseChainStages(d.Args[0].Str())
 	if !ok {
-		return "This person needs to speak in the voice channel before i can set the volume (i need to know the ssrc)", nil
+		return "Unknown stage, available stages: highpass, gate, agc, compressor, all", nil
 	}
 
-	st.mixer.SetVolume(ssrc, float32(vol))
+	var enable bool
+	switch strings.ToLower(d.Args[1].Str()) {
+	case "on", "enable", "true":
+		enable = true
+	case "off", "disable", "false":
+		enable = false
+	default:
+		return "State has to be on or off", nil
+	}
 
-	return fmt.Sprintf("Set volume of %s to %.1f%%", d.Args[0].Value.(*discordgo.User).Username, vol*100), nil
+	toggle := func(current ChainStages) ChainStages {
+		if enable {
+			return current | stages
+		}
+		return current &^ stages
+	}
+
+	if d.Args[2].Value == nil {
+		newStages := toggle(st.mixer.ChainStages())
+		st.mixer.SetChainStages(newStages)
+		return "Speaker processing for everyone: " + newStages.String(), nil
+	}
+
+	user := d.Args[2].Value.(*discordgo.User)
+	newStages := toggle(st.mixer.UserSettings(user.ID).Chain)
+	st.mixer.SetUserChainStages(user.ID, newStages)
+	return fmt.Sprintf("Speaker processing for %s: %s", user.Username, newStages), nil
+}
+
+func CmdLevels(d *dcmd.Data) (interface{}, error) {
+	st := hostedStation(d.Guild.ID)
+	if st == nil {
+		return "No broadcast from this server", nil
+	}
+
+	if !st.IsHost(d.Msg.Author.ID, true) {
+		return "Only the host and co-hosts can see the levels", nil
+	}
+
+	stats := st.mixer.MasterStats()
+
+	output := "```\n"
+	output += fmt.Sprintf("Momentary:  %s\n", formatLUFS(stats.Momentary))
+	output += fmt.Sprintf("Short term: %s\n", formatLUFS(stats.ShortTerm))
+	output += fmt.Sprintf("Integrated: %s\n", formatLUFS(stats.Integrated))
+	output += fmt.Sprintf("Peak:       %.1f dBFS\n", stats.Peak)
+	output += fmt.Sprintf("Clipped:    %d samples (limited)\n", stats.Clipped)
+	output += fmt.Sprintf("Limiter:    -%.1f dB\n", stats.GainReduction)
+	if stats.Normalize {
+		output += fmt.Sprintf("Normalizer: %+.1f dB towards %.1f LUFS\n", stats.NormalizeGain, stats.NormalizeTarget)
+	} else {
+		output += "Normalizer: off\n"
+	}
+	if talkover := st.mixer.Talkover(); talkover.Enabled {
+		output += fmt.Sprintf("Talkover:   ducking by %.1f dB\n", talkover.Depth)
+	} else {
+		output += "Talkover:   off\n"
+	}
+	switch enabled, active := st.mixer.Passthrough(); {
+	case active:
+		output += "Passthrough: active\n"
+	case enabled:
+		output += "Passthrough: waiting for a single speaker\n"
+	default:
+		output += "Passthrough: off\n"
+	}
+	switch enabled, suppressed := st.mixer.SilenceSuppression(); {
+	case suppressed:
+		output += "Silence:    suppressed\n"
+	case enabled:
+		output += "Silence:    suppressed after a short tail\n"
+	default:
+		output += "Silence:    always sent\n"
+	}
+	output += "```"
+
+	return output, nil
+}
+
+func CmdLoss(d *dcmd.Data) (interface{}, error) {
+	st := hostedStation(d.Guild.ID)
+	if st == nil {
+		return "No broadcast from this server", nil
+	}
+
+	if !st.IsHost(d.Msg.Author.ID, true) {
+		return "Only the host and co-hosts can see the speaker stats", nil
+	}
+
+	stats := st.mixer.SpeakerStats()
+	if len(stats) < 1 {
+		return "Nobody has spoken yet", nil
+	}
+
+	lines := make([]string, 0, len(stats))
+	for ssrc, v := range stats {
+		_, username, ok := st.resolveSpeaker(ssrc)
+		if !ok {
+			username = fmt.Sprintf("ssrc %d", ssrc)
+		}
+		lines = append(lines, fmt.Sprintf("%-20s %5d %9d %9d %5d", username, v.Lost, v.Recovered, v.Concealed, v.Depth))
+	}
+	sort.Strings(lines)
+
+	output := "```\n"
+	output += fmt.Sprintf("%-20s %5s %9s %9s %5s\n", "Speaker", "Lost", "Recovered", "Concealed", "Depth")
+	output += strings.Join(lines, "\n")
+	output += "\n```"
+
+	return output, nil
+}
+
+func formatLUFS(l float64) string {
+	if math.IsInf(l, -1) {
+		return "-inf LUFS"
+	}
+
+	return fmt.Sprintf("%.1f LUFS", l)
+}
+
+func CmdNormalize(d *dcmd.Data) (interface{}, error) {
+	st := hostedStation(d.Guild.ID)
+	if st == nil {
+		return "No broadcast from this server", nil
+	}
+
+	if !st.IsHost(d.Msg.Author.ID, true) {
+		return "Only the host and co-hosts can change the loudness normalization", nil
+	}
+
+	arg := strings.ToLower(d.Args[0].Str())
+	if arg == "off" {
+		st.mixer.SetNormalization(false, DefaultLoudnessTarget)
+		return "Disabled loudness normalization", nil
+	}
+
+	target, err := strconv.ParseFloat(strings.TrimSuffix(arg, "lufs"), 64)
+	if err != nil || target > 0 || target < -40 {
+		return "Target has to be a loudness between -40 and 0 LUFS, or off", nil
+	}
+
+	st.mixer.SetNormalization(true, target)
+	return fmt.Sprintf("Normalizing loudness to %.1f LUFS", target), nil
+}
+
+func CmdRecord(d *dcmd.Data) (interface{}, error) {
+	st := hostedStation(d.Guild.ID)
+	if st == nil {
+		return "No broadcast from this server", nil
+	}
+
+	if !st.IsHost(d.Msg.Author.ID, true) {
+		return "Only the host and co-hosts can record the broadcast", nil
+	}
+
+	mode := "mix"
+	if d.Args[1].Value != nil {
+		mode = strings.ToLower(d.Args[1].Str())
+	}
+	if mode != "mix" && mode != "tracks" && mode != "both" {
+		return "Mode has to be mix, tracks or both", nil
+	}
+	mix := mode == "mix" || mode == "both"
+	tracks := mode == "tracks" || mode == "both"
+
+	output := ""
+	switch strings.ToLower(d.Args[0].Str()) {
+	case "start":
+		if mix {
+			_, err := st.StartRecording()
+			if err == ErrAlreadyRecording {
+				output += "Already recording the mix\n"
+			} else if err != nil {
+				return err, err
+			} else {
+				output += "Started recording the mix\n"
+			}
+		}
+
+		if tracks {
+			_, err := st.StartMultitrack()
+			if err == ErrAlreadyRecording {
+				output += "Already recording the speaker tracks\n"
+			} else if err != nil {
+				return err, err
+			} else {
+				output += "Started recording a track per speaker\n"
+			}
+		}
+	case "stop":
+		if mix {
+			files, err := st.StopRecording()
+			if err == ErrNotRecording {
+				output += "Not recording the mix\n"
+			} else if err != nil {
+				return err, err
+			} else {
+				output += fmt.Sprintf("Stopped recording the mix, saved %d file(s):\n%s\n", len(files), strings.Join(files, "\n"))
+			}
+		}
+
+		if tracks {
+			dir, err := st.StopMultitrack()
+			if err == ErrNotRecording {
+				output += "Not recording the speaker tracks\n"
+			} else if err != nil {
+				return err, err
+			} else {
+				output += "Stopped recording the speaker tracks, saved to " + dir + "\n"
+			}
+		}
+	default:
+		return "Usage: record start|stop [mix|tracks|both]", nil
+	}
+
+	return output, nil
+}
+
+func CmdClip(d *dcmd.Data) (interface{}, error) {
+	ActiveLock.RLock()
+	st, ok := ActiveGuilds[d.Guild.ID]
+	ActiveLock.RUnlock()
+	if !ok {
+		return "No broadcast and no station tuned into from this server", nil
+	}
+
+	length := ClipMaxLength / 2
+	if d.Args[0].Value != nil {
+		length = time.Duration(d.Args[0].Int()) * time.Second
+	}
+	if length > ClipMaxLength {
+		return fmt.Sprintf("Clips can be at most %d seconds long", int(ClipMaxLength.Seconds())), nil
+	}
+
+	clip, err := st.Clip(length)
+	if err != nil {
+		if err == ErrClipCooldown {
+			return fmt.Sprintf("A clip of this station was made recently, try again in a bit (%d seconds between clips)", int(ClipCooldown.Seconds())), nil
+		}
+		if err == ErrNoReplayAudio {
+			return "Nothing to clip yet", nil
+		}
+		return err, err
+	}
+
+	name := fmt.Sprintf("%s-%s.opus", safeFileName(st.Meta().Name), time.Now().Format("2006-01-02_15-04-05"))
+	_, err = DG.ChannelFileSend(d.Msg.ChannelID, name, bytes.NewReader(clip))
+	if err != nil {
+		return "Failed uploading the clip", err
+	}
+
+	return fmt.Sprintf("Clip of the last %d seconds of %s", int(length.Seconds()), st.Meta().Name), nil
+}
+
+func CmdCoHost(d *dcmd.Data) (interface{}, error) {
+	st := hostedStation(d.Guild.ID)
+	if st == nil {
+		return "No broadcast from this server", nil
+	}
+
+	if !st.IsHost(d.Msg.Author.ID, false) {
+		return "Only the host of the broadcast can change co-hosts", nil
+	}
+
+	user := d.Args[0].Value.(*discordgo.User)
+	if st.ToggleCoHost(user.ID) {
+		return user.Username + " is now a co-host", nil
+	}
+
+	return user.Username + " is no longer a co-host", nil
+}
+
+func CmdDelay(d *dcmd.Data) (interface{}, error) {
+	st := hostedStation(d.Guild.ID)
+	if st == nil {
+		return "No broadcast from this server", nil
+	}
+
+	if !st.IsHost(d.Msg.Author.ID, false) {
+		return "Only the host of the broadcast can change the delay", nil
+	}
+
+	delay := time.Duration(d.Args[0].Value.(float64) * float64(time.Second))
+	st.mixer.SetDelay(delay)
+	if delay < FrameDuration {
+		return "Disabled the broadcast delay", nil
+	}
+
+	return fmt.Sprintf("Broadcast delay set to %.1f seconds", st.mixer.Delay().Seconds()), nil
+}
+
+func CmdDump(d *dcmd.Data) (interface{}, error) {
+	st := hostedStation(d.Guild.ID)
+	if st == nil {
+		return "No broadcast from this server", nil
+	}
+
+	if !st.IsHost(d.Msg.Author.ID, true) {
+		return "Only the host and co-hosts can dump the broadcast", nil
+	}
+
+	if !st.mixer.Dump() {
+		return "There is no broadcast delay to dump, set one with the delay command", nil
+	}
+
+	return "Dumped! The delayed audio will never reach the listeners", nil
+}
+
+func CmdMute(d *dcmd.Data) (interface{}, error) {
+	return setMuted(d, true)
+}
+
+func CmdUnmute(d *dcmd.Data) (interface{}, error) {
+	return setMuted(d, false)
+}
+
+func setMuted(d *dcmd.Data, muted bool) (interface{}, error) {
+	st := hostedStation(d.Guild.ID)
+	if st == nil {
+		return "No broadcast from this server", nil
+	}
+
+	if !st.IsHost(d.Msg.Author.ID, true) {
+		return "Only the host and co-hosts can mute people", nil
+	}
+
+	user := d.Args[0].Value.(*discordgo.User)
+	st.mixer.Access.SetMuted(user.ID, muted)
+	if muted {
+		return "Muted " + user.Username, nil
+	}
+
+	return "Unmuted " + user.Username, nil
+}
+
+func CmdSpeakers(d *dcmd.Data) (interface{}, error) {
+	st := hostedStation(d.Guild.ID)
+	if st == nil {
+		return "No broadcast from this server", nil
+	}
+
+	if !st.IsHost(d.Msg.Author.ID, false) {
+		return "Only the host can change who gets broadcasted", nil
+	}
+
+	policy, ok := ParseSpeakerPolicy(d.Args[0].Str())
+	if !ok {
+		return "Unknown policy, available policies: open, hosts, allowlist, denylist", nil
+	}
+
+	st.mixer.Access.SetPolicy(policy)
+	return "Speaker policy set to " + policy.String(), nil
+}
+
+func CmdMaxSpeakers(d *dcmd.Data) (interface{}, error) {
+	st := hostedStation(d.Guild.ID)
+	if st == nil {
+		return "No broadcast from this server", nil
+	}
+
+	if !st.IsHost(d.Msg.Author.ID, false) {
+		return "Only the host can change who gets broadcasted", nil
+	}
+
+	max := d.Args[0].Int()
+	st.mixer.SetMaxSpeakers(max)
+	if max < 1 {
+		return "Broadcasting everyone talking", nil
+	}
+
+	return fmt.Sprintf("Only broadcasting the %d loudest speakers, plus the hosts", max), nil
+}
+
+func CmdAllow(d *dcmd.Data) (interface{}, error) {
+	return toggleSpeakerList(d, "allow list", (*SpeakerAccess).ToggleAllowed)
+}
+
+func CmdDeny(d *dcmd.Data) (interface{}, error) {
+	return toggleSpeakerList(d, "deny list", (*SpeakerAccess).ToggleDenied)
+}
+
+func toggleSpeakerList(d *dcmd.Data, listName string, toggle func(sa *SpeakerAccess, userID string) bool) (interface{}, error) {
+	st := hostedStation(d.Guild.ID)
+	if st == nil {
+		return "No broadcast from this server", nil
+	}
+
+	if !st.IsHost(d.Msg.Author.ID, true) {
+		return "Only the host and co-hosts can change the speaker lists", nil
+	}
+
+	user := d.Args[0].Value.(*discordgo.User)
+	if toggle(st.mixer.Access, user.ID) {
+		return "Added " + user.Username + " to the " + listName, nil
+	}
+
+	return "Removed " + user.Username + " from the " + listName, nil
+}
+
+func CmdIgnoreBots(d *dcmd.Data) (interface{}, error) {
+	st := hostedStation(d.Guild.ID)
+	if st == nil {
+		return "No broadcast from this server", nil
+	}
+
+	if !st.IsHost(d.Msg.Author.ID, false) {
+		return "Only the host can change this", nil
+	}
+
+	switch strings.ToLower(d.Args[0].Str()) {
+	case "on", "enable", "true":
+		st.mixer.Access.SetIgnoreBots(true)
+		return "Other bots are now kept out of the broadcast", nil
+	case "off", "disable", "false":
+		st.mixer.Access.SetIgnoreBots(false)
+		return "Other bots are now broadcasted like everyone else", nil
+	}
+
+	return "State has to be on or off", nil
+}
+
+func CmdPan(d *dcmd.Data) (interface{}, error) {
+	st := hostedStation(d.Guild.ID)
+	if st == nil {
+		return "No broadcast from this server", nil
+	}
+
+	if !st.IsHost(d.Msg.Author.ID, true) {
+		return "Only the host and co-hosts can place speakers", nil
+	}
+
+	user := d.Args[0].Value.(*discordgo.User)
+	pan := d.Args[1].Int()
+	st.mixer.SetPan(user.ID, float32(pan))
+
+	switch {
+	case pan < 0:
+		return fmt.Sprintf("Placed %s %d%% to the left", user.Username, -pan), nil
+	case pan > 0:
+		return fmt.Sprintf("Placed %s %d%% to the right", user.Username, pan), nil
+	}
+
+	return "Placed " + user.Username + " in the center", nil
+}
+
+func CmdAutoPan(d *dcmd.Data) (interface{}, error) {
+	st := hostedStation(d.Guild.ID)
+	if st == nil {
+		return "No broadcast from this server", nil
+	}
+
+	if !st.IsHost(d.Msg.Author.ID, true) {
+		return "Only the host and co-hosts can change this", nil
+	}
+
+	switch strings.ToLower(d.Args[0].Str()) {
+	case "on", "enable", "true":
+		st.mixer.SetAutoPan(true)
+		return "Speakers are now spread across the stereo field as they join", nil
+	case "off", "disable", "false":
+		st.mixer.SetAutoPan(false)
+		return "Speakers without a position of their own are now in the center", nil
+	}
+
+	return "State has to be on or off", nil
+}
+
+func CmdFx(d *dcmd.Data) (interface{}, error) {
+	st := hostedStation(d.Guild.ID)
+	if st == nil {
+		return "No broadcast from this server", nil
+	}
+
+	action := strings.ToLower(d.Args[0].Str())
+	if action == "list" {
+		master, users := st.mixer.Effects()
+
+		output := "Available effects: " + strings.Join(EffectNames(), ", ") + "\n"
+		if len(master) > 0 {
+			output += "Broadcast: " + strings.Join(master, ", ") + "\n"
+		}
+		for userID, effects := range users {
+			// Names instead of mentions so listing doesn't ping everyone with effects
+			output += st.username(userID) + ": " + strings.Join(effects, ", ") + "\n"
+		}
+		return output, nil
+	}
+
+	if !st.IsHost(d.Msg.Author.ID, true) {
+		return "Only the host and co-hosts can change effects", nil
+	}
+
+	if action != "add" && action != "remove" {
+		return "Action has to be add, remove or list", nil
+	}
+
+	if d.Args[1].Value == nil {
+		return "Which effect? Available effects: " + strings.Join(EffectNames(), ", "), nil
+	}
+	effect := d.Args[1].Str()
+
+	userID := ""
+	target := "the broadcast"
+	if d.Args[2].Value != nil {
+		user := d.Args[2].Value.(*discordgo.User)
+		userID = user.ID
+		target = user.Username
+	}
+
+	var err error
+	if action == "add" {
+		err = st.mixer.AddEffect(userID, effect)
+	} else {
+		err = st.mixer.RemoveEffect(userID, effect)
+	}
+
+	switch err {
+	case nil:
+	case ErrUnknownEffect:
+		return "Unknown effect, available effects: " + strings.Join(EffectNames(), ", "), nil
+	case ErrTooManyEffects:
+		return fmt.Sprintf("%s already has %d effects", target, MaxEffects), nil
+	case ErrNoSuchEffect:
+		return fmt.Sprintf("%s doesn't have %s on", target, effect), nil
+	default:
+		return nil, err
+	}
+
+	if action == "add" {
+		return fmt.Sprintf("Added %s to %s", effect, target), nil
+	}
+	return fmt.Sprintf("Removed %s from %s", effect, target), nil
+}
+
+func CmdTalkover(d *dcmd.Data) (interface{}, error) {
+	st := hostedStation(d.Guild.ID)
+	if st == nil {
+		return "No broadcast from this server", nil
+	}
+
+	if !st.IsHost(d.Msg.Author.ID, true) {
+		return "Only the host and co-hosts can change talkover", nil
+	}
+
+	settings := st.mixer.Talkover()
+	switch strings.ToLower(d.Args[0].Str()) {
+	case "on", "enable", "true":
+		settings.Enabled = true
+	case "off", "disable", "false":
+		settings.Enabled = false
+	default:
+		return "State has to be on or off", nil
+	}
+
+	if d.Args[1].Value != nil {
+		settings.Depth = d.Args[1].Value.(float64)
+	}
+	if d.Args[2].Value != nil {
+		settings.Attack = time.Duration(d.Args[2].Int()) * time.Millisecond
+	}
+	if d.Args[3].Value != nil {
+		settings.Release = time.Duration(d.Args[3].Int()) * time.Millisecond
+	}
+
+	st.mixer.SetTalkover(settings)
+	if !settings.Enabled {
+		return "Talkover disabled", nil
+	}
+
+	return fmt.Sprintf("Talkover enabled, ducking by %.1f dB (attack %s, release %s)", settings.Depth, settings.Attack, settings.Release), nil
+}
+
+func CmdPriority(d *dcmd.Data) (interface{}, error) {
+	st := hostedStation(d.Guild.ID)
+	if st == nil {
+		return "No broadcast from this server", nil
+	}
+
+	if !st.IsHost(d.Msg.Author.ID, true) {
+		return "Only the host and co-hosts can change the priority speakers", nil
+	}
+
+	user := d.Args[0].Value.(*discordgo.User)
+	if st.mixer.TogglePriority(user.ID) {
+		return user.Username + " is now a priority speaker", nil
+	}
+
+	return user.Username + " is no longer a priority speaker", nil
+}
+
+// soundboardStation returns the station broadcasted from the guild if the author is allowed to use its soundboard,
+// otherwise the reply explaining why not
+func soundboardStation(d *dcmd.Data) (*Station, string) {
+	st := hostedStation(d.Guild.ID)
+	if st == nil {
+		return nil, "No broadcast from this server"
+	}
+
+	if !st.IsHost(d.Msg.Author.ID, true) {
+		return nil, "Only the host and co-hosts can use the soundboard"
+	}
+
+	return st, ""
+}
+
+func soundError(err error) (interface{}, error) {
+	switch err {
+	case ErrUnknownSound:
+		return "No sound by that name, see the sounds command", nil
+	case ErrUnsupportedSoundFormat, ErrNotOggOpus:
+		return "That sound is in a format the soundboard can't play, it supports DCA, Ogg Opus and 16 bit WAV", nil
+	case ErrSoundQueueFull:
+		return "The soundboard queue is full", nil
+	}
+
+	return nil, err
+}
+
+func CmdPlaySound(d *dcmd.Data) (interface{}, error) {
+	st, reply := soundboardStation(d)
+	if st == nil {
+		return reply, nil
+	}
+
+	err := st.soundboard.Play(d.Args[0].Str())
+	if err != nil {
+		return soundError(err)
+	}
+
+	return "Playing " + d.Args[0].Str(), nil
+}
+
+func CmdQueueSound(d *dcmd.Data) (interface{}, error) {
+	st, reply := soundboardStation(d)
+	if st == nil {
+		return reply, nil
+	}
+
+	err := st.soundboard.Queue(d.Args[0].Str())
+	if err != nil {
+		return soundError(err)
+	}
+
+	return "Queued " + d.Args[0].Str(), nil
+}
+
+func CmdStopSound(d *dcmd.Data) (interface{}, error) {
+	st, reply := soundboardStation(d)
+	if st == nil {
+		return reply, nil
+	}
+
+	if !st.soundboard.Stop() {
+		return "Nothing is playing", nil
+	}
+
+	return "Stopped the soundboard", nil
+}
+
+func CmdSoundVolume(d *dcmd.Data) (interface{}, error) {
+	st, reply := soundboardStation(d)
+	if st == nil {
+		return reply, nil
+	}
+
+	vol := d.Args[0].Value.(float64) / 100
+	st.soundboard.SetVolume(float32(vol))
+
+	return fmt.Sprintf("Set the soundboard volume to %.1f%%", vol*100), nil
+}
+
+func CmdSounds(d *dcmd.Data) (interface{}, error) {
+	st := hostedStation(d.Guild.ID)
+	if st == nil {
+		return "No broadcast from this server", nil
+	}
+
+	names, err := SoundNames(st.soundboard.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	volume, playing, queued := st.soundboard.Status()
+
+	output := fmt.Sprintf("Volume: %.1f%%\n", volume*100)
+	if playing != "" {
+		output += "Playing: " + playing + "\n"
+	}
+	if len(queued) > 0 {
+		output += "Queued: " + strings.Join(queued, ", ") + "\n"
+	}
+
+	if len(names) < 1 {
+		return output + "The soundboard library is empty", nil
+	}
+
+	return output + "```\n" + strings.Join(names, "\n") + "\n```", nil
+}
+
+func CmdBed(d *dcmd.Data) (interface{}, error) {
+	st := hostedStation(d.Guild.ID)
+	if st == nil {
+		return "No broadcast from this server", nil
+	}
+
+	if d.Args[0].Value == nil {
+		level, tracks, current := st.bed.Status()
+		ducking := st.bed.Ducking()
+
+		output := "Music bed: off\n"
+		if len(tracks) > 0 {
+			output = "Music bed: " + strings.Join(tracks, ", ") + "\n"
+			if current != "" {
+				output += "Playing: " + current + "\n"
+			}
+		}
+		output += fmt.Sprintf("Level: %.1f%%, ", level*100)
+		if ducking.Enabled {
+			output += fmt.Sprintf("ducked by %.1f dB while anyone's talking\n", ducking.Depth)
+		} else {
+			output += "not ducked\n"
+		}
+
+		names, err := SoundNames(st.bed.Dir)
+		if err != nil {
+			return nil, err
+		}
+		if len(names) < 1 {
+			return output + "The music library is empty", nil
+		}
+
+		return output + "```\n" + strings.Join(names, "\n") + "\n```", nil
+	}
+
+	if !st.IsHost(d.Msg.Author.ID, true) {
+		return "Only the host and co-hosts can change the music bed", nil
+	}
+
+	var tracks []string
+	switch arg := strings.TrimSpace(d.Args[0].Str()); strings.ToLower(arg) {
+	case "off", "stop":
+		if !st.bed.Stop() {
+			return "The music bed isn't playing", nil
+		}
+		return "Stopped the music bed", nil
+	case "all":
+		names, err := SoundNames(st.bed.Dir)
+		if err != nil {
+			return nil, err
+		}
+		tracks = names
+	default:
+		for _, name := range strings.Split(arg, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				tracks = append(tracks, name)
+			}
+		}
+	}
+
+	err := st.bed.Play(tracks)
+	if err != nil {
+		switch err {
+		case ErrEmptyPlaylist:
+			return "No tracks to play, the music library is empty", nil
+		case ErrUnknownSound:
+			return "One of the tracks isn't in the music library, see the bed command", nil
+		}
+		return nil, err
+	}
+
+	_, tracks, _ = st.bed.Status()
+	return "Playing the music bed: " + strings.Join(tracks, ", "), nil
+}
+
+func CmdBedLevel(d *dcmd.Data) (interface{}, error) {
+	st := hostedStation(d.Guild.ID)
+	if st == nil {
+		return "No broadcast from this server", nil
+	}
+
+	if !st.IsHost(d.Msg.Author.ID, true) {
+		return "Only the host and co-hosts can change the music bed", nil
+	}
+
+	level := d.Args[0].Value.(float64) / 100
+	st.bed.SetLevel(float32(level))
+
+	return fmt.Sprintf("Set the music bed level to %.1f%%", level*100), nil
+}
+
+func CmdBedDuck(d *dcmd.Data) (interface{}, error) {
+	st := hostedStation(d.Guild.ID)
+	if st == nil {
+		return "No broadcast from this server", nil
+	}
+
+	if !st.IsHost(d.Msg.Author.ID, true) {
+		return "Only the host and co-hosts can change the music bed", nil
+	}
+
+	settings := st.bed.Ducking()
+	settings.Depth = d.Args[0].Value.(float64)
+	if d.Args[1].Value != nil {
+		settings.Attack = time.Duration(d.Args[1].Int()) * time.Millisecond
+	}
+	if d.Args[2].Value != nil {
+		settings.Release = time.Duration(d.Args[2].Int()) * time.Millisecond
+	}
+
+	st.bed.SetDucking(settings.Depth, settings.Attack, settings.Release)
+	if settings.Depth <= 0 {
+		return "The music bed is no longer ducked", nil
+	}
+
+	return fmt.Sprintf("The music bed is ducked by %.1f dB while anyone's talking (attack %s, release %s)", settings.Depth, settings.Attack, settings.Release), nil
+}
+
+func CmdAutoDJ(d *dcmd.Data) (interface{}, error) {
+	st := hostedStation(d.Guild.ID)
+	if st == nil {
+		return "No broadcast from this server", nil
+	}
+
+	settings := st.autoDJ.Settings()
+	if d.Args[0].Value == nil {
+		if !settings.Enabled {
+			return "AutoDJ: off", nil
+		}
+
+		output := fmt.Sprintf("AutoDJ: on, after %s of silence, ", settings.Silence)
+		if settings.Shuffle {
+			output += "shuffled"
+		} else {
+			output += "in order"
+		}
+		if track := st.autoDJ.Playing(); track != "" {
+			output += "\nPlaying: " + track
+		}
+		return output, nil
+	}
+
+	if !st.IsHost(d.Msg.Author.ID, true) {
+		return "Only the host and co-hosts can change the AutoDJ", nil
+	}
+
+	switch strings.ToLower(d.Args[0].Str()) {
+	case "on", "enable", "true":
+		settings.Enabled = true
+	case "off", "disable", "false":
+		st.autoDJ.Stop()
+		return "AutoDJ disabled", nil
+	default:
+		return "State has to be on or off", nil
+	}
+
+	if d.Args[1].Value != nil {
+		settings.Silence = time.Duration(d.Args[1].Int()) * time.Second
+	}
+	if d.Args[2].Value != nil {
+		switch strings.ToLower(d.Args[2].Str()) {
+		case "shuffle", "shuffled", "random":
+			settings.Shuffle = true
+		case "ordered", "order", "inorder":
+			settings.Shuffle = false
+		default:
+			return "Order has to be shuffle or ordered", nil
+		}
+	}
+
+	err := st.autoDJ.Set(settings)
+	if err != nil {
+		if err == ErrEmptyPlaylist {
+			return "The music library is empty", nil
+		}
+		return nil, err
+	}
+
+	return fmt.Sprintf("AutoDJ enabled, playing the music library after %s of silence", settings.Silence), nil
+}
+
+func CmdIdent(d *dcmd.Data) (interface{}, error) {
+	st := hostedStation(d.Guild.ID)
+	if st == nil {
+		return "No broadcast from this server", nil
+	}
+
+	if d.Args[0].Value == nil {
+		if ident := st.Ident(); ident != "" {
+			return "Ident: " + ident, nil
+		}
+		return "No ident set", nil
+	}
+
+	if !st.IsHost(d.Msg.Author.ID, true) {
+		return "Only the host and co-hosts can change the ident", nil
+	}
+
+	name := d.Args[0].Str()
+	if strings.EqualFold(name, "off") {
+		name = ""
+	}
+
+	err := st.SetIdent(name)
+	if err != nil {
+		if err == ErrIdentTooLong {
+			return fmt.Sprintf("That sound is too long for an ident, the max is %s", MaxIdentLength), nil
+		}
+		return soundError(err)
+	}
+
+	if name == "" {
+		return "Ident removed", nil
+	}
+	return "Ident set to " + st.Ident() + ", servers tuning in will hear it first", nil
+}
+
+func CmdTiers(d *dcmd.Data) (interface{}, error) {
+	var st *Station
+	if d.Args[0].Value != nil {
+		st = FindStation(d.Args[0].Str())
+		if st == nil {
+			return "No station found by that name, or the search had multiple matches, try to be more exact", nil
+		}
+	} else {
+		st = hostedStation(d.Guild.ID)
+		if st == nil {
+			return "No broadcast from this server", nil
+		}
+	}
+
+	output := "```\n"
+	for _, t := range st.mixer.Tiers() {
+		output += fmt.Sprintf("%s (%d outputs)\n", t.EncoderProfile, t.Subscribers)
+	}
+	output += "```"
+
+	return output, nil
+}
+
+func CmdTier(d *dcmd.Data) (interface{}, error) {
+	st := hostedStation(d.Guild.ID)
+	if st == nil {
+		return "No broadcast from this server", nil
+	}
+
+	if !st.IsHost(d.Msg.Author.ID, false) {
+		return "Only the host can change the quality tiers", nil
+	}
+
+	profile := EncoderProfile{
+		Name:        d.Args[0].Str(),
+		Bitrate:     d.Args[1].Int() * 1000,
+		Complexity:  10,
+		Application: opus.AppAudio,
+	}
+
+	if d.Args[2].Value != nil {
+		for _, option := range strings.Split(strings.ToLower(d.Args[2].Str()), ",") {
+			switch strings.TrimSpace(option) {
+			case "voip":
+				profile.Application = opus.AppVoIP
+			case "fec":
+				profile.FEC = true
+			case "dtx":
+				profile.DTX = true
+			case "lowcpu":
+				profile.Complexity = 5
+			default:
+				return "Unknown option " + option + ", available options: voip, fec, dtx, lowcpu", nil
+			}
+		}
+	}
+
+	err := st.mixer.SetEncoderProfile(profile)
+	if err != nil {
+		return nil, err
+	}
+
+	return "Quality tier set: " + profile.String(), nil
+}
+
+func CmdOutputs(d *dcmd.Data) (interface{}, error) {
+	st := hostedStation(d.Guild.ID)
+	if st == nil {
+		return "No broadcast from this server", nil
+	}
+
+	if !st.IsHost(d.Msg.Author.ID, true) {
+		return "Only the host and co-hosts can see the listeners of the broadcast", nil
+	}
+
+	output := "```\n"
+	for _, v := range st.mixer.OutputStats() {
+		output += v.String() + "\n"
+	}
+	output += "```"
+
+	return output, nil
+}
+
+func CmdTiming(d *dcmd.Data) (interface{}, error) {
+	stats := Scheduler.Stats()
+
+	output := "```\n"
+	output += fmt.Sprintf("Mixers:       %d\n", stats.Processors)
+	output += fmt.Sprintf("Frames:       %d\n", stats.Frames)
+	output += fmt.Sprintf("Late:         %d\n", stats.Late)
+	output += fmt.Sprintf("Skipped:      %d\n", stats.Skipped)
+	output += fmt.Sprintf("Max lateness: %s\n", stats.MaxLateness)
+	output += fmt.Sprintf("Last frame:   %s\n", stats.LastTick)
+	output += "```"
+
+	return output, nil
 }
 
 func CmdListStations(d *dcmd.Data) (interface{}, error) {
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"github.com/jonas747/dcmd"
+	"github.com/jonas747/discordgo"
+	"testing"
+)
+
+func TestCmdVolumeHostsOnly(t *testing.T) {
+	st := &Station{
+		meta: &StationMeta{
+			GuildID: "guild",
+			Host:    &discordgo.User{ID: "host"},
+			CoHosts: []string{"cohost"},
+		},
+		mixer: NewMixer(),
+	}
+
+	ActiveLock.Lock()
+	ActiveGuilds["guild"] = st
+	ActiveLock.Unlock()
+	defer func() {
+		ActiveLock.Lock()
+		delete(ActiveGuilds, "guild")
+		ActiveLock.Unlock()
+	}()
+
+	setVolume := func(author string, volume float64) {
+		_, err := CmdVolume(&dcmd.Data{
+			Guild: &discordgo.Guild{ID: "guild"},
+			Msg:   &discordgo.Message{Author: &discordgo.User{ID: author}},
+			Args: []*dcmd.ParsedArg{
+				{Value: &discordgo.User{ID: "speaker", Username: "speaker"}},
+				{Value: volume},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	setVolume("listener", 10)
+	if v := st.mixer.UserSettings("speaker").Volume; v != 1 {
+		t.Error("Volume changed by someone who isn't a host: ", v)
+	}
+
+	setVolume("cohost", 50)
+	if v := st.mixer.UserSettings("speaker").Volume; v != 0.5 {
+		t.Error("Volume not changed by a co-host: ", v)
+	}
+
+	setVolume("host", 150)
+	if v := st.mixer.UserSettings("speaker").Volume; v != 1.5 {
+		t.Error("Volume not changed by the host: ", v)
+	}
+}
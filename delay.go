@@ -0,0 +1,77 @@
+package main
+
+import (
+	"time"
+)
+
+// MaxBroadcastDelay is the longest delay that can be set on a station
+const MaxBroadcastDelay = time.Second * 30
+
+// DelayLine holds back encoded frames for a fixed amount of time before they're broadcasted,
+// giving the host a chance to dump audio before it reaches any listeners.
+// It holds a reference to every frame in it, nil frames are silence.
+// It is not safe for concurrent use.
+type DelayLine struct {
+	// Ring of frames, frames[pos] is the oldest and the next to be sent
+	frames []*opusFrame
+	pos    int
+}
+
+// NewDelayLine returns a new delay line of the specified length, initially filled with silence
+func NewDelayLine(d time.Duration) *DelayLine {
+	n := int(d / FrameDuration)
+	if n < 1 {
+		n = 1
+	}
+
+	return &DelayLine{
+		frames: make([]*opusFrame, n),
+	}
+}
+
+// Length returns the delay
+func (dl *DelayLine) Length() time.Duration {
+	return time.Duration(len(dl.frames)) * FrameDuration
+}
+
+// Push adds a frame to the line and returns the one that's due to be sent, or nil for silence.
+// The line takes over the reference to frame, and hands over its reference to the returned one.
+func (dl *DelayLine) Push(frame *opusFrame) *opusFrame {
+	out := dl.frames[dl.pos]
+	dl.frames[dl.pos] = frame
+	dl.pos = (dl.pos + 1) % len(dl.frames)
+	return out
+}
+
+// Dump replaces all the frames not sent yet with silence
+func (dl *DelayLine) Dump() {
+	for i, f := range dl.frames {
+		if f != nil {
+			f.release()
+			dl.frames[i] = nil
+		}
+	}
+}
+
+// Resize returns a new delay line of the specified length, carrying over the newest pending frames.
+// Growing the delay inserts silence, shrinking it skips the oldest frames.
+// dl must not be used afterwards.
+func (dl *DelayLine) Resize(d time.Duration) *DelayLine {
+	resized := NewDelayLine(d)
+
+	n := len(dl.frames)
+	if len(resized.frames) < n {
+		n = len(resized.frames)
+	}
+
+	// Copy the newest n frames in order to the end of the new line
+	for i := 0; i < n; i++ {
+		src := (dl.pos - n + i + len(dl.frames)) % len(dl.frames)
+		resized.frames[len(resized.frames)-n+i] = dl.frames[src]
+		dl.frames[src] = nil
+	}
+
+	// Release the skipped ones
+	dl.Dump()
+	return resized
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestDelayLine(t *testing.T) {
+	// The test keeps its own reference to every frame, so the line's references can be checked
+	frames := make([]*opusFrame, 11)
+	for i := range frames {
+		frames[i] = newOpusFrame()
+		frames[i].data = append(frames[i].data, byte(i))
+		frames[i].retain()
+	}
+
+	dl := NewDelayLine(FrameDuration * 5)
+	next := 0
+
+	// push pushes the next frame, checking that the expected one comes out, -1 for silence
+	push := func(expected int) {
+		out := dl.Push(frames[next])
+		next++
+
+		if expected < 0 {
+			if out != nil {
+				t.Errorf("Expected silence after pushing frame %d, got frame %d", next-1, out.data[0])
+			}
+			return
+		}
+
+		if out != frames[expected] {
+			t.Errorf("Expected frame %d after pushing frame %d, got %v", expected, next-1, out)
+		}
+		if out != nil {
+			out.release()
+		}
+	}
+
+	checkRefs := func(upTo int, state string) {
+		for i, f := range frames[:upTo] {
+			if f.refs != 1 {
+				t.Errorf("%s: frame %d has %d references, expected 1", state, i, f.refs)
+			}
+		}
+	}
+
+	// Frames come out after exactly 5 frames
+	for i := 0; i < 5; i++ {
+		push(-1)
+	}
+	push(0)
+	push(1)
+	push(2)
+	checkRefs(3, "After sending")
+
+	// Holding 3, 4, 5, 6 and 7. Shrinking keeps the newest and releases 3 and 4
+	dl = dl.Resize(FrameDuration * 3)
+	if dl.Length() != FrameDuration*3 {
+		t.Error("Expected a length of 3 frames, got ", dl.Length())
+	}
+	checkRefs(5, "After shrinking")
+	push(5)
+
+	// Holding 6, 7 and 8, growing inserts silence in front of them
+	dl = dl.Resize(FrameDuration * 5)
+	push(-1)
+	push(-1)
+
+	// Holding 6, 7, 8, 9 and 10, dumping replaces them all with silence
+	dl.Dump()
+	checkRefs(11, "After dumping")
+	for i := 0; i < 5; i++ {
+		if out := dl.Push(nil); out != nil {
+			t.Errorf("Expected silence after dumping, got frame %d", out.data[0])
+		}
+	}
+
+	for _, f := range frames {
+		f.release()
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	// SampleRate is the sample rate used throughout the mixer
+	SampleRate = 48000
+
+	// FrameSize is the number of samples per channel in a 20ms frame
+	FrameSize = 960
+
+	// FrameSamples is the number of interleaved stereo samples in a 20ms frame
+	FrameSamples = FrameSize * 2
+
+	FrameDuration = time.Millisecond * 20
+)
+
+// biquad is a second order IIR filter section in transposed direct form II
+type biquad struct {
+	b0, b1, b2, a1, a2 float64
+	z1, z2             float64
+}
+
+func (bq *biquad) process(x float64) float64 {
+	y := bq.b0*x + bq.z1
+	bq.z1 = bq.b1*x - bq.a1*y + bq.z2
+	bq.z2 = bq.b2*x - bq.a2*y
+	return y
+}
+
+func (bq *biquad) reset() {
+	bq.z1 = 0
+	bq.z2 = 0
+}
+
+func absf32(x float32) float32 {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// dbToLinear converts decibels to a linear gain
+func dbToLinear(db float64) float64 {
+	return math.Pow(10, db/20)
+}
+
+// linearToDB converts a linear gain to decibels, returns -Inf for 0
+func linearToDB(lin float64) float64 {
+	return 20 * math.Log10(lin)
+}
+
+// timeCoeff returns the one pole smoothing coefficient for the specified time constant,
+// when updated every `every` samples
+func timeCoeff(seconds float64, every int) float64 {
+	if seconds <= 0 {
+		return 0
+	}
+
+	return math.Exp(-float64(every) / (seconds * SampleRate))
+}
+
+// softClip saturates samples above the knee smoothly towards full scale, so that anything
+// getting past the limiter is rounded off instead of hard clipped
+func softClip(x float32) float32 {
+	const knee = 0.9
+
+	sign := float32(1)
+	if x < 0 {
+		sign = -1
+		x = -x
+	}
+
+	if x <= knee {
+		return sign * x
+	}
+
+	over := float64(x-knee) / (1 - knee)
+	return sign * (knee + (1-knee)*float32(math.Tanh(over)))
+}
+
+// slidingMin tracks the minimum of the last `window` values pushed, using a monotonic queue
+type slidingMin struct {
+	vals []float64
+	idx  []int
+
+	head    int
+	n       int
+	counter int
+	window  int
+}
+
+func newSlidingMin(window int) *slidingMin {
+	if window < 1 {
+		window = 1
+	}
+
+	return &slidingMin{
+		vals:   make([]float64, window),
+		idx:    make([]int, window),
+		window: window,
+	}
+}
+
+// push adds a value and returns the minimum of the window
+func (sm *slidingMin) push(v float64) float64 {
+	size := len(sm.vals)
+
+	// Values larger than the new one can never be the minimum again
+	for sm.n > 0 && sm.vals[(sm.head+sm.n-1)%size] >= v {
+		sm.n--
+	}
+
+	if sm.n > 0 && sm.idx[sm.head] <= sm.counter-sm.window {
+		sm.head = (sm.head + 1) % size
+		sm.n--
+	}
+
+	tail := (sm.head + sm.n) % size
+	sm.vals[tail] = v
+	sm.idx[tail] = sm.counter
+	sm.n++
+	sm.counter++
+
+	return sm.vals[sm.head]
+}
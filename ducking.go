@@ -0,0 +1,78 @@
+package main
+
+import (
+	"time"
+)
+
+// Talkover defaults
+const (
+	DefaultTalkoverDepth   = 12.0 // dB
+	DefaultTalkoverAttack  = time.Millisecond * 50
+	DefaultTalkoverRelease = time.Millisecond * 500
+
+	// A speaker counts as talking while their level is above this in dBFS
+	talkoverThreshold = -40.0
+)
+
+// TalkoverSettings are the settings of a station's talkover mode
+type TalkoverSettings struct {
+	Enabled bool
+	Depth   float64 // dB the other speakers are attenuated by
+	Attack  time.Duration
+	Release time.Duration
+}
+
+// Ducker attenuates the non priority speakers while a priority speaker is talking,
+// fading down over the attack time and back up over the release time
+type Ducker struct {
+	TalkoverSettings
+
+	attack  float32
+	release float32
+	floor   float32
+
+	gain float32
+}
+
+// NewDucker returns a new disabled ducker with the default settings
+func NewDucker() *Ducker {
+	d := &Ducker{gain: 1}
+	d.Set(TalkoverSettings{
+		Depth:   DefaultTalkoverDepth,
+		Attack:  DefaultTalkoverAttack,
+		Release: DefaultTalkoverRelease,
+	})
+	return d
+}
+
+// Set applies the settings, the current gain is kept so changes don't click
+func (d *Ducker) Set(settings TalkoverSettings) {
+	d.TalkoverSettings = settings
+	d.attack = float32(timeCoeff(settings.Attack.Seconds(), 1))
+	d.release = float32(timeCoeff(settings.Release.Seconds(), 1))
+	d.floor = float32(dbToLinear(-settings.Depth))
+}
+
+// Process applies the ducking gain to the interleaved stereo pcm, ducked is whether a priority speaker is talking
+func (d *Ducker) Process(pcm []float32, ducked bool) {
+	target, coeff := float32(1), d.release
+	if ducked && d.Enabled {
+		target, coeff = d.floor, d.attack
+	}
+
+	for i := 0; i+1 < len(pcm); i += 2 {
+		d.gain = target + (d.gain-target)*coeff
+		pcm[i] *= d.gain
+		pcm[i+1] *= d.gain
+	}
+}
+
+// Unity returns true if the ducker isn't attenuating anything
+func (d *Ducker) Unity() bool {
+	return d.gain > 0.999
+}
+
+// Gain returns the current gain in dB
+func (d *Ducker) Gain() float64 {
+	return linearToDB(float64(d.gain))
+}
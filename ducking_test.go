@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDucker(t *testing.T) {
+	d := NewDucker()
+	d.Set(TalkoverSettings{Enabled: true, Depth: 12, Attack: time.Millisecond * 10, Release: time.Millisecond * 100})
+
+	pcm := make([]float32, FrameSamples)
+	run := func(frames int, ducked bool) {
+		for i := 0; i < frames; i++ {
+			for j := range pcm {
+				pcm[j] = 1
+			}
+			d.Process(pcm, ducked)
+		}
+	}
+
+	run(5, true)
+	if g := d.Gain(); g > -11.9 {
+		t.Error("Not ducked by 12 dB after 100ms, gain: ", g)
+	}
+	if last := float64(pcm[len(pcm)-1]); last > dbToLinear(-11.9) {
+		t.Error("Ducking not applied to the pcm: ", last)
+	}
+
+	// Released slower than it attacked
+	run(1, false)
+	if d.Unity() {
+		t.Error("Released within a single frame")
+	}
+	run(50, false)
+	if !d.Unity() {
+		t.Error("Not released after a second, gain: ", d.Gain())
+	}
+
+	// Disabled never ducks
+	d.Set(TalkoverSettings{Depth: 12})
+	run(5, true)
+	if !d.Unity() {
+		t.Error("Ducked while disabled, gain: ", d.Gain())
+	}
+}
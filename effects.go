@@ -0,0 +1,147 @@
+package main
+
+import (
+	"github.com/pkg/errors"
+	"sort"
+	"strings"
+)
+
+var (
+	ErrUnknownEffect  = errors.New("Unknown effect")
+	ErrTooManyEffects = errors.New("Too many effects")
+	ErrNoSuchEffect   = errors.New("Effect not in use")
+)
+
+// MaxEffects is the max number of effects on a single speaker or the master bus
+const MaxEffects = 4
+
+// Effect processes the audio of a speaker or the master bus, one 20ms interleaved stereo frame at a time,
+// with full scale being 1. Process is called from the mixer and must not allocate.
+type Effect interface {
+	Process(pcm []float32)
+}
+
+// EffectFactory creates a new instance of an effect, every speaker gets their own as effects keep state between frames
+type EffectFactory func() Effect
+
+var effectRegistry = make(map[string]EffectFactory)
+
+// RegisterEffect makes the effect available by name, replacing any previous effect with the same name
+func RegisterEffect(name string, factory EffectFactory) {
+	effectRegistry[strings.ToLower(name)] = factory
+}
+
+// EffectNames returns the names of all registered effects, sorted
+func EffectNames() []string {
+	names := make([]string, 0, len(effectRegistry))
+	for name := range effectRegistry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// namedEffect is an effect instance in a chain
+type namedEffect struct {
+	name string
+	Effect
+}
+
+// EffectChain is a list of effects run in order
+type EffectChain []namedEffect
+
+// Process runs the pcm through all the effects
+func (ec EffectChain) Process(pcm []float32) {
+	for _, e := range ec {
+		e.Process(pcm)
+	}
+}
+
+// Names returns the names of the effects in order
+func (ec EffectChain) Names() []string {
+	names := make([]string, len(ec))
+	for i, e := range ec {
+		names[i] = e.name
+	}
+	return names
+}
+
+// add returns the chain with a new instance of the named effect appended
+func (ec EffectChain) add(name string) (EffectChain, error) {
+	factory, ok := effectRegistry[strings.ToLower(name)]
+	if !ok {
+		return ec, ErrUnknownEffect
+	}
+
+	if len(ec) >= MaxEffects {
+		return ec, ErrTooManyEffects
+	}
+
+	return append(ec, namedEffect{name: strings.ToLower(name), Effect: factory()}), nil
+}
+
+// remove returns the chain without the last instance of the named effect
+func (ec EffectChain) remove(name string) (EffectChain, error) {
+	name = strings.ToLower(name)
+	for i := len(ec) - 1; i >= 0; i-- {
+		if ec[i].name == name {
+			return append(ec[:i], ec[i+1:]...), nil
+		}
+	}
+
+	return ec, ErrNoSuchEffect
+}
+
+// AddEffect adds the named effect to the end of the user's chain, or the master bus if userID is empty
+func (mix *Mixer) AddEffect(userID, name string) error {
+	mix.usersLock.Lock()
+	defer mix.usersLock.Unlock()
+
+	if userID == "" {
+		chain, err := mix.masterEffects.add(name)
+		mix.masterEffects = chain
+		return err
+	}
+
+	chain, err := mix.userEffects[userID].add(name)
+	if err == nil {
+		mix.userEffects[userID] = chain
+	}
+	return err
+}
+
+// RemoveEffect removes the named effect from the user's chain, or the master bus if userID is empty
+func (mix *Mixer) RemoveEffect(userID, name string) error {
+	mix.usersLock.Lock()
+	defer mix.usersLock.Unlock()
+
+	if userID == "" {
+		chain, err := mix.masterEffects.remove(name)
+		mix.masterEffects = chain
+		return err
+	}
+
+	chain, err := mix.userEffects[userID].remove(name)
+	if err != nil {
+		return err
+	}
+
+	if len(chain) < 1 {
+		delete(mix.userEffects, userID)
+	} else {
+		mix.userEffects[userID] = chain
+	}
+	return nil
+}
+
+// Effects returns the names of the effects on the master bus and on every user with any
+func (mix *Mixer) Effects() (master []string, users map[string][]string) {
+	mix.usersLock.Lock()
+	master = mix.masterEffects.Names()
+	users = make(map[string][]string, len(mix.userEffects))
+	for userID, chain := range mix.userEffects {
+		users[userID] = chain.Names()
+	}
+	mix.usersLock.Unlock()
+	return
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+func init() {
+	RegisterEffect("echo", func() Effect { return NewEcho(time.Millisecond*300, 0.4, 0.5) })
+	RegisterEffect("reverb", func() Effect { return NewReverb(0.84, 0.2, 0.35) })
+	RegisterEffect("pitchup", func() Effect { return NewPitchShift(5) })
+	RegisterEffect("pitchdown", func() Effect { return NewPitchShift(-5) })
+	RegisterEffect("robot", func() Effect { return NewRobot(50) })
+	RegisterEffect("bitcrush", func() Effect { return NewBitcrush(6, 6) })
+}
+
+// Echo repeats the audio after a delay, each repeat quieter than the last
+type Echo struct {
+	Feedback float32
+	Mix      float32
+
+	buf []float32
+	pos int
+}
+
+func NewEcho(delay time.Duration, feedback, mix float32) *Echo {
+	return &Echo{
+		Feedback: feedback,
+		Mix:      mix,
+		buf:      make([]float32, int(delay.Seconds()*SampleRate)*2),
+	}
+}
+
+func (e *Echo) Process(pcm []float32) {
+	for i, v := range pcm {
+		delayed := e.buf[e.pos]
+		e.buf[e.pos] = v + delayed*e.Feedback
+		pcm[i] = v + delayed*e.Mix
+
+		e.pos++
+		if e.pos >= len(e.buf) {
+			e.pos = 0
+		}
+	}
+}
+
+// Comb and allpass delays of the reverb at 44.1khz, from freeverb
+var (
+	reverbCombTunings    = []int{1116, 1188, 1277, 1356}
+	reverbAllpassTunings = []int{556, 441}
+)
+
+// The right channel's delays are offset by this many samples to decorrelate the channels
+const reverbStereoSpread = 23
+
+type reverbComb struct {
+	buf   []float32
+	pos   int
+	store float32
+}
+
+func (c *reverbComb) process(x, feedback, damp float32) float32 {
+	y := c.buf[c.pos]
+	c.store = y*(1-damp) + c.store*damp
+	c.buf[c.pos] = x + c.store*feedback
+
+	c.pos++
+	if c.pos >= len(c.buf) {
+		c.pos = 0
+	}
+	return y
+}
+
+type reverbAllpass struct {
+	buf []float32
+	pos int
+}
+
+func (a *reverbAllpass) process(x float32) float32 {
+	b := a.buf[a.pos]
+	a.buf[a.pos] = x + b*0.5
+
+	a.pos++
+	if a.pos >= len(a.buf) {
+		a.pos = 0
+	}
+	return b - x
+}
+
+// Reverb is a small freeverb style reverb, a set of parallel damped comb filters followed by allpass filters
+type Reverb struct {
+	Feedback float32 // Room size
+	Damp     float32 // How fast the highs die out
+	Mix      float32
+
+	combs     [2][]reverbComb
+	allpasses [2][]reverbAllpass
+}
+
+func NewReverb(feedback, damp, mix float32) *Reverb {
+	r := &Reverb{
+		Feedback: feedback,
+		Damp:     damp,
+		Mix:      mix,
+	}
+
+	scale := SampleRate / 44100.0
+	for ch := 0; ch < 2; ch++ {
+		for _, t := range reverbCombTunings {
+			r.combs[ch] = append(r.combs[ch], reverbComb{buf: make([]float32, int(float64(t+ch*reverbStereoSpread)*scale))})
+		}
+		for _, t := range reverbAllpassTunings {
+			r.allpasses[ch] = append(r.allpasses[ch], reverbAllpass{buf: make([]float32, int(float64(t+ch*reverbStereoSpread)*scale))})
+		}
+	}
+
+	return r
+}
+
+func (r *Reverb) Process(pcm []float32) {
+	for i, v := range pcm {
+		ch := i & 1
+
+		// Scaled down as the combs resonate
+		in := v * 0.05
+		var wet float32
+		for j := range r.combs[ch] {
+			wet += r.combs[ch][j].process(in, r.Feedback, r.Damp)
+		}
+		for j := range r.allpasses[ch] {
+			wet = r.allpasses[ch][j].process(wet)
+		}
+
+		pcm[i] = v + wet*r.Mix
+	}
+}
+
+// The window of the pitch shifter in samples, long enough for the lowest voices, short enough to not sound like an echo
+const (
+	pitchWindow  = 2048
+	pitchBufSize = pitchWindow * 2 // Power of 2 above the window
+)
+
+// PitchShift shifts the pitch without changing the speed, using two read heads moving through a delay line
+// at a different speed than it's written, crossfaded so the jumps back when they wrap around aren't heard
+type PitchShift struct {
+	ratio float64
+
+	buf   [2][]float32
+	write int
+	phase float64
+}
+
+// NewPitchShift returns a new pitch shifter shifting by the specified number of semitones
+func NewPitchShift(semitones float64) *PitchShift {
+	return &PitchShift{
+		ratio: math.Pow(2, semitones/12),
+		buf:   [2][]float32{make([]float32, pitchBufSize), make([]float32, pitchBufSize)},
+	}
+}
+
+// read returns the sample delay samples back, interpolated
+func (p *PitchShift) read(ch int, delay float64) float32 {
+	pos := float64(p.write) - delay
+	i := int(math.Floor(pos))
+	frac := float32(pos - float64(i))
+
+	a := p.buf[ch][i&(pitchBufSize-1)]
+	b := p.buf[ch][(i+1)&(pitchBufSize-1)]
+	return a + (b-a)*frac
+}
+
+func (p *PitchShift) Process(pcm []float32) {
+	for i := 0; i+1 < len(pcm); i += 2 {
+		// The delay changes by 1-ratio every sample, so the heads read at ratio times the speed they're written
+		p.phase += (1 - p.ratio) / pitchWindow
+		p.phase -= math.Floor(p.phase)
+
+		phase2 := p.phase + 0.5
+		if phase2 >= 1 {
+			phase2--
+		}
+
+		// sin² windows of the two heads sum up to 1
+		w1 := math.Sin(math.Pi * p.phase)
+		w1 *= w1
+		w2 := 1 - w1
+
+		p.buf[0][p.write] = pcm[i]
+		p.buf[1][p.write] = pcm[i+1]
+
+		for ch := 0; ch < 2; ch++ {
+			pcm[i+ch] = p.read(ch, p.phase*pitchWindow)*float32(w1) + p.read(ch, phase2*pitchWindow)*float32(w2)
+		}
+
+		p.write = (p.write + 1) & (pitchBufSize - 1)
+	}
+}
+
+// Robot ring modulates the audio with a low sine, giving voices a metallic robotic sound
+type Robot struct {
+	step  float64
+	phase float64
+}
+
+// NewRobot returns a new ring modulator at the frequency in hz
+func NewRobot(freq float64) *Robot {
+	return &Robot{
+		step: 2 * math.Pi * freq / SampleRate,
+	}
+}
+
+func (r *Robot) Process(pcm []float32) {
+	for i := 0; i+1 < len(pcm); i += 2 {
+		m := float32(math.Sin(r.phase))
+		pcm[i] *= m
+		pcm[i+1] *= m
+
+		r.phase += r.step
+		if r.phase > 2*math.Pi {
+			r.phase -= 2 * math.Pi
+		}
+	}
+}
+
+// Bitcrush lowers the bit depth and sample rate for a lo-fi sound
+type Bitcrush struct {
+	levels float32
+	hold   int
+
+	held    [2]float32
+	counter int
+}
+
+// NewBitcrush returns a new bitcrusher quantizing to bits and holding each sample for hold samples
+func NewBitcrush(bits uint, hold int) *Bitcrush {
+	return &Bitcrush{
+		levels: float32(int(1) << (bits - 1)),
+		hold:   hold,
+	}
+}
+
+func (b *Bitcrush) Process(pcm []float32) {
+	for i := 0; i+1 < len(pcm); i += 2 {
+		if b.counter == 0 {
+			for ch := 0; ch < 2; ch++ {
+				b.held[ch] = float32(math.Round(float64(pcm[i+ch]*b.levels))) / b.levels
+			}
+		}
+
+		b.counter++
+		if b.counter >= b.hold {
+			b.counter = 0
+		}
+
+		pcm[i] = b.held[0]
+		pcm[i+1] = b.held[1]
+	}
+}
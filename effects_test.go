@@ -0,0 +1,68 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestEffects(t *testing.T) {
+	pcm := make([]float32, FrameSamples)
+	phase := 0.0
+
+	for _, name := range EffectNames() {
+		effect := effectRegistry[name]()
+
+		allocs := testing.AllocsPerRun(50, func() {
+			for i := 0; i < len(pcm); i += 2 {
+				v := float32(math.Sin(phase) * 0.5)
+				pcm[i], pcm[i+1] = v, v
+				phase += 2 * math.Pi * 440 / SampleRate
+			}
+
+			effect.Process(pcm)
+		})
+		if allocs > 0 {
+			t.Errorf("%s: Allocated %f times per frame", name, allocs)
+		}
+
+		for _, v := range pcm {
+			if math.IsNaN(float64(v)) || absf32(v) > 4 {
+				t.Errorf("%s: Output out of bounds: %f", name, v)
+				break
+			}
+		}
+	}
+}
+
+func TestMixerEffects(t *testing.T) {
+	mix := NewMixer()
+
+	if err := mix.AddEffect("1", "nope"); err != ErrUnknownEffect {
+		t.Error("Expected ErrUnknownEffect, got ", err)
+	}
+
+	for i := 0; i < MaxEffects; i++ {
+		if err := mix.AddEffect("1", "echo"); err != nil {
+			t.Fatal("Failed adding effect: ", err)
+		}
+	}
+	if err := mix.AddEffect("1", "reverb"); err != ErrTooManyEffects {
+		t.Error("Expected ErrTooManyEffects, got ", err)
+	}
+
+	if err := mix.AddEffect("", "Robot"); err != nil {
+		t.Error("Failed adding master effect: ", err)
+	}
+	if err := mix.RemoveEffect("1", "reverb"); err != ErrNoSuchEffect {
+		t.Error("Expected ErrNoSuchEffect, got ", err)
+	}
+
+	for i := 0; i < MaxEffects; i++ {
+		mix.RemoveEffect("1", "echo")
+	}
+
+	master, users := mix.Effects()
+	if len(master) != 1 || master[0] != "robot" || len(users) != 0 {
+		t.Errorf("Unexpected effects: %v, %v", master, users)
+	}
+}
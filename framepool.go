@@ -0,0 +1,53 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// maxOpusFrameSize is the largest encoded 20ms frame, a toc byte and the 1275 byte max frame size with some room to spare
+const maxOpusFrameSize = 1500
+
+var opusFramePool = sync.Pool{
+	New: func() interface{} {
+		return &opusFrame{buf: make([]byte, maxOpusFrameSize)}
+	},
+}
+
+// opusFrame is a pooled, reference counted encoded frame shared between the delay line and the output queues.
+// Every holder owns a reference, and the frame goes back to the pool once the last one is released.
+type opusFrame struct {
+	buf  []byte
+	data []byte
+	refs int32
+
+	// Whether the frame was encoded from silence
+	silent bool
+}
+
+// newOpusFrame returns a frame from the pool with a single reference, data is to be filled in by the caller
+func newOpusFrame() *opusFrame {
+	f := opusFramePool.Get().(*opusFrame)
+	f.refs = 1
+	f.data = f.buf[:0]
+	f.silent = false
+	return f
+}
+
+// wrapOpusFrame returns a frame with a single reference holding the packet, which must not be modified afterwards
+func wrapOpusFrame(packet []byte) *opusFrame {
+	f := newOpusFrame()
+	f.data = packet
+	return f
+}
+
+func (f *opusFrame) retain() {
+	atomic.AddInt32(&f.refs, 1)
+}
+
+func (f *opusFrame) release() {
+	if atomic.AddInt32(&f.refs, -1) == 0 {
+		f.data = nil
+		opusFramePool.Put(f)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"sync"
+)
+
+// SpeakerIdentities maps the ssrc's of a voice connection to discord users, built from speaking updates.
+// Users get a new ssrc when they rejoin, the user is then mapped to the newest one.
+type SpeakerIdentities struct {
+	sync.RWMutex
+
+	ssrcToUser map[uint32]string
+	userToSSRC map[string]uint32
+}
+
+// NewSpeakerIdentities returns a new empty identity map
+func NewSpeakerIdentities() *SpeakerIdentities {
+	return &SpeakerIdentities{
+		ssrcToUser: make(map[uint32]string),
+		userToSSRC: make(map[string]uint32),
+	}
+}
+
+// Set maps the ssrc to the user
+func (si *SpeakerIdentities) Set(ssrc uint32, userID string) {
+	si.Lock()
+	si.ssrcToUser[ssrc] = userID
+	si.userToSSRC[userID] = ssrc
+	si.Unlock()
+}
+
+// User returns the user behind the ssrc
+func (si *SpeakerIdentities) User(ssrc uint32) (userID string, ok bool) {
+	si.RLock()
+	userID, ok = si.ssrcToUser[ssrc]
+	si.RUnlock()
+	return
+}
+
+// SSRC returns the current ssrc of the user
+func (si *SpeakerIdentities) SSRC(userID string) (ssrc uint32, ok bool) {
+	si.RLock()
+	ssrc, ok = si.userToSSRC[userID]
+	si.RUnlock()
+	return
+}
+
+// RemoveSSRC forgets the ssrc of a user who left. The user stays mapped to
+// a newer ssrc if they already rejoined
+func (si *SpeakerIdentities) RemoveSSRC(ssrc uint32) {
+	si.Lock()
+	userID, ok := si.ssrcToUser[ssrc]
+	delete(si.ssrcToUser, ssrc)
+	if ok && si.userToSSRC[userID] == ssrc {
+		delete(si.userToSSRC, userID)
+	}
+	si.Unlock()
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"github.com/jonas747/discordgo"
+)
+
+const (
+	// DefaultJitterTarget is the number of 20ms frames held back at the start of a talk spurt
+	DefaultJitterTarget = 3
+
+	// DefaultJitterMax is the max number of frames buffered before the oldest ones gets dropped
+	DefaultJitterMax = 10
+)
+
+var (
+	// OpusSilence is the silence frame discord clients send at the end of a talk spurt
+	OpusSilence = []byte{0xF8, 0xFF, 0xFE}
+)
+
+// JitterStats contains the current depth and counters of a JitterBuffer
+type JitterStats struct {
+	Depth     int // Number of packets currently buffered
+	Late      int // Packets that arrived after their playout slot had passed
+	Duplicate int // Packets received more than once
+	Dropped   int // Packets dropped to keep the latency bounded
+	Rebuffers int // Times the buffer ran dry and had to build up the target delay again
+}
+
+// JitterBuffer reorders the packets of a single ssrc by their sequence number
+// and releases them one playout slot at a time, holding back TargetDelay frames
+// at the start of every talk spurt to absorb network jitter.
+// It is not safe for concurrent use.
+type JitterBuffer struct {
+	TargetDelay int
+	MaxDelay    int
+
+	// Sorted by sequence number
+	packets []*discordgo.Packet
+	playing bool
+	nextSeq uint16
+
+	stats JitterStats
+}
+
+// NewJitterBuffer returns a new jitter buffer with the specified target and max delay in frames
+func NewJitterBuffer(target, max int) *JitterBuffer {
+	if max < target {
+		max = target
+	}
+
+	return &JitterBuffer{
+		TargetDelay: target,
+		MaxDelay:    max,
+		packets:     make([]*discordgo.Packet, 0, max+1),
+	}
+}
+
+// seqBefore returns true if sequence number a comes before b, taking wraparound into account
+func seqBefore(a, b uint16) bool {
+	return int16(a-b) < 0
+}
+
+// isSilenceFrame returns true if the opus packet is the standard 3 byte silence frame
+func isSilenceFrame(opus []byte) bool {
+	return bytes.Equal(opus, OpusSilence)
+}
+
+// Push inserts a packet into the buffer at its place in the sequence
+func (jb *JitterBuffer) Push(p *discordgo.Packet) {
+	if jb.playing && seqBefore(p.Sequence, jb.nextSeq) {
+		// Its slot has already been played out
+		jb.stats.Late++
+		return
+	}
+
+	// Search from the back as packets mostly arrive in order
+	i := len(jb.packets)
+	for i > 0 && seqBefore(p.Sequence, jb.packets[i-1].Sequence) {
+		i--
+	}
+
+	if i > 0 && jb.packets[i-1].Sequence == p.Sequence {
+		jb.stats.Duplicate++
+		return
+	}
+
+	jb.packets = append(jb.packets, nil)
+	copy(jb.packets[i+1:], jb.packets[i:])
+	jb.packets[i] = p
+
+	// If the speaker's clock runs faster than ours the buffer slowly grows,
+	// drop the oldest packets to keep the latency bounded
+	for len(jb.packets) > jb.MaxDelay {
+		jb.dropHead()
+	}
+}
+
+// Pop returns the packet for the next playout slot, or nil if there's nothing to play.
+// lost is true if the packet for this slot is missing while later ones are buffered.
+func (jb *JitterBuffer) Pop() (p *discordgo.Packet, lost bool) {
+	if !jb.playing {
+		if len(jb.packets) < 1 || len(jb.packets) < jb.TargetDelay {
+			// Still buffering up
+			return nil, false
+		}
+
+		jb.playing = true
+		jb.nextSeq = jb.packets[0].Sequence
+	}
+
+	if len(jb.packets) < 1 {
+		// Ran dry, either the talk spurt ended or the network stalled
+		jb.playing = false
+		jb.stats.Rebuffers++
+		return nil, false
+	}
+
+	// Skip silence frames while we're above the target delay, this catches up on drift
+	// without any audible artifacts
+	for len(jb.packets) > jb.TargetDelay && len(jb.packets) > 1 && jb.packets[0].Sequence == jb.nextSeq && isSilenceFrame(jb.packets[0].Opus) {
+		jb.dropHead()
+	}
+
+	head := jb.packets[0]
+	if head.Sequence != jb.nextSeq {
+		if int(head.Sequence-jb.nextSeq) > jb.MaxDelay {
+			// Too large of a gap to be packet loss, the sender probably reset, resync to it
+			jb.nextSeq = head.Sequence
+		} else {
+			jb.nextSeq++
+			return nil, true
+		}
+	}
+
+	jb.shift()
+	jb.nextSeq++
+	return head, false
+}
+
+// Peek returns the packet for the next playout slot if it's buffered, without removing it
+func (jb *JitterBuffer) Peek() *discordgo.Packet {
+	if !jb.playing || len(jb.packets) < 1 || jb.packets[0].Sequence != jb.nextSeq {
+		return nil
+	}
+
+	return jb.packets[0]
+}
+
+// Depth returns the number of packets currently buffered
+func (jb *JitterBuffer) Depth() int {
+	return len(jb.packets)
+}
+
+// Stats returns the current depth and counters
+func (jb *JitterBuffer) Stats() JitterStats {
+	stats := jb.stats
+	stats.Depth = len(jb.packets)
+	return stats
+}
+
+func (jb *JitterBuffer) dropHead() {
+	head := jb.packets[0]
+	jb.shift()
+
+	if jb.playing && !seqBefore(head.Sequence, jb.nextSeq) {
+		jb.nextSeq = head.Sequence + 1
+	}
+	jb.stats.Dropped++
+}
+
+// shift removes the first packet, reusing the backing array
+func (jb *JitterBuffer) shift() {
+	copy(jb.packets, jb.packets[1:])
+	jb.packets[len(jb.packets)-1] = nil
+	jb.packets = jb.packets[:len(jb.packets)-1]
+}
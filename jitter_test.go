@@ -0,0 +1,63 @@
+package main
+
+import (
+	"github.com/jonas747/discordgo"
+	"testing"
+)
+
+func pushSeqs(jb *JitterBuffer, seqs ...uint16) {
+	for _, seq := range seqs {
+		jb.Push(&discordgo.Packet{Sequence: seq, Opus: []byte{0xFC, byte(seq)}})
+	}
+}
+
+func TestJitterBufferReorder(t *testing.T) {
+	jb := NewJitterBuffer(3, 10)
+	pushSeqs(jb, 65534, 0, 65535, 1)
+
+	expected := []uint16{65534, 65535, 0, 1}
+	for _, seq := range expected {
+		p, lost := jb.Pop()
+		if p == nil || lost {
+			t.Fatalf("Expected packet %d, got nil (lost: %t)", seq, lost)
+		}
+		if p.Sequence != seq {
+			t.Errorf("Expected packet %d, got %d", seq, p.Sequence)
+		}
+	}
+
+	// Arrived after its slot was played out
+	pushSeqs(jb, 1)
+	if jb.Stats().Late != 1 {
+		t.Error("Late packet not counted: ", jb.Stats().Late)
+	}
+}
+
+func TestJitterBufferGapAndDrift(t *testing.T) {
+	jb := NewJitterBuffer(2, 4)
+
+	// Nothing is released until the target delay is reached
+	pushSeqs(jb, 10)
+	if p, _ := jb.Pop(); p != nil {
+		t.Error("Packet released before target delay was reached")
+	}
+
+	pushSeqs(jb, 12)
+	if p, _ := jb.Pop(); p == nil || p.Sequence != 10 {
+		t.Fatal("Expected packet 10")
+	}
+	if p, lost := jb.Pop(); p != nil || !lost {
+		t.Error("Expected slot 11 to be reported as lost")
+	}
+	if p, _ := jb.Pop(); p == nil || p.Sequence != 12 {
+		t.Fatal("Expected packet 12")
+	}
+
+	pushSeqs(jb, 13, 14, 15, 16, 17, 18)
+	if jb.Depth() != 4 {
+		t.Error("Depth not bounded by max delay: ", jb.Depth())
+	}
+	if p, _ := jb.Pop(); p == nil || p.Sequence != 15 {
+		t.Error("Expected the oldest packets to be dropped")
+	}
+}
@@ -18,6 +18,11 @@ type Listener struct {
 	stop    chan bool
 	vc      *discordgo.VoiceConnection
 	station *Station
+
+	// The mixer reuses the frames it gives us, so they're copied into this ring before being
+	// handed to discordgo. It has room for every frame in OpusSend, the one being sent and the next one.
+	sendBufs [][]byte
+	sendPos  int
 }
 
 func (l *Listener) Stop() {
@@ -35,12 +40,42 @@ func (l *Listener) Start(voiceChannelID string) error {
 	}
 
 	l.vc = vc
+	l.sendBufs = make([][]byte, cap(vc.OpusSend)+2)
+	for i := range l.sendBufs {
+		l.sendBufs[i] = make([]byte, 0, maxOpusFrameSize)
+	}
 	return nil
 }
 
+// OutputDisconnected implements OutputDisconnecter, called when we couldn't keep up with the mixer
+func (l *Listener) OutputDisconnected() {
+	l.vc.Close()
+	l.station.RemoveListener(l)
+}
+
+func (l *Listener) String() string {
+	return "Listener in " + l.GuildID
+}
+
+// SetSpeaking implements SpeakingOutput, so the speaking ring in the listening server matches the broadcast
+func (l *Listener) SetSpeaking(speaking bool) error {
+	if !speaking {
+		// Let the tail of silence frames still queued up in discordgo go out first
+		for i := 0; len(l.vc.OpusSend) > 0 && i < cap(l.vc.OpusSend); i++ {
+			time.Sleep(FrameDuration)
+		}
+	}
+
+	return l.vc.Speaking(speaking)
+}
+
 func (l *Listener) WriteOpus(data []byte) error {
+	buf := append(l.sendBufs[l.sendPos][:0], data...)
+	l.sendBufs[l.sendPos] = buf
+	l.sendPos = (l.sendPos + 1) % len(l.sendBufs)
+
 	select {
-	case l.vc.OpusSend <- data:
+	case l.vc.OpusSend <- buf:
 		return nil
 	case <-time.After(time.Second):
 	case <-l.stop:
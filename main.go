@@ -17,6 +17,29 @@ import (
 var (
 	Token string
 
+	RecordingsDir     string
+	RecordMaxSize     int64
+	RecordMaxDuration time.Duration
+
+	SoundsDir string
+	MusicDir  string
+
+	ClipMaxLength time.Duration
+	ClipCooldown  time.Duration
+
+	OutputQueueSize  int
+	SlowPolicy       = DropOldest
+	slowConsumerFlag string
+
+	Passthrough     bool
+	SuppressSilence bool
+	MaxSpeakers     int
+	AutoPan         bool
+
+	// Ticks the mixers of all stations
+	Scheduler    *FrameScheduler
+	MixerWorkers int
+
 	runningChannels = make([]chan *sync.WaitGroup, 0)
 	runningLock     sync.Mutex
 	DG              *discordgo.Session
@@ -27,6 +50,20 @@ func init() {
 	// flag.StringVar(&GuildID, "g", "288075199415320578", "GuilID")
 	// flag.StringVar(&ChannelID, "c", "288079314384191488", "ChannelID")
 	// flag.StringVar(&Token, "t", "", "Account Token")
+	flag.StringVar(&RecordingsDir, "recordings", "recordings", "Directory recordings are saved in")
+	flag.Int64Var(&RecordMaxSize, "recmaxsize", 100, "Max size of a recording file in megabytes before a new one is started, 0 for no limit")
+	flag.DurationVar(&RecordMaxDuration, "recmaxduration", time.Hour, "Max duration of a recording file before a new one is started, 0 for no limit")
+	flag.StringVar(&SoundsDir, "sounds", "sounds", "Directory of the soundboard's library of DCA, Ogg Opus and WAV files")
+	flag.StringVar(&MusicDir, "music", "music", "Directory of the music bed's library of DCA, Ogg Opus and WAV files")
+	flag.DurationVar(&ClipMaxLength, "clipmax", time.Minute, "Max length of clips, this much audio is kept in memory for every station")
+	flag.DurationVar(&ClipCooldown, "clipcooldown", time.Second*30, "Time between clips of a station")
+	flag.IntVar(&OutputQueueSize, "outputqueue", DefaultOutputQueueSize, "Number of 20ms frames queued per output before the slow consumer policy kicks in")
+	flag.StringVar(&slowConsumerFlag, "slowpolicy", DropOldest.String(), "What to do with outputs that can't keep up: dropoldest, dropnewest or disconnect")
+	flag.BoolVar(&Passthrough, "passthrough", true, "Send the packets of a single speaker as is instead of re-encoding them")
+	flag.BoolVar(&SuppressSilence, "suppresssilence", true, "Stop sending to listeners while the broadcast is silent")
+	flag.IntVar(&MaxSpeakers, "maxspeakers", 0, "Max number of speakers mixed in at once not counting the hosts, 0 for no limit")
+	flag.BoolVar(&AutoPan, "autopan", false, "Spread speakers across the stereo field as they join")
+	flag.IntVar(&MixerWorkers, "mixworkers", 0, "Number of workers mixing the stations, 0 for one per cpu")
 	flag.Parse()
 }
 
@@ -34,6 +71,15 @@ func main() {
 
 	llog.SetOutput(os.Stderr)
 
+	if policy, ok := ParseSlowConsumerPolicy(slowConsumerFlag); ok {
+		SlowPolicy = policy
+	} else {
+		log("Unknown slow consumer policy ", slowConsumerFlag, ", using ", SlowPolicy)
+	}
+
+	Scheduler = NewFrameScheduler(RealClock, MixerWorkers)
+	go Scheduler.Run()
+
 	// Create a new Discord session using the provided login information.
 	// Use discordgo.New(Token) to just use a token for login.
 	dg, err := discordgo.New(os.Getenv("DG_TOKEN"))
@@ -54,6 +100,7 @@ func main() {
 
 	sys := dcmd.NewStandardSystem("!r")
 	dg.AddHandler(sys.HandleMessageCreate)
+	dg.AddHandler(HandleVoiceStateUpdate)
 	InitCommands(sys)
 
 	sc := make(chan os.Signal, 1)
@@ -62,6 +109,17 @@ func main() {
 	Stop()
 }
 
+// HandleVoiceStateUpdate passes voice state updates on to the station broadcasted from the guild
+func HandleVoiceStateUpdate(s *discordgo.Session, vs *discordgo.VoiceStateUpdate) {
+	ActiveLock.RLock()
+	st, ok := ActiveGuilds[vs.GuildID]
+	ActiveLock.RUnlock()
+
+	if ok && st.Meta().GuildID == vs.GuildID {
+		st.VoiceStateUpdateHandler(vs)
+	}
+}
+
 func Stop() {
 	fmt.Println("stopping")
 
@@ -74,6 +132,7 @@ func Stop() {
 	runningLock.Unlock()
 	fmt.Println("Waiting")
 	wg.Wait()
+	Scheduler.Stop()
 	DG.Close()
 
 	fmt.Println("Done Waiting")
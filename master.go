@@ -0,0 +1,379 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultLimiterCeiling is the max output peak of the master limiter in dBFS
+	DefaultLimiterCeiling = -1.0
+
+	DefaultLimiterLookahead = time.Millisecond * 5
+	DefaultLimiterRelease   = time.Millisecond * 150
+
+	// DefaultLoudnessTarget is the default normalization target in LUFS, common for spoken word streams
+	DefaultLoudnessTarget = -16.0
+
+	// MaxNormalizeGain is the max amount of gain in dB the normalizer will apply in either direction
+	MaxNormalizeGain = 12.0
+
+	// How fast the normalizer changes its gain, in dB per second
+	normalizeRate = 3.0
+
+	// The normalizer holds its gain while the short term loudness is below this, so silence
+	// and room noise doesn't get pumped up
+	normalizeGateLUFS = -50.0
+
+	// EBU R128 absolute gate, and the resolution of the integrated loudness histogram
+	loudnessMinLUFS  = -70.0
+	loudnessHistBins = 800 // 0.1 LU bins from -70 to +10 LUFS
+	loudnessSubBlock = SampleRate / 10
+)
+
+// Limiter is a look-ahead peak limiter, the signal is delayed so that the gain can be brought
+// down smoothly before a peak arrives instead of clipping it.
+// It is not safe for concurrent use.
+type Limiter struct {
+	Ceiling float32
+
+	attack  float64
+	release float64
+	gain    float64
+
+	// Interleaved stereo delay line
+	delay []float32
+	pos   int
+
+	// Lowest required gain over the samples in the delay line
+	window *slidingMin
+}
+
+// NewLimiter returns a new limiter with the specified ceiling in dBFS
+func NewLimiter(ceilingDB float64, lookahead, release time.Duration) *Limiter {
+	frames := int(lookahead.Seconds() * SampleRate)
+
+	return &Limiter{
+		Ceiling: float32(dbToLinear(ceilingDB)),
+		// Settle on the target gain well within the look-ahead window
+		attack:  timeCoeff(lookahead.Seconds()/8, 1),
+		release: timeCoeff(release.Seconds(), 1),
+		gain:    1,
+		delay:   make([]float32, frames*2),
+		window:  newSlidingMin(frames + 1),
+	}
+}
+
+// Process limits the interleaved stereo pcm in place
+func (l *Limiter) Process(pcm []float32) {
+	for i := 0; i+1 < len(pcm); i += 2 {
+		peak := absf32(pcm[i])
+		if r := absf32(pcm[i+1]); r > peak {
+			peak = r
+		}
+
+		required := 1.0
+		if peak > l.Ceiling {
+			required = float64(l.Ceiling / peak)
+		}
+
+		// Hold the gain down for as long as the peak is in the delay line
+		target := l.window.push(required)
+		if target < l.gain {
+			l.gain = target + (l.gain-target)*l.attack
+		} else {
+			l.gain = target + (l.gain-target)*l.release
+		}
+
+		left, right := pcm[i], pcm[i+1]
+		if len(l.delay) > 0 {
+			// Swap the incoming samples with the delayed ones
+			left, l.delay[l.pos] = l.delay[l.pos], left
+			right, l.delay[l.pos+1] = l.delay[l.pos+1], right
+			l.pos = (l.pos + 2) % len(l.delay)
+		}
+
+		g := float32(l.gain)
+		pcm[i] = softClip(left * g)
+		pcm[i+1] = softClip(right * g)
+	}
+}
+
+// GainReduction returns the current gain reduction in dB
+func (l *Limiter) GainReduction() float64 {
+	return -linearToDB(l.gain)
+}
+
+// LoudnessMeter measures the loudness of a stereo signal as specified in ITU-R BS.1770 / EBU R128.
+// It is not safe for concurrent use.
+type LoudnessMeter struct {
+	// K-weighting filter stages per channel
+	filters [2][2]biquad
+
+	sum   [2]float64
+	count int
+
+	// Ring of the mean square of the last 3 seconds of 100ms sub blocks
+	blocks       [30]float64
+	blockPos     int
+	blocksFilled int
+
+	// Histogram of the gating block loudness used for the integrated loudness,
+	// so it doesn't grow over long broadcasts
+	hist [loudnessHistBins]int
+}
+
+// NewLoudnessMeter returns a new loudness meter for 48khz audio
+func NewLoudnessMeter() *LoudnessMeter {
+	lm := &LoudnessMeter{}
+	for ch := 0; ch < 2; ch++ {
+		// High shelf modelling the acoustic effect of the head
+		lm.filters[ch][0] = biquad{b0: 1.53512485958697, b1: -2.69169618940638, b2: 1.19839281085285, a1: -1.69065929318241, a2: 0.73248077421585}
+		// RLB high pass
+		lm.filters[ch][1] = biquad{b0: 1, b1: -2, b2: 1, a1: -1.99004745483398, a2: 0.99007225036621}
+	}
+	return lm
+}
+
+// Process measures the interleaved stereo pcm
+func (lm *LoudnessMeter) Process(pcm []float32) {
+	for i := 0; i+1 < len(pcm); i += 2 {
+		for ch := 0; ch < 2; ch++ {
+			y := lm.filters[ch][1].process(lm.filters[ch][0].process(float64(pcm[i+ch])))
+			lm.sum[ch] += y * y
+		}
+
+		lm.count++
+		if lm.count >= loudnessSubBlock {
+			lm.endSubBlock()
+		}
+	}
+}
+
+func (lm *LoudnessMeter) endSubBlock() {
+	lm.blocks[lm.blockPos] = (lm.sum[0] + lm.sum[1]) / float64(lm.count)
+	lm.blockPos = (lm.blockPos + 1) % len(lm.blocks)
+	if lm.blocksFilled < len(lm.blocks) {
+		lm.blocksFilled++
+	}
+
+	lm.sum = [2]float64{}
+	lm.count = 0
+
+	// Every sub block completes a new 400ms gating block with 75% overlap
+	if lm.blocksFilled >= 4 {
+		l := lm.Momentary()
+		if l > loudnessMinLUFS {
+			bin := int((l - loudnessMinLUFS) * 10)
+			if bin >= len(lm.hist) {
+				bin = len(lm.hist) - 1
+			}
+			lm.hist[bin]++
+		}
+	}
+}
+
+func (lm *LoudnessMeter) lastBlocks(n int) float64 {
+	if lm.blocksFilled < n {
+		n = lm.blocksFilled
+	}
+	if n < 1 {
+		return math.Inf(-1)
+	}
+
+	sum := 0.0
+	for i := 1; i <= n; i++ {
+		sum += lm.blocks[(lm.blockPos-i+len(lm.blocks))%len(lm.blocks)]
+	}
+
+	return powerToLUFS(sum / float64(n))
+}
+
+// Momentary returns the loudness of the last 400ms in LUFS
+func (lm *LoudnessMeter) Momentary() float64 {
+	return lm.lastBlocks(4)
+}
+
+// ShortTerm returns the loudness of the last 3 seconds in LUFS
+func (lm *LoudnessMeter) ShortTerm() float64 {
+	return lm.lastBlocks(30)
+}
+
+// Integrated returns the gated loudness since the meter was created in LUFS
+func (lm *LoudnessMeter) Integrated() float64 {
+	// Absolute gate is already applied when filling the histogram
+	total, n := lm.gatedPower(loudnessMinLUFS)
+	if n < 1 {
+		return math.Inf(-1)
+	}
+
+	relativeGate := powerToLUFS(total/float64(n)) - 10
+	total, n = lm.gatedPower(relativeGate)
+	if n < 1 {
+		return math.Inf(-1)
+	}
+
+	return powerToLUFS(total / float64(n))
+}
+
+func (lm *LoudnessMeter) gatedPower(gate float64) (total float64, n int) {
+	for bin, count := range lm.hist {
+		l := loudnessMinLUFS + (float64(bin)+0.5)/10
+		if count < 1 || l < gate {
+			continue
+		}
+
+		total += float64(count) * lufsToPower(l)
+		n += count
+	}
+	return
+}
+
+func powerToLUFS(p float64) float64 {
+	return -0.691 + 10*math.Log10(p)
+}
+
+func lufsToPower(l float64) float64 {
+	return math.Pow(10, (l+0.691)/10)
+}
+
+// MasterStats contains the loudness and clip readings of the master bus
+type MasterStats struct {
+	Momentary  float64 // LUFS
+	ShortTerm  float64 // LUFS
+	Integrated float64 // LUFS
+
+	Peak          float64 // Highest sample peak before the limiter in dBFS
+	Clipped       int     // Samples that would have clipped without the limiter
+	GainReduction float64 // Current limiter gain reduction in dB
+
+	Normalize       bool
+	NormalizeTarget float64 // LUFS
+	NormalizeGain   float64 // dB currently applied by the normalizer
+}
+
+// MasterBus processes the summed float bus before it's encoded, optionally normalizing it
+// to a target loudness, and running it through the limiter so it never clips
+type MasterBus struct {
+	sync.Mutex
+
+	limiter *Limiter
+	meter   *LoudnessMeter
+
+	normalize       bool
+	normalizeTarget float64
+	normalizeGain   float64
+
+	peak    float32
+	clipped int
+
+	out []int16
+}
+
+// NewMasterBus returns a new master bus with normalization disabled
+func NewMasterBus() *MasterBus {
+	return &MasterBus{
+		limiter:         NewLimiter(DefaultLimiterCeiling, DefaultLimiterLookahead, DefaultLimiterRelease),
+		meter:           NewLoudnessMeter(),
+		normalizeTarget: DefaultLoudnessTarget,
+		out:             make([]int16, FrameSamples),
+	}
+}
+
+// SetNormalization enables or disables loudness normalization to the target in LUFS
+func (m *MasterBus) SetNormalization(enabled bool, target float64) {
+	m.Lock()
+	m.normalize = enabled
+	m.normalizeTarget = target
+	if !enabled {
+		m.normalizeGain = 0
+	}
+	m.Unlock()
+}
+
+// Normalizing returns true if loudness normalization is enabled
+func (m *MasterBus) Normalizing() bool {
+	m.Lock()
+	normalize := m.normalize
+	m.Unlock()
+	return normalize
+}
+
+// Process runs the interleaved stereo bus through the normalizer, limiter and meter,
+// and converts it to 16 bit pcm. The returned slice is reused on the next call.
+func (m *MasterBus) Process(bus []float32) []int16 {
+	m.Lock()
+
+	if m.normalize {
+		m.updateNormalizeGain(len(bus) / 2)
+		g := float32(dbToLinear(m.normalizeGain))
+		for i := range bus {
+			bus[i] *= g
+		}
+	}
+
+	for _, v := range bus {
+		v = absf32(v)
+		if v > m.peak {
+			m.peak = v
+		}
+		if v > 1 {
+			m.clipped++
+		}
+	}
+
+	m.limiter.Process(bus)
+	m.meter.Process(bus)
+
+	if cap(m.out) < len(bus) {
+		m.out = make([]int16, len(bus))
+	}
+	out := m.out[:len(bus)]
+	for i, v := range bus {
+		out[i] = int16(v * 0x7fff)
+	}
+
+	m.Unlock()
+	return out
+}
+
+// updateNormalizeGain steps the normalizer gain towards the one that would hit the target
+func (m *MasterBus) updateNormalizeGain(frames int) {
+	shortTerm := m.meter.ShortTerm()
+	if shortTerm < normalizeGateLUFS {
+		return
+	}
+
+	// The meter measures after our own gain, take it out to estimate the input loudness
+	desired := m.normalizeTarget - (shortTerm - m.normalizeGain)
+	desired = math.Max(-MaxNormalizeGain, math.Min(MaxNormalizeGain, desired))
+
+	step := normalizeRate * float64(frames) / SampleRate
+	switch {
+	case desired > m.normalizeGain+step:
+		m.normalizeGain += step
+	case desired < m.normalizeGain-step:
+		m.normalizeGain -= step
+	default:
+		m.normalizeGain = desired
+	}
+}
+
+// Stats returns the current loudness and clip readings
+func (m *MasterBus) Stats() MasterStats {
+	m.Lock()
+	stats := MasterStats{
+		Momentary:       m.meter.Momentary(),
+		ShortTerm:       m.meter.ShortTerm(),
+		Integrated:      m.meter.Integrated(),
+		Peak:            linearToDB(float64(m.peak)),
+		Clipped:         m.clipped,
+		GainReduction:   m.limiter.GainReduction(),
+		Normalize:       m.normalize,
+		NormalizeTarget: m.normalizeTarget,
+		NormalizeGain:   m.normalizeGain,
+	}
+	m.Unlock()
+	return stats
+}
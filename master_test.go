@@ -0,0 +1,52 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func sineFrame(buf []float32, amplitude float64, offset int) {
+	for i := 0; i < len(buf)/2; i++ {
+		v := float32(amplitude * math.Sin(2*math.Pi*1000*float64(offset+i)/SampleRate))
+		buf[i*2] = v
+		buf[i*2+1] = v
+	}
+}
+
+func TestLoudnessMeterSine(t *testing.T) {
+	lm := NewLoudnessMeter()
+	buf := make([]float32, FrameSamples)
+
+	// 5 seconds of a -20 dBFS 1khz sine in both channels should read -20 LUFS
+	for i := 0; i < 250; i++ {
+		sineFrame(buf, dbToLinear(-20), i*FrameSize)
+		lm.Process(buf)
+	}
+
+	for name, l := range map[string]float64{"momentary": lm.Momentary(), "short term": lm.ShortTerm(), "integrated": lm.Integrated()} {
+		if math.Abs(l+20) > 0.3 {
+			t.Errorf("Expected %s loudness of -20 LUFS, got %.2f", name, l)
+		}
+	}
+}
+
+func TestMasterBusLimits(t *testing.T) {
+	m := NewMasterBus()
+	buf := make([]float32, FrameSamples)
+	ceiling := int16(dbToLinear(DefaultLimiterCeiling)*0x7fff) + 1
+
+	for i := 0; i < 50; i++ {
+		// 4 speakers shouting at full scale
+		sineFrame(buf, 4, i*FrameSize)
+		out := m.Process(buf)
+		for _, v := range out[len(out)/2:] {
+			if v > ceiling || v < -ceiling {
+				t.Fatalf("Sample %d exceeds the ceiling of %d", v, ceiling)
+			}
+		}
+	}
+
+	if stats := m.Stats(); stats.Clipped < 1 || stats.GainReduction < 6 {
+		t.Errorf("Expected clips and gain reduction to be reported: %+v", stats)
+	}
+}
@@ -3,174 +3,851 @@ package main
 import (
 	"github.com/hraban/opus"
 	"github.com/jonas747/discordgo"
-	"github.com/jonas747/opusutil"
 	"github.com/pkg/errors"
+	"io"
+	"math"
+	"strings"
 	"sync"
 	"time"
 )
 
+var (
+	ErrInvalidOpusPacket = errors.New("Invalid opus packet")
+)
+
+// maxOpusPacketSamples is the max number of samples per channel in a single opus packet, 120ms
+const maxOpusPacketSamples = 5760
+
+// Samples per channel of a single frame at 48khz by the config number in the toc byte,
+// SILK (0-11) and Hybrid (12-15) modes repeat in groups of 4 and 2, CELT (16-31) in groups of 4
+var (
+	opusSilkFrameSamples   = [4]int{480, 960, 1920, 2880}
+	opusHybridFrameSamples = [2]int{480, 960}
+	opusCeltFrameSamples   = [4]int{120, 240, 480, 960}
+)
+
+// opusPacketSamples returns the number of samples per channel in the opus packet,
+// read straight from the toc byte (and frame count byte) as described in RFC 6716 section 3.1
+func opusPacketSamples(packet []byte) (int, error) {
+	if len(packet) < 1 {
+		return 0, ErrInvalidOpusPacket
+	}
+
+	toc := packet[0]
+	config := int(toc >> 3)
+
+	var frameSamples int
+	switch {
+	case config < 12:
+		frameSamples = opusSilkFrameSamples[config%4]
+	case config < 16:
+		frameSamples = opusHybridFrameSamples[config%2]
+	default:
+		frameSamples = opusCeltFrameSamples[config%4]
+	}
+
+	frames := 1
+	switch toc & 3 {
+	case 1, 2:
+		frames = 2
+	case 3:
+		if len(packet) < 2 {
+			return 0, ErrInvalidOpusPacket
+		}
+		frames = int(packet[1] & 0x3f)
+	}
+
+	samples := frames * frameSamples
+	if samples < 1 || samples > maxOpusPacketSamples {
+		return 0, ErrInvalidOpusPacket
+	}
+
+	return samples, nil
+}
+
+// SpeakerStats contains the jitter buffer and packet loss counters of a single speaker
+type SpeakerStats struct {
+	JitterStats
+
+	Lost      int // Playout slots whose packet never arrived
+	Recovered int // Lost frames recovered using the in-band FEC data of the following packet
+	Concealed int // Lost frames filled in by the decoder's packet loss concealment
+}
+
 // UserDecoder represents a individual user's audio stream.
-// TODO: Optimise UserDecoder to reuse the buffers
+// Packets are reordered through a jitter buffer and decoded as they're read,
+// lost packets are recovered using opus in-band FEC when possible, and concealed otherwise.
 type UserDecoder struct {
 	SSRC uint32
 
 	decoder *opus.Decoder
 
 	bufLock sync.Mutex
-	buf     []int16
+	jitter  *JitterBuffer
+
+	// Packets are decoded into pcm, buf is the part of it not read yet
+	pcm []int16
+	buf []int16
+
+	// Number of samples (including both channels) in the last decoded frame,
+	// used as the size of concealed frames
+	lastFrameSamples int
+
+	lost      int
+	recovered int
+	concealed int
+
+	// The packet played by the last Read if it was a single intact 20ms frame,
+	// which the mixer can pass through as is
+	lastPacket  []byte
+	passthrough []byte
+
+	// Processing applied by the mixer before this user is mixed in
+	chain *SpeakerChain
+
+	// Set once the user has left the channel, Read returns io.EOF once everything buffered has been played
+	closed bool
+
+	// Mixer state, only touched by the mixer with usersLock held.
+	// frame holds the audio read this frame, level is the peak hold level in dBFS
+	// and selected is whether they got one of the MaxSpeakers slots.
+	frame          []int16
+	frameLen       int
+	userID         string
+	allowed        bool
+	host           bool
+	priority       bool
+	level          float64
+	selected       bool
+	selectedFrames int
+	idleFrames     int
 }
 
+// Decoders of speakers that haven't played anything for this long are evicted
+const decoderIdleTimeout = time.Minute * 5
+
+const decoderIdleFrames = int(decoderIdleTimeout / FrameDuration)
+
+// Evicted decoders are kept around for new speakers, so the buffers aren't reallocated every time
+// someone joins on a long broadcast. The opus decoder itself is always new, as it can't be initialized twice
+var userDecoderPool sync.Pool
+
 // NewUserDecoder Creates a new user UserDecoder, using the provided ssrc
 func NewUserDecoder(ssrc uint32) *UserDecoder {
-	dec, err := opus.NewDecoder(48000, 2)
+	var pcm, frame []int16
+	if pooled, ok := userDecoderPool.Get().(*UserDecoder); ok {
+		pcm, frame = pooled.pcm, pooled.frame
+	} else {
+		pcm = make([]int16, maxOpusPacketSamples*2)
+		frame = make([]int16, FrameSamples)
+	}
+
+	dec, err := opus.NewDecoder(SampleRate, 2)
 	if err != nil {
 		panic("Failed creating decoder: " + err.Error())
 	}
 
 	return &UserDecoder{
-		decoder: dec,
-		SSRC:    ssrc,
+		decoder:          dec,
+		SSRC:             ssrc,
+		jitter:           NewJitterBuffer(DefaultJitterTarget, DefaultJitterMax),
+		pcm:              pcm,
+		lastFrameSamples: 960 * 2,
+		chain:            NewSpeakerChain(),
+		frame:            frame,
+		level:            math.Inf(-1),
 	}
 }
 
-// Handles an incoming voice packet
-func (ud *UserDecoder) HandlePacket(packet *discordgo.Packet) error {
+// Close marks the user as having left, what's buffered is still played out
+func (ud *UserDecoder) Close() {
+	ud.bufLock.Lock()
+	ud.closed = true
+	ud.bufLock.Unlock()
+}
 
-	header, err := opusutil.DecodeHeader(packet.Opus)
-	if err != nil {
-		return errors.WithMessage(err, "ud.HandlePacket, opusutil.DecodeHeader")
+// release puts the decoder in the pool for reuse, it must not be used afterwards
+func (ud *UserDecoder) release() {
+	ud.bufLock.Lock()
+	ud.decoder = nil
+	ud.jitter = nil
+	ud.buf = nil
+	ud.lastPacket = nil
+	ud.passthrough = nil
+	ud.bufLock.Unlock()
+
+	userDecoderPool.Put(ud)
+}
+
+// SetJitterDelay sets the target and max delay of the jitter buffer, in 20ms frames
+func (ud *UserDecoder) SetJitterDelay(target, max int) {
+	if max < target {
+		max = target
+	}
+
+	ud.bufLock.Lock()
+	ud.jitter.TargetDelay = target
+	ud.jitter.MaxDelay = max
+	ud.bufLock.Unlock()
+}
+
+// Stats returns the current jitter buffer depth and packet loss counters
+func (ud *UserDecoder) Stats() SpeakerStats {
+	ud.bufLock.Lock()
+	stats := SpeakerStats{
+		JitterStats: ud.jitter.Stats(),
+		Lost:        ud.lost,
+		Recovered:   ud.recovered,
+		Concealed:   ud.concealed,
 	}
+	ud.bufLock.Unlock()
+	return stats
+}
 
-	// Example: 1x 20000us frame at 48k = 1 * 20 * 48 * 2(channels) = 960 * 2 channels
-	samples := int(float64(header.NumFrames)*float64(header.Config.FrameDuration.Seconds()*1000)*48) * 2
+// Handles an incoming voice packet
+func (ud *UserDecoder) HandlePacket(packet *discordgo.Packet) error {
 
-	pcm := make([]int16, samples)
-	_, err = ud.decoder.Decode(packet.Opus, pcm)
+	_, err := opusPacketSamples(packet.Opus)
 	if err != nil {
-		return errors.WithMessage(err, "ud.HandlePacket, ud.decoder.Decode")
+		return errors.WithMessage(err, "ud.HandlePacket")
 	}
 
 	ud.bufLock.Lock()
-	ud.buf = append(ud.buf, pcm...)
-	// log(packet.SSRC, ": Samples: ", samples, " bufsize: ", len(ud.buf))
+	ud.jitter.Push(packet)
+	// log(packet.SSRC, ": Depth: ", ud.jitter.Depth(), " bufsize: ", len(ud.buf))
 	ud.bufLock.Unlock()
 
 	return nil
 }
 
-// Read Implements io.Read, err is always nil as reads can always be performed
-// TODO: Reads on users that has left the channel should return io.EOF
+// decodeNext decodes the packet for the next playout slot into buf, which has to be empty,
+// returns false if there was nothing to play in this slot
+func (ud *UserDecoder) decodeNext() bool {
+	packet, lost := ud.jitter.Pop()
+	if lost {
+		return ud.recoverLost()
+	}
+
+	if packet == nil {
+		return false
+	}
+
+	samples, err := opusPacketSamples(packet.Opus)
+	if err != nil {
+		log("Error decoding voice packet: ", errors.WithMessage(err, "ud.decodeNext"))
+		return false
+	}
+
+	pcm := ud.pcm[:samples*2]
+	n, err := ud.decoder.Decode(packet.Opus, pcm)
+	if err != nil {
+		log("Error decoding voice packet: ", errors.WithMessage(err, "ud.decodeNext, ud.decoder.Decode"))
+		return false
+	}
+
+	ud.lastFrameSamples = n * 2
+	ud.lastPacket = nil
+	if samples == FrameSize {
+		ud.lastPacket = packet.Opus
+	}
+	ud.buf = pcm[:n*2]
+	return true
+}
+
+// recoverLost fills in a lost playout slot, using the FEC data of the following packet if it's
+// already buffered, otherwise falling back to the decoder's packet loss concealment
+func (ud *UserDecoder) recoverLost() bool {
+	ud.lost++
+	ud.lastPacket = nil
+
+	pcm := ud.pcm[:ud.lastFrameSamples]
+	if next := ud.jitter.Peek(); next != nil {
+		err := ud.decoder.DecodeFEC(next.Opus, pcm)
+		if err == nil {
+			ud.recovered++
+			ud.buf = pcm
+			return true
+		}
+	}
+
+	err := ud.decoder.DecodePLC(pcm)
+	if err != nil {
+		log("Error concealing lost voice packet: ", errors.WithMessage(err, "ud.recoverLost, ud.decoder.DecodePLC"))
+		return false
+	}
+
+	ud.concealed++
+	ud.buf = pcm
+	return true
+}
+
+// Read Implements io.Read, decoding as many playout slots from the jitter buffer as needed to fill b,
+// stopping early if the next slot has nothing to play.
+// Returns io.EOF once the user has left the channel and everything buffered has been played.
 func (ud *UserDecoder) Read(b []int16) (n int, err error) {
 	ud.bufLock.Lock()
-	if len(ud.buf) < 1 {
-		ud.bufLock.Unlock()
-		return 0, nil
+
+	// Only a read made up of exactly one freshly decoded packet can be passed through
+	fresh := len(ud.buf) < 1
+	decoded := 0
+
+	for n < len(b) {
+		if len(ud.buf) < 1 {
+			if !ud.decodeNext() {
+				break
+			}
+			decoded++
+			continue
+		}
+
+		c := copy(b[n:], ud.buf)
+		ud.buf = ud.buf[c:]
+		n += c
+	}
+
+	ud.passthrough = nil
+	if fresh && decoded == 1 && n == FrameSamples && len(ud.buf) < 1 {
+		ud.passthrough = ud.lastPacket
+	}
+
+	if n == 0 && ud.closed {
+		err = io.EOF
 	}
 
-	n = copy(b, ud.buf)
-	ud.buf = ud.buf[n:]
 	ud.bufLock.Unlock()
 	return
 }
 
+// passthroughPacket returns the opus packet played by the last Read, or nil if it can't be passed through as is
+func (ud *UserDecoder) passthroughPacket() []byte {
+	ud.bufLock.Lock()
+	p := ud.passthrough
+	ud.bufLock.Unlock()
+	return p
+}
+
 // The mixer uotputs to mixerouputs
 type MixerOutput interface {
 
 	// WriteOpus gets called every 20ms with the next batch of opus data
 	// If an error is returned, output is removed
+	// opus is reused once this returns, outputs that hold on to it have to make a copy
 	WriteOpus(opus []byte) error
 }
 
+// MixerSource is an extra source of audio mixed in on top of the speakers, like the soundboard
+type MixerSource interface {
+	// MixFrame adds the next 20ms of interleaved stereo audio to bus, full scale being 1,
+	// speaking is whether anyone is talking this frame. Returns false if there was nothing to play.
+	// Called by the mixer every frame, must not block.
+	MixFrame(bus []float32, speaking bool) bool
+}
+
+// UserSettings are the mixer settings of a single user, keyed by their discord user ID so they
+// apply as soon as the user speaks and survive them rejoining with a new ssrc
+type UserSettings struct {
+	Volume float32
+
+	// Stereo position from -100 (left) to 100 (right), set by the host if PanSet is set, otherwise
+	// handed out automatically if auto panning is on
+	Pan    float32
+	PanSet bool
+
+	// Overrides the station wide speaker processing stages if OverrideChain is set
+	Chain         ChainStages
+	OverrideChain bool
+}
+
+// A single speaker has to be passthrough eligible for this many frames in a row before we stop re-encoding,
+// so we don't flip back and forth between the encoder and the speaker's packets while people talk over each other
+const passthroughEnterFrames = 10
+
 // Mixer is the main DiscordRadio mixer, in charge of combining all streams
 // and broadcastign them to all outputs
 type Mixer struct {
 	usersLock sync.Mutex
 	users     map[uint32]*UserDecoder
-	stop      chan bool
 
-	volumeMultipliers map[uint32]float32
+	// Maps ssrc's to users, per user settings apply once their ssrc is known
+	Identities   *SpeakerIdentities
+	userSettings map[string]*UserSettings
+
+	// Decides who gets mixed in
+	Access *SpeakerAccess
+
+	// Speaker processing stages enabled for everyone without their own override
+	chainStages ChainStages
+
+	// Effects on single users by user ID, and on the master bus
+	userEffects   map[string]EffectChain
+	masterEffects EffectChain
 
-	encoder *opus.Encoder
+	// Spreads speakers without a pan set by the host across the stereo field as they join
+	autoPan  bool
+	autoPans map[string]float32
 
-	pcmbuf []int16
+	// With a single unprocessed speaker their packets are sent as is instead of being re-encoded,
+	// passthroughFrames counts the consecutive frames that could have been
+	passthroughEnabled bool
+	passthroughFrames  int
 
-	outputLock sync.Mutex
-	outputs    []MixerOutput
+	// Target and max jitter buffer delay in 20ms frames for new user decoders
+	JitterTarget int
+	JitterMax    int
+
+	// Max number of speakers mixed in at once not counting the hosts, 0 for no limit
+	maxSpeakers int
+
+	// Speakers with audio this frame, and the ones competing for a slot, reused every frame
+	active     []*UserDecoder
+	candidates []*UserDecoder
+
+	// Receives the decoded audio of every speaker, if set
+	tap SpeakerTap
+
+	// Extra sources mixed in after the speakers, not ducked by talkover
+	sources []MixerSource
+
+	// Float mix bus, scaled so full scale is 1
+	bus     []float32
+	userBus []float32
+	master  *MasterBus
+
+	// Speakers other than the hosts and priority speakers are summed into duckBus,
+	// which is ducked while one of them is talking if talkover is enabled
+	duckBus  []float32
+	ducker   *Ducker
+	priority map[string]bool
+
+	// Size and slow consumer policy of the queues for new outputs
+	OutputQueueSize    int
+	SlowConsumerPolicy SlowConsumerPolicy
+
+	// Outputs subscribe to one of the encoder tiers, which all have the same optional
+	// broadcast delay between the encoder and the outputs
+	outputLock  sync.Mutex
+	outputs     []*outputQueue
+	tiers       []*encoderTier
+	delayLength time.Duration
+
+	// The last frames of the mix, recentPCM[recentPos] is the oldest
+	recentPCM [encoderPrimeFrames][]int16
+	recentPos int
+
+	// Stop sending to outputs implementing SpeakingOutput while the broadcast is silent
+	suppressSilence bool
 }
 
 // NewMixer returns a new mixer with default values
 func NewMixer() *Mixer {
-	enc, err := opus.NewEncoder(48000, 2, opus.AppAudio)
-	if err != nil {
-		panic("Failed creating encoder: " + err.Error())
+	mix := &Mixer{
+		users:        make(map[uint32]*UserDecoder),
+		Identities:   NewSpeakerIdentities(),
+		Access:       NewSpeakerAccess(),
+		userSettings: make(map[string]*UserSettings),
+		autoPans:     make(map[string]float32),
+		userEffects:  make(map[string]EffectChain),
+		JitterTarget: DefaultJitterTarget,
+		JitterMax:    DefaultJitterMax,
+		bus:          make([]float32, FrameSamples),
+		userBus:      make([]float32, FrameSamples),
+		master:       NewMasterBus(),
+		duckBus:      make([]float32, FrameSamples),
+		ducker:       NewDucker(),
+		priority:     make(map[string]bool),
+
+		passthroughEnabled: true,
+
+		OutputQueueSize:    DefaultOutputQueueSize,
+		SlowConsumerPolicy: DropOldest,
+	}
+
+	for _, profile := range DefaultEncoderProfiles {
+		err := mix.SetEncoderProfile(profile)
+		if err != nil {
+			panic("Failed creating encoder: " + err.Error())
+		}
+	}
+
+	return mix
+}
+
+// SetVolume sets the volume multiplier of the user
+func (mix *Mixer) SetVolume(userID string, volume float32) {
+	mix.usersLock.Lock()
+	mix.userSettingsLocked(userID).Volume = volume
+	mix.usersLock.Unlock()
+}
+
+// SetPan places the user at a stereo position from -100 (left) to 100 (right)
+func (mix *Mixer) SetPan(userID string, pan float32) {
+	mix.usersLock.Lock()
+	settings := mix.userSettingsLocked(userID)
+	settings.Pan = pan
+	settings.PanSet = true
+	mix.usersLock.Unlock()
+}
+
+// SetAutoPan enables or disables spreading speakers without a pan of their own across the stereo field
+func (mix *Mixer) SetAutoPan(enabled bool) {
+	mix.usersLock.Lock()
+	mix.autoPan = enabled
+	mix.usersLock.Unlock()
+}
+
+// AutoPan returns whether auto panning is enabled
+func (mix *Mixer) AutoPan() bool {
+	mix.usersLock.Lock()
+	enabled := mix.autoPan
+	mix.usersLock.Unlock()
+	return enabled
+}
+
+// SetChainStages sets the speaker processing stages enabled for everyone without their own override
+func (mix *Mixer) SetChainStages(stages ChainStages) {
+	mix.usersLock.Lock()
+	mix.chainStages = stages
+	mix.usersLock.Unlock()
+}
+
+// SetUserChainStages overrides the speaker processing stages for a single user
+func (mix *Mixer) SetUserChainStages(userID string, stages ChainStages) {
+	mix.usersLock.Lock()
+	settings := mix.userSettingsLocked(userID)
+	settings.Chain = stages
+	settings.OverrideChain = true
+	mix.usersLock.Unlock()
+}
+
+// ChainStages returns the station wide speaker processing stages
+func (mix *Mixer) ChainStages() ChainStages {
+	mix.usersLock.Lock()
+	stages := mix.chainStages
+	mix.usersLock.Unlock()
+	return stages
+}
+
+// UserSettings returns the settings in effect for the user
+func (mix *Mixer) UserSettings(userID string) UserSettings {
+	mix.usersLock.Lock()
+	settings := mix.effectiveSettingsLocked(userID)
+	mix.usersLock.Unlock()
+	return settings
+}
+
+// userSettingsLocked returns the settings of the user, creating them if needed
+func (mix *Mixer) userSettingsLocked(userID string) *UserSettings {
+	settings, ok := mix.userSettings[userID]
+	if !ok {
+		settings = &UserSettings{Volume: 1}
+		mix.userSettings[userID] = settings
+	}
+	return settings
+}
+
+// effectiveSettingsLocked returns the settings of the user with the station wide defaults applied
+func (mix *Mixer) effectiveSettingsLocked(userID string) UserSettings {
+	settings := UserSettings{Volume: 1}
+	if s, ok := mix.userSettings[userID]; ok {
+		settings = *s
+	}
+
+	if !settings.OverrideChain {
+		settings.Chain = mix.chainStages
 	}
 
-	return &Mixer{
-		stop:              make(chan bool),
-		users:             make(map[uint32]*UserDecoder),
-		volumeMultipliers: make(map[uint32]float32),
-		encoder:           enc,
+	if !settings.PanSet && mix.autoPan {
+		settings.Pan = mix.autoPans[userID]
 	}
+
+	return settings
 }
 
-func (mix *Mixer) SetVolume(ssrc uint32, volume float32) {
+// AddSource adds an extra source to the mix
+func (mix *Mixer) AddSource(src MixerSource) {
 	mix.usersLock.Lock()
-	mix.volumeMultipliers[ssrc] = volume
+	mix.sources = append(mix.sources, src)
 	mix.usersLock.Unlock()
 }
 
+// RemoveSource removes a source added with AddSource
+func (mix *Mixer) RemoveSource(src MixerSource) {
+	mix.usersLock.Lock()
+	for i, v := range mix.sources {
+		if v == src {
+			mix.sources = append(mix.sources[:i], mix.sources[i+1:]...)
+			break
+		}
+	}
+	mix.usersLock.Unlock()
+}
+
+// SetPassthrough enables or disables passing through the packets of a single speaker without re-encoding them
+func (mix *Mixer) SetPassthrough(enabled bool) {
+	mix.usersLock.Lock()
+	mix.passthroughEnabled = enabled
+	mix.passthroughFrames = 0
+	mix.usersLock.Unlock()
+}
+
+// Passthrough returns whether passthrough is enabled, and whether it's currently in use
+func (mix *Mixer) Passthrough() (enabled, active bool) {
+	mix.usersLock.Lock()
+	enabled = mix.passthroughEnabled
+	active = mix.passthroughFrames >= passthroughEnterFrames
+	mix.usersLock.Unlock()
+	return
+}
+
+// SetMaxSpeakers limits the mix to the max loudest speakers, the hosts are always mixed in on top of that.
+// 0 removes the limit.
+func (mix *Mixer) SetMaxSpeakers(max int) {
+	mix.usersLock.Lock()
+	mix.maxSpeakers = max
+	mix.usersLock.Unlock()
+}
+
+// MaxSpeakers returns the max number of speakers mixed in at once, 0 if there's no limit
+func (mix *Mixer) MaxSpeakers() int {
+	mix.usersLock.Lock()
+	max := mix.maxSpeakers
+	mix.usersLock.Unlock()
+	return max
+}
+
+// SetTalkover sets the talkover settings, ducking everyone else while a host or priority speaker is talking
+func (mix *Mixer) SetTalkover(settings TalkoverSettings) {
+	mix.usersLock.Lock()
+	mix.ducker.Set(settings)
+	mix.usersLock.Unlock()
+}
+
+// Talkover returns the talkover settings
+func (mix *Mixer) Talkover() TalkoverSettings {
+	mix.usersLock.Lock()
+	settings := mix.ducker.TalkoverSettings
+	mix.usersLock.Unlock()
+	return settings
+}
+
+// TogglePriority makes the user a priority speaker for talkover, or removes them if they are one.
+// Returns true if they were added
+func (mix *Mixer) TogglePriority(userID string) bool {
+	mix.usersLock.Lock()
+	added := !mix.priority[userID]
+	setOrDelete(mix.priority, userID, added)
+	mix.usersLock.Unlock()
+	return added
+}
+
+// SetSpeakerTap sets the tap receiving the audio of every speaker each frame, nil removes it.
+// Once this returns the previous tap will not receive any more calls.
+func (mix *Mixer) SetSpeakerTap(tap SpeakerTap) {
+	mix.usersLock.Lock()
+	mix.tap = tap
+	mix.usersLock.Unlock()
+}
+
+// SetNormalization enables or disables loudness normalization of the master bus to the target in LUFS
+func (mix *Mixer) SetNormalization(enabled bool, target float64) {
+	mix.master.SetNormalization(enabled, target)
+}
+
+// MasterStats returns the loudness and clip readings of the master bus
+func (mix *Mixer) MasterStats() MasterStats {
+	return mix.master.Stats()
+}
+
+// SetDelay sets the broadcast delay, 0 disables it
+func (mix *Mixer) SetDelay(d time.Duration) {
+	mix.outputLock.Lock()
+	if d < FrameDuration {
+		d = 0
+	}
+	mix.delayLength = d
+
+	for _, t := range mix.tiers {
+		switch {
+		case d == 0:
+			if t.delay != nil {
+				t.delay.Dump()
+			}
+			t.delay = nil
+		case t.delay == nil:
+			t.delay = NewDelayLine(d)
+		default:
+			t.delay = t.delay.Resize(d)
+		}
+	}
+	mix.outputLock.Unlock()
+}
+
+// Delay returns the current broadcast delay
+func (mix *Mixer) Delay() time.Duration {
+	mix.outputLock.Lock()
+	d := mix.delayLength
+	mix.outputLock.Unlock()
+	return d
+}
+
+// Dump discards all the delayed audio not sent to outputs yet, replacing it with silence.
+// Returns false if there's no broadcast delay
+func (mix *Mixer) Dump() bool {
+	mix.outputLock.Lock()
+	defer mix.outputLock.Unlock()
+
+	if mix.delayLength == 0 {
+		return false
+	}
+
+	for _, t := range mix.tiers {
+		t.delay.Dump()
+	}
+	return true
+}
+
 // AddOutput Adds a new output to the mixer, which will then further receive mixed audio
 // Every 20mx (Even if there are no people talking in the channel)
+// Every output gets its own queue and sender, handled according to the SlowConsumerPolicy if it falls behind.
+// The output gets the DefaultTier.
 func (mix *Mixer) AddOutput(output MixerOutput) {
+	err := mix.AddOutputTier(output, DefaultTier)
+	if err != nil {
+		// The default tier can't be removed
+		panic("AddOutput: " + err.Error())
+	}
+}
+
+// AddOutputTier adds a new output to the mixer subscribed to the named encoder tier
+func (mix *Mixer) AddOutputTier(output MixerOutput, tier string) error {
+	return mix.AddOutputPreroll(output, tier, nil)
+}
+
+// AddOutputPreroll adds a new output to the mixer subscribed to the named encoder tier, which gets
+// the 48khz interleaved stereo ident before the live feed. The ident must not be modified afterwards.
+func (mix *Mixer) AddOutputPreroll(output MixerOutput, tier string, ident []int16) error {
 	mix.outputLock.Lock()
-	mix.outputs = append(mix.outputs, output)
+	t := mix.tierLocked(strings.ToLower(tier))
+	if t == nil {
+		mix.outputLock.Unlock()
+		return ErrUnknownTier
+	}
+
+	q := newOutputQueue(mix, output, t, mix.OutputQueueSize, mix.SlowConsumerPolicy)
+	if len(ident) > 0 {
+		p, err := newPreroll(ident, t.profile)
+		if err != nil {
+			mix.outputLock.Unlock()
+			return err
+		}
+		q.preroll = p
+		q.prerollFrames = prerollFrames(ident)
+	}
+	mix.outputs = append(mix.outputs, q)
+	t.subscribers++
 	mix.outputLock.Unlock()
+
+	go q.run()
+	return nil
 }
 
 // RemoveOutput removes an output from the mixer
 func (mix *Mixer) RemoveOutput(output MixerOutput) {
 	mix.outputLock.Lock()
 	for k, v := range mix.outputs {
-		if v == output {
+		if v.output == output {
 			mix.outputs = append(mix.outputs[:k], mix.outputs[k+1:]...)
+			v.tier.subscribers--
+			close(v.stop)
 			break
 		}
 	}
 	mix.outputLock.Unlock()
 }
 
-func (mix *Mixer) Stop() {
-	close(mix.stop)
+// SpeakerStats returns the jitter buffer and packet loss stats of all the users, by ssrc
+func (mix *Mixer) SpeakerStats() map[uint32]SpeakerStats {
+	mix.usersLock.Lock()
+	stats := make(map[uint32]SpeakerStats, len(mix.users))
+	for ssrc, ud := range mix.users {
+		stats[ssrc] = ud.Stats()
+	}
+	mix.usersLock.Unlock()
+	return stats
+}
+
+// OutputStats returns the queue depth and counters of all the outputs
+func (mix *Mixer) OutputStats() []OutputStats {
+	mix.outputLock.Lock()
+	stats := make([]OutputStats, len(mix.outputs))
+	for i, v := range mix.outputs {
+		stats[i] = v.stats()
+	}
+	mix.outputLock.Unlock()
+	return stats
 }
 
 func (mix *Mixer) Queue(packet *discordgo.Packet) {
 
+	userID, _ := mix.Identities.User(packet.SSRC)
+	if !mix.Access.Allowed(userID) {
+		return
+	}
+
+	mix.usersLock.Lock()
 	st, ok := mix.users[packet.SSRC]
 	if !ok {
 		st = NewUserDecoder(packet.SSRC)
-		mix.usersLock.Lock()
+		st.SetJitterDelay(mix.JitterTarget, mix.JitterMax)
 		mix.users[packet.SSRC] = st
-		mix.usersLock.Unlock()
 	}
 
+	// Still holding usersLock so the decoder can't be evicted in the meantime
 	err := st.HandlePacket(packet)
+	mix.usersLock.Unlock()
 	if err != nil {
 		log("Error handling voice packet: ", err)
 	}
 }
 
-func (mix *Mixer) Run() {
-	log("Mixer running")
-	ticker := time.NewTicker(time.Millisecond * 20)
-	for {
-		select {
-		case <-mix.stop:
-			log("Mixer stopping")
-			return
-		case <-ticker.C:
-			mix.processQueue()
+// RemoveSpeaker is called when the user leaves the voice channel,
+// their decoder is evicted once everything they said has been played
+func (mix *Mixer) RemoveSpeaker(userID string) {
+	ssrc, ok := mix.Identities.SSRC(userID)
+
+	mix.usersLock.Lock()
+	if st, found := mix.users[ssrc]; ok && found {
+		st.Close()
+	} else {
+		delete(mix.autoPans, userID)
+		if ok {
+			mix.Identities.RemoveSSRC(ssrc)
+		}
+	}
+	mix.usersLock.Unlock()
+}
+
+// evictLocked removes the decoder of a speaker that went idle or left and puts it in the pool,
+// usersLock has to be held
+func (mix *Mixer) evictLocked(ssrc uint32, st *UserDecoder, left bool) {
+	delete(mix.users, ssrc)
+
+	if left {
+		// Their ssrc won't be used again, they get a new one when they rejoin
+		mix.Identities.RemoveSSRC(ssrc)
+
+		if st.userID != "" {
+			// Free up their spot in the stereo field for whoever joins next
+			delete(mix.autoPans, st.userID)
 		}
 	}
+
+	st.release()
+}
+
+// ProcessFrame implements FrameProcessor, mixing and sending out the next frame
+func (mix *Mixer) ProcessFrame() {
+	mix.processQueue()
 }
 
 func (mix *Mixer) processQueue() {
@@ -178,60 +855,189 @@ func (mix *Mixer) processQueue() {
 	// log("Processing audio")
 	// started := time.Now()
 
+	for i := range mix.bus {
+		mix.bus[i] = 0
+		mix.duckBus[i] = 0
+	}
+
+	// The packet of the only speaker this frame, if it can be sent as is
+	var passthrough []byte
+	speakers := 0
+
 	mix.usersLock.Lock()
-	mixedPCM := make([]int16, 48*20*2)
-	for _, st := range mix.users {
 
-		userPCM := make([]int16, 48*20*2)
-		n, _ := st.Read(userPCM)
+	// Read everyone first, so the loudest speakers can be picked before mixing
+	active := mix.active[:0]
+	for ssrc, st := range mix.users {
+
+		n, err := st.Read(st.frame)
+		if n > 0 {
+			st.idleFrames = 0
+		} else {
+			st.idleFrames++
+		}
+
+		if err == io.EOF || st.idleFrames > decoderIdleFrames {
+			mix.evictLocked(ssrc, st, err == io.EOF)
+			continue
+		}
+
+		// Also checked here as the policy may have changed with audio still buffered
+		st.userID, _ = mix.Identities.User(st.SSRC)
+		st.allowed = mix.Access.Allowed(st.userID)
+		st.host = st.userID != "" && mix.Access.IsHost(st.userID)
+		if !st.allowed {
+			n = 0
+		}
+
+		st.frameLen = n
+		st.updateLevel(st.frame[:n])
+
+		st.priority = st.host || mix.priority[st.userID]
+
 		if n < 1 {
 			continue
 		}
 
-		mult, ok := mix.volumeMultipliers[st.SSRC]
-		if !ok {
-			mult = 1
+		if mix.tap != nil {
+			mix.tap.WriteSpeaker(st.SSRC, st.frame[:n])
 		}
 
-		for i := 0; i < len(userPCM); i++ {
-			// Mix it
+		active = append(active, st)
+	}
+	mix.active = active
 
-			v := int32(mixedPCM[i]) + int32(float32(userPCM[i])*mult)
-			// Clip
-			if v > 0x7fff {
-				v = 0x7fff
-			} else if v < -0x7fff {
-				v = -0x7fff
-			}
-			mixedPCM[i] = int16(v)
+	if mix.maxSpeakers > 0 {
+		mix.selectSpeakers(mix.maxSpeakers)
+	}
+	speaking, talkover := mix.talkingLocked()
+
+	for _, st := range active {
+		if !mix.inMixLocked(st) {
+			continue
 		}
+
+		pcm := st.frame[:st.frameLen]
+		userPCM := mix.userBus[:len(pcm)]
+		for i := range userPCM {
+			userPCM[i] = float32(pcm[i]) / 0x8000
+		}
+
+		if mix.autoPan && st.userID != "" {
+			mix.assignAutoPanLocked(st.userID)
+		}
+
+		settings := mix.effectiveSettingsLocked(st.userID)
+		effects := mix.userEffects[st.userID]
+
+		speakers++
+		passthrough = nil
+		if speakers == 1 && settings.Volume == 1 && settings.Chain == 0 && settings.Pan == 0 && len(effects) == 0 && (st.priority || mix.ducker.Unity()) {
+			passthrough = st.passthroughPacket()
+		}
+
+		if settings.Chain != 0 {
+			st.chain.Process(userPCM, settings.Chain)
+		}
+
+		if len(effects) > 0 {
+			effects.Process(userPCM)
+		}
+
+		if settings.Pan != 0 {
+			applyPan(userPCM, settings.Pan)
+		}
+
+		bus := mix.bus
+		if !st.priority {
+			bus = mix.duckBus
+		}
+
+		// Sum into the float bus, clipping is left to the master limiter
+		for i, v := range userPCM {
+			bus[i] += v * settings.Volume
+		}
+	}
+
+	mix.ducker.Process(mix.duckBus, talkover)
+	for i, v := range mix.duckBus {
+		mix.bus[i] += v
 	}
 
+	for _, src := range mix.sources {
+		if src.MixFrame(mix.bus, speaking) {
+			// The speaker's packet alone isn't the mix anymore
+			passthrough = nil
+		}
+	}
+
+	mix.masterEffects.Process(mix.bus)
+
+	if mix.tap != nil {
+		mix.tap.EndFrame()
+	}
+
+	if passthrough != nil && mix.passthroughEnabled && len(mix.masterEffects) == 0 && !mix.master.Normalizing() {
+		mix.passthroughFrames++
+	} else {
+		mix.passthroughFrames = 0
+	}
+	usePassthrough := mix.passthroughFrames >= passthroughEnterFrames
+
 	// log("Took ", time.Since(started), " To process queue")
 	mix.usersLock.Unlock()
 
-	output := make([]byte, 0xfff)
-	n, err := mix.encoder.Encode(mixedPCM, output)
-	if err != nil {
-		log("Failed encode: ", err)
+	// The master bus still runs while passing through to keep the meter and limiter up to date,
+	// so switching back to mixing is seamless
+	mixedPCM := mix.master.Process(mix.bus)
+
+	if !usePassthrough {
+		passthrough = nil
 	}
 
-	mix.broadcastAudio(output[:n])
+	mix.broadcastAudio(mixedPCM, passthrough)
 }
 
-func (mix *Mixer) broadcastAudio(opus []byte) {
+// broadcastAudio encodes the pcm once for every tier in use and queues it on every output,
+// each queue takes its own reference to its tier's frame
+func (mix *Mixer) broadcastAudio(pcm []int16, passthrough []byte) {
+	var disconnect []*outputQueue
+
 	mix.outputLock.Lock()
-	for _, output := range mix.outputs {
-		go mix.sendToOutput(output, opus)
+	mix.encodeTiers(pcm, passthrough)
+
+	for _, q := range mix.outputs {
+		if q.prerollFrames > 0 {
+			// The ident keeps playing through silence
+			q.prerollFrames--
+		} else if q.speaker != nil && mix.suppressSilence && q.tier.suppressed {
+			if !q.silenced {
+				q.silenced = true
+				q.pushEndOfSpeech()
+			}
+			continue
+		}
+		q.silenced = false
+
+		if !q.push(q.tier.frame) {
+			disconnect = append(disconnect, q)
+		}
+	}
+
+	for _, t := range mix.tiers {
+		if t.frame != nil {
+			t.frame.release()
+			t.frame = nil
+		}
 	}
 	mix.outputLock.Unlock()
-}
 
-func (mix *Mixer) sendToOutput(output MixerOutput, audio []byte) {
-	err := output.WriteOpus(audio)
-	if err != nil {
-		mix.RemoveOutput(output)
-		log("Failed sending to output: ", err)
+	for _, q := range disconnect {
+		log("Disconnecting slow output: ", q.stats())
+		mix.RemoveOutput(q.output)
+		if d, ok := q.output.(OutputDisconnecter); ok {
+			go d.OutputDisconnected()
+		}
 	}
 }
 
@@ -1,7 +1,11 @@
 package main
 
 import (
+	"fmt"
+	"github.com/hraban/opus"
 	"github.com/jonas747/discordgo"
+	"io"
+	"math"
 	"testing"
 )
 
@@ -21,42 +25,125 @@ type ProxyOutput struct {
 }
 
 func (p *ProxyOutput) WriteOpus(data []byte) error {
-	p.ProxyChannel <- data
+	// The mixer reuses data
+	p.ProxyChannel <- append([]byte(nil), data...)
 	return nil
 }
 
 func TestUserDecoder(t *testing.T) {
 	ud := NewUserDecoder(1)
-	err := ud.HandlePacket(&discordgo.Packet{
-		SSRC: 1,
-		Opus: Silence,
-	})
+	for i := 0; i < DefaultJitterTarget; i++ {
+		err := ud.HandlePacket(&discordgo.Packet{
+			SSRC:     1,
+			Sequence: uint16(i),
+			Opus:     Silence,
+		})
 
-	if err != nil {
-		t.Error("Error handling packet: ", err)
+		if err != nil {
+			t.Error("Error handling packet: ", err)
+		}
 	}
 
-	if len(ud.buf) != 960*2 {
-		t.Error("Decoded size is not 960*2: ", len(ud.buf))
+	buf := make([]int16, 960*2)
+	n, _ := ud.Read(buf)
+	if n != 960*2 {
+		t.Error("Decoded size is not 960*2: ", n)
+	}
+}
+
+func TestMixerEvictsDepartedSpeaker(t *testing.T) {
+	mix := NewMixer()
+	mix.JitterTarget = 1
+	mix.Identities.Set(1, "1")
+	mix.SetAutoPan(true)
+
+	feedSpeaker(mix, 1, 0, Silence)
+	mix.Queue(&discordgo.Packet{SSRC: 1, Sequence: 1, Opus: Silence})
+	if len(mix.autoPans) != 1 {
+		t.Fatal("Speaker wasn't given an auto pan position")
+	}
+
+	mix.RemoveSpeaker("1")
+
+	st := mix.users[1]
+	if st == nil {
+		t.Fatal("Decoder evicted before everything buffered was played")
+	}
+
+	// The buffered packet is still played
+	buf := make([]int16, FrameSamples)
+	if n, err := st.Read(buf); n != FrameSamples || err != nil {
+		t.Fatal("Read after leaving: ", n, err)
+	}
+	if _, err := st.Read(buf); err != io.EOF {
+		t.Fatal("Read on a departed speaker returned ", err, ", expected io.EOF")
+	}
+
+	mix.processQueue()
+	if len(mix.users) != 0 {
+		t.Error("Decoder not evicted")
+	}
+	if len(mix.autoPans) != 0 {
+		t.Error("Auto pan position not freed")
+	}
+	if _, ok := mix.Identities.User(1); ok {
+		t.Error("Departed speaker's ssrc still mapped")
+	}
+}
+
+func TestMixerReusesEvictedDecoder(t *testing.T) {
+	mix := NewMixer()
+	mix.JitterTarget = 1
+	mix.Identities.Set(1, "1")
+	mix.Identities.Set(2, "2")
+
+	feedSpeaker(mix, 1, 0, Silence)
+	evicted := mix.users[1]
+	mix.RemoveSpeaker("1")
+	for i := 0; i < 10 && len(mix.users) > 0; i++ {
+		mix.processQueue()
+	}
+	if len(mix.users) != 0 {
+		t.Fatal("Decoder not evicted")
+	}
+
+	// The next speaker gets the evicted decoder from the pool
+	mix.Queue(&discordgo.Packet{SSRC: 2, Sequence: 0, Opus: Silence})
+	mix.Queue(&discordgo.Packet{SSRC: 2, Sequence: 1, Opus: Silence})
+	st := mix.users[2]
+	if st == nil {
+		t.Fatal("No decoder for the new speaker")
+	}
+	if &st.pcm[0] != &evicted.pcm[0] {
+		t.Skip("Evicted decoder was dropped from the pool")
+	}
+
+	buf := make([]int16, FrameSamples)
+	if n, err := st.Read(buf); n != FrameSamples || err != nil {
+		t.Fatal("Read with a reused decoder: ", n, err)
 	}
 }
 
 func BenchmarkUserDecodeRead(b *testing.B) {
 	ud := NewUserDecoder(1)
+	ud.SetJitterDelay(1, DefaultJitterMax)
 	p := &discordgo.Packet{
 		SSRC: 1,
 		Opus: Silence,
 	}
 
+	buf := make([]int16, 960*2)
+
+	b.ReportAllocs()
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
+		p.Sequence = uint16(i)
 		err := ud.HandlePacket(p)
 		if err != nil {
 			b.Error("Failed handling packet: ", err)
 			continue
 		}
 
-		buf := make([]int16, 960*2)
 		n, _ := ud.Read(buf)
 		if n != 960*2 {
 			b.Error("Packet size is not 960*2: ", n)
@@ -64,3 +151,202 @@ func BenchmarkUserDecodeRead(b *testing.B) {
 		}
 	}
 }
+
+func TestUserDecoderLoss(t *testing.T) {
+	ud := NewUserDecoder(1)
+	ud.SetJitterDelay(2, DefaultJitterMax)
+
+	// Packet 1 is lost
+	for _, seq := range []uint16{0, 2, 3} {
+		ud.HandlePacket(&discordgo.Packet{SSRC: 1, Sequence: seq, Opus: Silence})
+	}
+
+	buf := make([]int16, 960*2)
+	for i := 0; i < 3; i++ {
+		n, _ := ud.Read(buf)
+		if n != 960*2 {
+			t.Errorf("Read %d returned %d samples, expected 960*2", i, n)
+		}
+	}
+
+	stats := ud.Stats()
+	if stats.Lost != 1 || stats.Recovered+stats.Concealed != 1 {
+		t.Errorf("Unexpected loss stats: %+v", stats)
+	}
+}
+
+func TestUserSettingsByIdentity(t *testing.T) {
+	mix := NewMixer()
+
+	speakerVolume := func(ssrc uint32) float32 {
+		userID, _ := mix.Identities.User(ssrc)
+		return mix.effectiveSettingsLocked(userID).Volume
+	}
+
+	// Set before we know their ssrc
+	mix.SetVolume("123", 0.5)
+	if v := speakerVolume(1); v != 1 {
+		t.Error("Unknown ssrc should get the default volume, got ", v)
+	}
+
+	mix.Identities.Set(1, "123")
+	if v := speakerVolume(1); v != 0.5 {
+		t.Error("Volume not applied once the ssrc is known, got ", v)
+	}
+
+	// Rejoined with a new ssrc
+	mix.Identities.Set(2, "123")
+	if v := speakerVolume(2); v != 0.5 {
+		t.Error("Volume not applied to the new ssrc, got ", v)
+	}
+}
+
+// feedSpeaker queues the next packet of a speaker and runs the mixer for a frame
+func feedSpeaker(mix *Mixer, ssrc uint32, seq uint16, opus []byte) {
+	mix.Queue(&discordgo.Packet{SSRC: ssrc, Sequence: seq, Opus: opus})
+	mix.processQueue()
+}
+
+func TestMixerPassthrough(t *testing.T) {
+	mix := NewMixer()
+	mix.JitterTarget = 1
+	mix.Identities.Set(1, "1")
+
+	seq := uint16(0)
+	for i := 0; i < passthroughEnterFrames; i++ {
+		feedSpeaker(mix, 1, seq, Silence)
+		seq++
+	}
+	if _, active := mix.Passthrough(); !active {
+		t.Fatal("Passthrough not active with a single speaker")
+	}
+
+	// A second voice joins
+	mix.Queue(&discordgo.Packet{SSRC: 2, Sequence: 0, Opus: Silence})
+	mix.Queue(&discordgo.Packet{SSRC: 1, Sequence: seq, Opus: Silence})
+	mix.processQueue()
+	seq++
+	if _, active := mix.Passthrough(); active {
+		t.Error("Passthrough still active with two speakers")
+	}
+
+	for i := 0; i < passthroughEnterFrames; i++ {
+		feedSpeaker(mix, 1, seq, Silence)
+		seq++
+	}
+	if _, active := mix.Passthrough(); !active {
+		t.Fatal("Passthrough not resumed once the second speaker stopped")
+	}
+
+	mix.SetVolume("1", 0.5)
+	feedSpeaker(mix, 1, seq, Silence)
+	if _, active := mix.Passthrough(); active {
+		t.Error("Passthrough still active after changing the volume")
+	}
+}
+
+// testOpusPacket returns a 20ms packet of a tone, so the decoder and encoder have real work to do
+func testOpusPacket(b *testing.B) []byte {
+	enc, err := opus.NewEncoder(SampleRate, 2, opus.AppVoIP)
+	if err != nil {
+		b.Fatal("Failed creating encoder: ", err)
+	}
+
+	pcm := make([]int16, FrameSamples)
+	for i := 0; i < FrameSize; i++ {
+		v := int16(math.Sin(2*math.Pi*440*float64(i)/SampleRate) * 8000)
+		pcm[i*2], pcm[i*2+1] = v, v
+	}
+	packet := make([]byte, maxOpusFrameSize)
+	n, err := enc.Encode(pcm, packet)
+	if err != nil {
+		b.Fatal("Failed encoding: ", err)
+	}
+	return packet[:n]
+}
+
+// benchmarkMixer runs the mixer with the number of speakers all talking at once, sending to the number of outputs
+func benchmarkMixer(b *testing.B, speakers, outputs int, passthrough bool) {
+	opus := testOpusPacket(b)
+
+	mix := NewMixer()
+	mix.JitterTarget = 1
+	mix.SetPassthrough(passthrough)
+
+	dummies := make([]*DummyOutput, outputs)
+	for i := range dummies {
+		dummies[i] = &DummyOutput{}
+		mix.AddOutput(dummies[i])
+	}
+
+	// The packets are reused as they're done with once they've been mixed
+	packets := make([]*discordgo.Packet, speakers)
+	for i := range packets {
+		packets[i] = &discordgo.Packet{SSRC: uint32(i + 1), Opus: opus}
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, p := range packets {
+			p.Sequence = uint16(i)
+			mix.Queue(p)
+		}
+		mix.processQueue()
+	}
+	b.StopTimer()
+
+	for _, d := range dummies {
+		mix.RemoveOutput(d)
+	}
+}
+
+func BenchmarkMixerOneSpeakerMixed(b *testing.B) {
+	benchmarkMixer(b, 1, 1, false)
+}
+
+func BenchmarkMixerOneSpeakerPassthrough(b *testing.B) {
+	benchmarkMixer(b, 1, 1, true)
+}
+
+func BenchmarkMixer(b *testing.B) {
+	for _, speakers := range []int{1, 5, 20} {
+		for _, outputs := range []int{1, 10, 100} {
+			b.Run(fmt.Sprintf("%dspeakers-%doutputs", speakers, outputs), func(b *testing.B) {
+				benchmarkMixer(b, speakers, outputs, false)
+			})
+		}
+	}
+}
+
+func TestOpusPacketSamples(t *testing.T) {
+	cases := []struct {
+		packet  []byte
+		samples int
+	}{
+		{Silence, 960},                // CELT FB 20ms, 1 frame
+		{[]byte{0x78}, 960},           // Hybrid FB 20ms
+		{[]byte{0x08}, 960},           // SILK NB 20ms
+		{[]byte{0x18}, 2880},          // SILK NB 60ms
+		{[]byte{0xF9}, 1920},          // CELT FB 20ms, 2 frames
+		{[]byte{0xE3, 0x03}, 360},     // CELT FB 2.5ms, 3 frames
+		{[]byte{0x1B, 0x03}, 0},       // SILK 60ms, 3 frames is over 120ms
+		{[]byte{0xFB}, 0},             // Missing frame count
+		{[]byte{}, 0},                 // Empty
+		{[]byte{0xFB, 0x00, 0x00}, 0}, // 0 frames
+	}
+
+	for _, c := range cases {
+		samples, err := opusPacketSamples(c.packet)
+		if c.samples == 0 {
+			if err == nil {
+				t.Errorf("%x: Expected an error, got %d samples", c.packet, samples)
+			}
+			continue
+		}
+
+		if err != nil || samples != c.samples {
+			t.Errorf("%x: Got %d samples (%v), expected %d", c.packet, samples, err, c.samples)
+		}
+	}
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/hraban/opus"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// SpeakerTap receives the decoded audio of every speaker each frame, before it's processed and mixed
+type SpeakerTap interface {
+	// WriteSpeaker is called with the pcm of every speaker that had audio in the current frame,
+	// pcm is only valid for the duration of the call
+	WriteSpeaker(ssrc uint32, pcm []int16)
+
+	// EndFrame is called once per frame after all the speakers has been written
+	EndFrame()
+}
+
+// SpeakerResolver returns the discord user id and name of the ssrc, ok is false if it's not known yet
+type SpeakerResolver func(ssrc uint32) (userID, username string, ok bool)
+
+// Frames buffered between the mixer and the track writer
+const multitrackQueueSize = 50
+
+type multitrackFrame struct {
+	// Frames that were dropped before this one because the writer fell behind
+	skipped int
+
+	speakers map[uint32][]int16
+}
+
+// MultitrackManifest describes the tracks of a multitrack recording
+type MultitrackManifest struct {
+	Station    string            `json:"station"`
+	Started    time.Time         `json:"started"`
+	SampleRate int               `json:"sample_rate"`
+	Tracks     []*MultitrackInfo `json:"tracks"`
+}
+
+// MultitrackInfo describes a single track
+type MultitrackInfo struct {
+	UserID   string `json:"user_id"`
+	Username string `json:"username"`
+	File     string `json:"file"`
+
+	// Where the track starts relative to the start of the recording, files should be
+	// placed at this offset to be in sync with each other
+	StartOffsetMS      int64 `json:"start_offset_ms"`
+	StartOffsetSamples int64 `json:"start_offset_samples"`
+}
+
+type multitrackTrack struct {
+	info    *MultitrackInfo
+	file    *os.File
+	ogg     *OggOpusWriter
+	encoder *opus.Encoder
+}
+
+// MultitrackRecorder is a SpeakerTap that records every speaker into its own Ogg Opus file,
+// keyed by discord user id so a speaker rejoining with a new ssrc continues on the same track.
+// Every track gets a frame for every mixer frame after it starts, keeping them time aligned.
+type MultitrackRecorder struct {
+	Dir string
+
+	resolve SpeakerResolver
+
+	// Used by the mixer goroutine
+	current *multitrackFrame
+	skipped int
+	frames  chan *multitrackFrame
+	free    chan *multitrackFrame
+
+	// Used by the writer goroutine. ssrcTracks remembers the tracks of identified ssrc's,
+	// as the mixer forgets the ssrc of a departed speaker before their last frames are written
+	manifest   *MultitrackManifest
+	tracks     map[string]*multitrackTrack
+	ssrcTracks map[uint32]*multitrackTrack
+	frameIndex int64
+	pcm        []int16
+	packet     []byte
+
+	done    chan bool
+	errLock sync.Mutex
+	err     error
+}
+
+// NewMultitrackRecorder creates the directory for a new multitrack recording and starts the track writer
+func NewMultitrackRecorder(dir, station string, resolve SpeakerResolver) (*MultitrackRecorder, error) {
+	started := time.Now()
+	dir = filepath.Join(dir, fmt.Sprintf("%s-%s-tracks", safeFileName(station), started.Format("2006-01-02_15-04-05")))
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, errors.WithMessage(err, "NewMultitrackRecorder")
+	}
+
+	r := &MultitrackRecorder{
+		Dir:     dir,
+		resolve: resolve,
+		frames:  make(chan *multitrackFrame, multitrackQueueSize),
+		free:    make(chan *multitrackFrame, multitrackQueueSize+1),
+		manifest: &MultitrackManifest{
+			Station:    station,
+			Started:    started,
+			SampleRate: SampleRate,
+		},
+		tracks:     make(map[string]*multitrackTrack),
+		ssrcTracks: make(map[uint32]*multitrackTrack),
+		pcm:        make([]int16, FrameSamples),
+		packet:     make([]byte, 0xfff),
+		done:       make(chan bool),
+	}
+	r.current = r.newFrame()
+
+	go r.run()
+	return r, nil
+}
+
+func (r *MultitrackRecorder) newFrame() *multitrackFrame {
+	select {
+	case frame := <-r.free:
+		return frame
+	default:
+		return &multitrackFrame{speakers: make(map[uint32][]int16)}
+	}
+}
+
+// WriteSpeaker implements SpeakerTap
+func (r *MultitrackRecorder) WriteSpeaker(ssrc uint32, pcm []int16) {
+	buf := r.current.speakers[ssrc]
+	r.current.speakers[ssrc] = append(buf[:0], pcm...)
+}
+
+// EndFrame implements SpeakerTap
+func (r *MultitrackRecorder) EndFrame() {
+	r.current.skipped = r.skipped
+
+	select {
+	case r.frames <- r.current:
+		r.skipped = 0
+		r.current = r.newFrame()
+	default:
+		// The writer fell behind, drop the frame, it will be written as silence to keep the tracks aligned
+		r.skipped++
+	}
+
+	for ssrc, buf := range r.current.speakers {
+		r.current.speakers[ssrc] = buf[:0]
+	}
+}
+
+func (r *MultitrackRecorder) run() {
+	for frame := range r.frames {
+		err := r.writeFrame(frame)
+		if err != nil {
+			r.setErr(err)
+		}
+
+		select {
+		case r.free <- frame:
+		default:
+		}
+	}
+
+	for _, t := range r.tracks {
+		err := t.ogg.Close()
+		if cerr := t.file.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			r.setErr(err)
+		}
+	}
+
+	err := r.writeManifest()
+	if err != nil {
+		r.setErr(err)
+	}
+
+	close(r.done)
+}
+
+func (r *MultitrackRecorder) setErr(err error) {
+	r.errLock.Lock()
+	if r.err == nil {
+		r.err = err
+		log("Multitrack recording error: ", err)
+	}
+	r.errLock.Unlock()
+}
+
+func (r *MultitrackRecorder) writeFrame(frame *multitrackFrame) error {
+	for i := 0; i < frame.skipped; i++ {
+		err := r.writeSilence(nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	written := make(map[*multitrackTrack]bool, len(frame.speakers))
+	for ssrc, pcm := range frame.speakers {
+		if len(pcm) < 1 {
+			continue
+		}
+
+		t, err := r.track(ssrc)
+		if err != nil {
+			return err
+		}
+
+		if written[t] {
+			// Old and new ssrc of a rejoining user overlapping, keep it to one frame per frame
+			continue
+		}
+
+		// Pad partial frames with silence
+		n := copy(r.pcm, pcm)
+		for i := n; i < len(r.pcm); i++ {
+			r.pcm[i] = 0
+		}
+
+		size, err := t.encoder.Encode(r.pcm, r.packet)
+		if err != nil {
+			return errors.WithMessage(err, "MultitrackRecorder, Encode")
+		}
+
+		err = t.ogg.WritePacket(r.packet[:size], FrameSize)
+		if err != nil {
+			return errors.WithMessage(err, "MultitrackRecorder, WritePacket")
+		}
+		written[t] = true
+	}
+
+	return r.writeSilence(written)
+}
+
+// writeSilence writes a silence frame to every track not in skip, and advances the frame index
+func (r *MultitrackRecorder) writeSilence(skip map[*multitrackTrack]bool) error {
+	for _, t := range r.tracks {
+		if skip[t] {
+			continue
+		}
+
+		err := t.ogg.WritePacket(OpusSilence, FrameSize)
+		if err != nil {
+			return errors.WithMessage(err, "MultitrackRecorder, WritePacket")
+		}
+	}
+
+	r.frameIndex++
+	return nil
+}
+
+// track returns the track of the user behind the ssrc, creating it if needed
+func (r *MultitrackRecorder) track(ssrc uint32) (*multitrackTrack, error) {
+	if t, ok := r.ssrcTracks[ssrc]; ok {
+		return t, nil
+	}
+
+	userID, username, ok := r.resolve(ssrc)
+	fileName := fmt.Sprintf("%s-%s.opus", safeFileName(username), userID)
+	if !ok {
+		// Not known yet, keep them on a track of their own
+		userID = "ssrc-" + strconv.FormatUint(uint64(ssrc), 10)
+		username = userID
+		fileName = userID + ".opus"
+	}
+
+	if t, found := r.tracks[userID]; found {
+		if ok {
+			r.ssrcTracks[ssrc] = t
+		}
+		return t, nil
+	}
+
+	info := &MultitrackInfo{
+		UserID:             userID,
+		Username:           username,
+		File:               fileName,
+		StartOffsetMS:      r.frameIndex * int64(FrameDuration/time.Millisecond),
+		StartOffsetSamples: r.frameIndex * FrameSize,
+	}
+
+	file, err := os.Create(filepath.Join(r.Dir, info.File))
+	if err != nil {
+		return nil, errors.WithMessage(err, "MultitrackRecorder, creating track")
+	}
+
+	ogg, err := NewOggOpusWriter(file, 2, map[string]string{
+		"TITLE":  username,
+		"ARTIST": username,
+		"ALBUM":  r.manifest.Station,
+	})
+	if err != nil {
+		file.Close()
+		return nil, errors.WithMessage(err, "MultitrackRecorder, creating track")
+	}
+
+	enc, err := opus.NewEncoder(SampleRate, 2, opus.AppVoIP)
+	if err != nil {
+		file.Close()
+		return nil, errors.WithMessage(err, "MultitrackRecorder, creating encoder")
+	}
+
+	t := &multitrackTrack{
+		info:    info,
+		file:    file,
+		ogg:     ogg,
+		encoder: enc,
+	}
+	r.tracks[userID] = t
+	if ok {
+		r.ssrcTracks[ssrc] = t
+	}
+	r.manifest.Tracks = append(r.manifest.Tracks, info)
+
+	// Keep the manifest up to date in case we crash
+	return t, r.writeManifest()
+}
+
+func (r *MultitrackRecorder) writeManifest() error {
+	serialized, err := json.MarshalIndent(r.manifest, "", "  ")
+	if err != nil {
+		return errors.WithMessage(err, "MultitrackRecorder, writeManifest")
+	}
+
+	err = ioutil.WriteFile(filepath.Join(r.Dir, "manifest.json"), serialized, 0644)
+	return errors.WithMessage(err, "MultitrackRecorder, writeManifest")
+}
+
+// Close finishes all the tracks and writes the final manifest, it must be removed from the mixer first
+func (r *MultitrackRecorder) Close() error {
+	close(r.frames)
+	<-r.done
+
+	r.errLock.Lock()
+	err := r.err
+	r.errLock.Unlock()
+	return err
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMultitrackAlignment(t *testing.T) {
+	dir, err := ioutil.TempDir("", "multitrack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// ssrc 3 is the first speaker rejoining, ssrc 4 is never identified
+	users := map[uint32]string{1: "100", 2: "200", 3: "100"}
+	resolve := func(ssrc uint32) (string, string, bool) {
+		userID, ok := users[ssrc]
+		return userID, "user" + userID, ok
+	}
+
+	r, err := NewMultitrackRecorder(dir, "test station", resolve)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pcm := make([]int16, FrameSamples)
+	for i := 0; i < 30; i++ {
+		if i < 20 {
+			r.WriteSpeaker(1, pcm)
+		} else {
+			r.WriteSpeaker(3, pcm)
+		}
+		if i >= 10 {
+			r.WriteSpeaker(2, pcm)
+		}
+		if i == 25 {
+			r.WriteSpeaker(4, pcm)
+		}
+		// The queue has room for all the frames, nothing is dropped
+		r.EndFrame()
+	}
+
+	err = r.Close()
+	if err != nil {
+		t.Fatal("Failed closing: ", err)
+	}
+
+	serialized, err := ioutil.ReadFile(filepath.Join(r.Dir, "manifest.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var manifest MultitrackManifest
+	err = json.Unmarshal(serialized, &manifest)
+	if err != nil {
+		t.Fatal("Failed decoding the manifest: ", err)
+	}
+
+	expected := []struct {
+		userID  string
+		offset  int
+		packets int
+	}{
+		{"100", 0, 30},
+		{"200", 10, 20},
+		{"ssrc-4", 25, 5},
+	}
+
+	if len(manifest.Tracks) != len(expected) {
+		t.Fatalf("Expected %d tracks, got %d", len(expected), len(manifest.Tracks))
+	}
+
+	for i, e := range expected {
+		track := manifest.Tracks[i]
+		if track.UserID != e.userID {
+			t.Errorf("Expected track %d to be of %s, got %s", i, e.userID, track.UserID)
+			continue
+		}
+
+		if track.StartOffsetSamples != int64(e.offset*FrameSize) || track.StartOffsetMS != int64(e.offset*20) {
+			t.Errorf("Track of %s starts at %d samples / %d ms, expected frame %d", e.userID, track.StartOffsetSamples, track.StartOffsetMS, e.offset)
+		}
+
+		if n := countOggPackets(t, filepath.Join(r.Dir, track.File)); n != e.packets {
+			t.Errorf("Expected %d packets in the track of %s, got %d", e.packets, e.userID, n)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Music bed defaults
+const (
+	DefaultBedLevel       = 0.3
+	DefaultBedDuckDepth   = 15.0 // dB
+	DefaultBedDuckAttack  = time.Millisecond * 100
+	DefaultBedDuckRelease = time.Millisecond * 1500
+)
+
+// MusicBed plays a playlist of tracks from the music library on repeat under the voices, ducking it while anyone's talking
+type MusicBed struct {
+	Dir string
+
+	lock    sync.Mutex
+	level   float32
+	ducker  *Ducker
+	player  *playlistPlayer // nil if not playing
+	current string
+
+	buf []float32
+}
+
+// NewMusicBed returns a new music bed playing tracks from the library dir
+func NewMusicBed(dir string) *MusicBed {
+	mb := &MusicBed{
+		Dir:    dir,
+		level:  DefaultBedLevel,
+		ducker: NewDucker(),
+		buf:    make([]float32, FrameSamples),
+	}
+	mb.ducker.Set(TalkoverSettings{
+		Enabled: true,
+		Depth:   DefaultBedDuckDepth,
+		Attack:  DefaultBedDuckAttack,
+		Release: DefaultBedDuckRelease,
+	})
+	return mb
+}
+
+// Play starts playing the tracks in order on repeat, replacing the current playlist
+func (mb *MusicBed) Play(tracks []string) error {
+	player, err := newPlaylistPlayer(mb.Dir, tracks, false)
+	if err != nil {
+		return err
+	}
+
+	mb.lock.Lock()
+	if mb.player != nil {
+		mb.player.Stop()
+	}
+	mb.player = player
+	mb.current = ""
+	mb.lock.Unlock()
+	return nil
+}
+
+// Stop stops the bed, returns false if it wasn't playing
+func (mb *MusicBed) Stop() bool {
+	mb.lock.Lock()
+	defer mb.lock.Unlock()
+
+	if mb.player == nil {
+		return false
+	}
+
+	mb.player.Stop()
+	mb.player = nil
+	mb.current = ""
+	return true
+}
+
+// SetLevel sets the level of the bed, 1 being unchanged
+func (mb *MusicBed) SetLevel(level float32) {
+	mb.lock.Lock()
+	mb.level = level
+	mb.lock.Unlock()
+}
+
+// SetDucking sets how many dB the bed is ducked by while anyone's talking, and how fast
+func (mb *MusicBed) SetDucking(depth float64, attack, release time.Duration) {
+	mb.lock.Lock()
+	mb.ducker.Set(TalkoverSettings{
+		Enabled: depth > 0,
+		Depth:   depth,
+		Attack:  attack,
+		Release: release,
+	})
+	mb.lock.Unlock()
+}
+
+// Ducking returns the current ducking settings
+func (mb *MusicBed) Ducking() TalkoverSettings {
+	mb.lock.Lock()
+	settings := mb.ducker.TalkoverSettings
+	mb.lock.Unlock()
+	return settings
+}
+
+// Status returns the level, the playlist and the track playing, tracks is empty if the bed is off
+func (mb *MusicBed) Status() (level float32, tracks []string, current string) {
+	mb.lock.Lock()
+	level = mb.level
+	if mb.player != nil {
+		tracks = append(tracks, mb.player.Tracks...)
+	}
+	current = mb.current
+	mb.lock.Unlock()
+	return
+}
+
+// MixFrame implements MixerSource
+func (mb *MusicBed) MixFrame(bus []float32, speaking bool) bool {
+	mb.lock.Lock()
+	defer mb.lock.Unlock()
+
+	if mb.player == nil {
+		return false
+	}
+
+	frame, ok := mb.player.next()
+	if !ok {
+		return false
+	}
+	mb.current = frame.track
+
+	for i, v := range frame.pcm {
+		mb.buf[i] = float32(v) / 0x8000 * mb.level
+	}
+	mb.player.done(frame)
+
+	mb.ducker.Process(mb.buf, speaking)
+	for i, v := range mb.buf {
+		bus[i] += v
+	}
+	return true
+}
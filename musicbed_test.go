@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestWAV writes frames of 48khz stereo at a constant value
+func writeTestWAV(t *testing.T, path string, frames int, value int16) {
+	var buf bytes.Buffer
+	buf.WriteString("RIFF")
+	binary.Write(&buf, binary.LittleEndian, uint32(36+frames*4))
+	buf.WriteString("WAVEfmt ")
+	binary.Write(&buf, binary.LittleEndian, []uint32{16})
+	binary.Write(&buf, binary.LittleEndian, []uint16{1, 2})
+	binary.Write(&buf, binary.LittleEndian, []uint32{SampleRate, SampleRate * 4})
+	binary.Write(&buf, binary.LittleEndian, []uint16{4, 16})
+	buf.WriteString("data")
+	binary.Write(&buf, binary.LittleEndian, uint32(frames*4))
+	for i := 0; i < frames*2; i++ {
+		binary.Write(&buf, binary.LittleEndian, value)
+	}
+
+	err := ioutil.WriteFile(path, buf.Bytes(), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// mixBedFrame waits for the decoder and mixes the next frame of the bed
+func mixBedFrame(t *testing.T, mb *MusicBed, speaking bool) []float32 {
+	bus := make([]float32, FrameSamples)
+	deadline := time.Now().Add(time.Second)
+	for !mb.MixFrame(bus, speaking) {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the bed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return bus
+}
+
+func TestMusicBed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "musicbed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Shorter than a frame, so frames continue across the repeats
+	writeTestWAV(t, filepath.Join(dir, "Track.wav"), FrameSize/2, 0x4000)
+
+	mb := NewMusicBed(dir)
+	mb.SetLevel(0.5)
+	if err := mb.Play([]string{"nope"}); err != ErrUnknownSound {
+		t.Error("Unknown track gave: ", err)
+	}
+
+	err = mb.Play([]string{"track"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, tracks, _ := mb.Status(); len(tracks) != 1 || tracks[0] != "Track" {
+		t.Error("Unexpected playlist: ", tracks)
+	}
+
+	bus := mixBedFrame(t, mb, false)
+	if bus[0] != 0.25 || bus[FrameSamples-1] != 0.25 {
+		t.Error("Expected a full frame at the bed level, got ", bus[0], bus[FrameSamples-1])
+	}
+
+	// Ducked once the attack is over
+	for i := 0; i < 20; i++ {
+		bus = mixBedFrame(t, mb, true)
+	}
+	if expected := float32(0.25 * dbToLinear(-DefaultBedDuckDepth)); bus[FrameSamples-1] > expected*1.1 {
+		t.Error("Bed not ducked while speaking: ", bus[FrameSamples-1], ", expected ", expected)
+	}
+
+	if !mb.Stop() {
+		t.Error("Stop says the bed wasn't playing")
+	}
+	if mb.MixFrame(bus, false) {
+		t.Error("Bed still playing after being stopped")
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"io"
+	"math/rand"
+)
+
+const (
+	// OggPreSkip is the number of samples the decoder should discard at the start of a stream,
+	// the lookahead of the libopus encoder
+	OggPreSkip = 312
+
+	// Max packets per ogg page, around a second of 20ms frames
+	oggMaxPagePackets = 50
+
+	oggFlagBOS = 0x02
+	oggFlagEOS = 0x04
+
+	// Packets continued across pages are given up on past this size, no sane opus packet comes close
+	maxOggPacketSize = 64 * 1024
+)
+
+var oggCRCTable = func() (table [256]uint32) {
+	for i := range table {
+		r := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if r&0x80000000 != 0 {
+				r = (r << 1) ^ 0x04c11db7
+			} else {
+				r <<= 1
+			}
+		}
+		table[i] = r
+	}
+	return
+}()
+
+func oggCRC(data []byte) uint32 {
+	var crc uint32
+	for _, b := range data {
+		crc = (crc << 8) ^ oggCRCTable[byte(crc>>24)^b]
+	}
+	return crc
+}
+
+// OggOpusWriter writes opus packets to an Ogg Opus stream as specified in RFC 7845
+type OggOpusWriter struct {
+	w io.Writer
+
+	serial  uint32
+	pageSeq uint32
+	granule uint64
+
+	// Packets waiting to be written in the next page
+	pending     [][]byte
+	numSegments int
+	closed      bool
+
+	page []byte
+}
+
+// NewOggOpusWriter writes the identification and comment headers to w, and returns
+// a writer for the audio packets
+func NewOggOpusWriter(w io.Writer, channels int, tags map[string]string) (*OggOpusWriter, error) {
+	ow := &OggOpusWriter{
+		w:      w,
+		serial: rand.Uint32(),
+	}
+
+	head := make([]byte, 19)
+	copy(head, "OpusHead")
+	head[8] = 1 // Version
+	head[9] = byte(channels)
+	binary.LittleEndian.PutUint16(head[10:], OggPreSkip)
+	binary.LittleEndian.PutUint32(head[12:], SampleRate)
+	// Output gain and channel mapping family 0 are left as zero
+
+	err := ow.writePage([][]byte{head}, 0, oggFlagBOS)
+	if err != nil {
+		return nil, errors.WithMessage(err, "NewOggOpusWriter, OpusHead")
+	}
+
+	const vendor = "discordradio"
+	comments := make([]byte, 0, 64)
+	comments = append(comments, "OpusTags"...)
+	comments = appendUint32LE(comments, uint32(len(vendor)))
+	comments = append(comments, vendor...)
+	comments = appendUint32LE(comments, uint32(len(tags)))
+	for k, v := range tags {
+		comments = appendUint32LE(comments, uint32(len(k)+1+len(v)))
+		comments = append(comments, k+"="+v...)
+	}
+
+	err = ow.writePage([][]byte{comments}, 0, 0)
+	if err != nil {
+		return nil, errors.WithMessage(err, "NewOggOpusWriter, OpusTags")
+	}
+
+	return ow, nil
+}
+
+func appendUint32LE(b []byte, v uint32) []byte {
+	return append(b, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+// WritePacket queues a packet containing the specified number of samples (per channel, at 48khz)
+// for writing, pages are written once they're full
+func (ow *OggOpusWriter) WritePacket(packet []byte, samples int) error {
+	if ow.closed {
+		return errors.New("OggOpusWriter is closed")
+	}
+
+	segments := len(packet)/255 + 1
+	if ow.numSegments+segments > 255 || len(ow.pending) >= oggMaxPagePackets {
+		err := ow.Flush()
+		if err != nil {
+			return err
+		}
+	}
+
+	// The packet has to be copied as the caller may reuse it
+	cop := make([]byte, len(packet))
+	copy(cop, packet)
+
+	ow.pending = append(ow.pending, cop)
+	ow.numSegments += segments
+	ow.granule += uint64(samples)
+	return nil
+}
+
+// Flush writes the pending packets as a page
+func (ow *OggOpusWriter) Flush() error {
+	if len(ow.pending) < 1 {
+		return nil
+	}
+
+	return ow.flush(0)
+}
+
+func (ow *OggOpusWriter) flush(flags byte) error {
+	err := ow.writePage(ow.pending, ow.granule, flags)
+	ow.pending = ow.pending[:0]
+	ow.numSegments = 0
+	return err
+}
+
+// Close writes the remaining packets in the last page of the stream, it does not close the underlying writer
+func (ow *OggOpusWriter) Close() error {
+	if ow.closed {
+		return nil
+	}
+
+	ow.closed = true
+	return ow.flush(oggFlagEOS)
+}
+
+// Granule returns the granule position after the last written packet
+func (ow *OggOpusWriter) Granule() uint64 {
+	return ow.granule
+}
+
+func (ow *OggOpusWriter) writePage(packets [][]byte, granule uint64, flags byte) error {
+	page := ow.page[:0]
+	page = append(page, "OggS"...)
+	page = append(page, 0, flags)
+	page = appendUint32LE(page, uint32(granule))
+	page = appendUint32LE(page, uint32(granule>>32))
+	page = appendUint32LE(page, ow.serial)
+	page = appendUint32LE(page, ow.pageSeq)
+	page = appendUint32LE(page, 0) // CRC, filled in below
+
+	numSegments := 0
+	for _, p := range packets {
+		numSegments += len(p)/255 + 1
+	}
+	page = append(page, byte(numSegments))
+
+	// Lacing values, a packet is split into 255 byte segments and ended with a segment shorter than 255
+	for _, p := range packets {
+		for i := 0; i < len(p)/255; i++ {
+			page = append(page, 255)
+		}
+		page = append(page, byte(len(p)%255))
+	}
+
+	for _, p := range packets {
+		page = append(page, p...)
+	}
+
+	binary.LittleEndian.PutUint32(page[22:], oggCRC(page))
+	ow.page = page
+	ow.pageSeq++
+
+	_, err := ow.w.Write(page)
+	return err
+}
+
+var (
+	ErrNotOggOpus        = errors.New("Not an Ogg Opus stream")
+	ErrOggBadChecksum    = errors.New("Bad ogg page checksum")
+	ErrOggPacketTooLarge = errors.New("Ogg packet too large")
+)
+
+// OggOpusReader reads the audio packets of the first logical stream of an Ogg Opus stream
+type OggOpusReader struct {
+	r io.Reader
+
+	Channels int
+	PreSkip  int // Samples to discard at the start
+
+	serial  uint32
+	started bool
+	eos     bool
+
+	// Packets of the current page not read yet, and the start of a packet continued on the next page
+	packets [][]byte
+	partial []byte
+}
+
+// NewOggOpusReader reads the identification and comment headers from r, and returns
+// a reader for the audio packets
+func NewOggOpusReader(r io.Reader) (*OggOpusReader, error) {
+	or := &OggOpusReader{r: r}
+
+	head, err := or.ReadPacket()
+	if err != nil {
+		return nil, errors.WithMessage(err, "NewOggOpusReader, OpusHead")
+	}
+	if len(head) < 19 || string(head[:8]) != "OpusHead" {
+		return nil, ErrNotOggOpus
+	}
+	or.Channels = int(head[9])
+	or.PreSkip = int(binary.LittleEndian.Uint16(head[10:]))
+
+	tags, err := or.ReadPacket()
+	if err != nil {
+		return nil, errors.WithMessage(err, "NewOggOpusReader, OpusTags")
+	}
+	if len(tags) < 8 || string(tags[:8]) != "OpusTags" {
+		return nil, ErrNotOggOpus
+	}
+
+	return or, nil
+}
+
+// ReadPacket returns the next packet, or io.EOF at the end of the stream
+func (or *OggOpusReader) ReadPacket() ([]byte, error) {
+	for len(or.packets) < 1 {
+		if or.eos {
+			return nil, io.EOF
+		}
+
+		err := or.readPage()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	p := or.packets[0]
+	or.packets = or.packets[1:]
+	return p, nil
+}
+
+// readPage reads the next page of the stream, splitting it up into packets
+func (or *OggOpusReader) readPage() error {
+	header := make([]byte, 27, 27+255)
+	_, err := io.ReadFull(or.r, header)
+	if err != nil {
+		return err
+	}
+	if string(header[:4]) != "OggS" {
+		return ErrNotOggOpus
+	}
+
+	lacing := header[27 : 27+int(header[26])]
+	_, err = io.ReadFull(or.r, lacing)
+	if err != nil {
+		return errors.WithMessage(err, "readPage, lacing")
+	}
+	header = header[:27+len(lacing)]
+
+	size := 0
+	for _, l := range lacing {
+		size += int(l)
+	}
+	data := make([]byte, size)
+	_, err = io.ReadFull(or.r, data)
+	if err != nil {
+		return errors.WithMessage(err, "readPage, data")
+	}
+
+	crc := binary.LittleEndian.Uint32(header[22:])
+	binary.LittleEndian.PutUint32(header[22:], 0)
+	if oggCRC(append(header, data...)) != crc {
+		return ErrOggBadChecksum
+	}
+
+	serial := binary.LittleEndian.Uint32(header[14:])
+	if !or.started {
+		or.serial = serial
+		or.started = true
+	} else if serial != or.serial {
+		// Another logical stream multiplexed in
+		return nil
+	}
+
+	for _, l := range lacing {
+		or.partial = append(or.partial, data[:l]...)
+		data = data[l:]
+		if l < 255 {
+			or.packets = append(or.packets, or.partial)
+			or.partial = nil
+		}
+	}
+
+	if len(or.partial) > maxOggPacketSize {
+		return ErrOggPacketTooLarge
+	}
+
+	if header[5]&oggFlagEOS != 0 {
+		or.eos = true
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+func TestOggOpusWriter(t *testing.T) {
+	var buf bytes.Buffer
+	ow, err := NewOggOpusWriter(&buf, 2, map[string]string{"TITLE": "test"})
+	if err != nil {
+		t.Fatal("Failed creating writer: ", err)
+	}
+
+	for i := 0; i < 120; i++ {
+		err = ow.WritePacket(Silence, 960)
+		if err != nil {
+			t.Fatal("Failed writing packet: ", err)
+		}
+	}
+	ow.Close()
+
+	// Walk the pages, checking the checksums and that the last one ends the stream at the right granule
+	data := buf.Bytes()
+	pages := 0
+	var lastFlags byte
+	var lastGranule uint64
+	for len(data) > 0 {
+		if !bytes.HasPrefix(data, []byte("OggS")) {
+			t.Fatal("Page does not start with OggS")
+		}
+
+		numSegments := int(data[26])
+		size := 27 + numSegments
+		for _, lacing := range data[27 : 27+numSegments] {
+			size += int(lacing)
+		}
+
+		page := make([]byte, size)
+		copy(page, data[:size])
+		crc := binary.LittleEndian.Uint32(page[22:])
+		binary.LittleEndian.PutUint32(page[22:], 0)
+		if oggCRC(page) != crc {
+			t.Errorf("Page %d has a bad checksum", pages)
+		}
+
+		if binary.LittleEndian.Uint32(page[18:]) != uint32(pages) {
+			t.Errorf("Page %d has the wrong sequence number", pages)
+		}
+
+		lastFlags = page[5]
+		lastGranule = binary.LittleEndian.Uint64(page[6:])
+		data = data[size:]
+		pages++
+	}
+
+	// 2 header pages + 3 pages of audio
+	if pages != 5 {
+		t.Error("Expected 5 pages, got ", pages)
+	}
+
+	if lastFlags&oggFlagEOS == 0 {
+		t.Error("Last page is not marked as the end of the stream")
+	}
+
+	if lastGranule != 120*960 {
+		t.Error("Expected a final granule position of 120*960, got ", lastGranule)
+	}
+}
+
+func TestOggOpusReader(t *testing.T) {
+	var buf bytes.Buffer
+	ow, err := NewOggOpusWriter(&buf, 2, nil)
+	if err != nil {
+		t.Fatal("Failed creating writer: ", err)
+	}
+
+	// Big enough to span multiple segments
+	large := bytes.Repeat([]byte{7}, 600)
+	for i := 0; i < 120; i++ {
+		packet := Silence
+		if i%10 == 0 {
+			packet = large
+		}
+		ow.WritePacket(packet, 960)
+	}
+	ow.Close()
+
+	or, err := NewOggOpusReader(&buf)
+	if err != nil {
+		t.Fatal("Failed creating reader: ", err)
+	}
+	if or.Channels != 2 || or.PreSkip != OggPreSkip {
+		t.Error("Wrong header: ", or.Channels, or.PreSkip)
+	}
+
+	for i := 0; i < 120; i++ {
+		packet, err := or.ReadPacket()
+		if err != nil {
+			t.Fatal("Failed reading packet ", i, ": ", err)
+		}
+
+		expected := Silence
+		if i%10 == 0 {
+			expected = large
+		}
+		if !bytes.Equal(packet, expected) {
+			t.Fatalf("Packet %d differs, got %d bytes", i, len(packet))
+		}
+	}
+
+	if _, err := or.ReadPacket(); err != io.EOF {
+		t.Error("Expected io.EOF at the end of the stream, got ", err)
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+// SlowConsumerPolicy decides what happens when an output can't keep up and its queue is full
+type SlowConsumerPolicy int
+
+const (
+	// DropOldest drops the oldest queued frame to make room for the new one
+	DropOldest SlowConsumerPolicy = iota
+	// DropNewest drops the new frame
+	DropNewest
+	// Disconnect removes the output from the mixer
+	Disconnect
+)
+
+var slowConsumerPolicyNames = map[SlowConsumerPolicy]string{
+	DropOldest: "dropoldest",
+	DropNewest: "dropnewest",
+	Disconnect: "disconnect",
+}
+
+func (p SlowConsumerPolicy) String() string {
+	return slowConsumerPolicyNames[p]
+}
+
+// ParseSlowConsumerPolicy returns the policy by name
+func ParseSlowConsumerPolicy(name string) (SlowConsumerPolicy, bool) {
+	name = strings.ToLower(name)
+	for p, n := range slowConsumerPolicyNames {
+		if n == name {
+			return p, true
+		}
+	}
+
+	return DropOldest, false
+}
+
+// DefaultOutputQueueSize is the default number of frames queued per output, half a second
+const DefaultOutputQueueSize = 25
+
+// OutputDisconnecter can be implemented by outputs that need to know when the mixer
+// disconnects them for not keeping up
+type OutputDisconnecter interface {
+	OutputDisconnected()
+}
+
+// SpeakingOutput can be implemented by outputs that don't want frames while the broadcast is silent,
+// SetSpeaking is called in order with the frames when it goes silent and when it resumes
+type SpeakingOutput interface {
+	SetSpeaking(speaking bool) error
+}
+
+// endOfSpeech is queued to outputs implementing SpeakingOutput when the broadcast goes silent,
+// it's never released
+var endOfSpeech = &opusFrame{refs: 1}
+
+// releaseQueued releases a frame taken out of a queue
+func releaseQueued(frame *opusFrame) {
+	if frame != endOfSpeech {
+		frame.release()
+	}
+}
+
+// OutputStats contains the queue depth and counters of a single output
+type OutputStats struct {
+	Output  MixerOutput
+	Tier    string
+	Depth   int
+	Sent    int64
+	Dropped int64
+}
+
+func (o OutputStats) String() string {
+	name := fmt.Sprintf("%T", o.Output)
+	if s, ok := o.Output.(fmt.Stringer); ok {
+		name = s.String()
+	}
+
+	return fmt.Sprintf("%s (%s): queued %d, sent %d, dropped %d", name, o.Tier, o.Depth, o.Sent, o.Dropped)
+}
+
+// outputQueue is a bounded ordered queue of frames for a single output, sent by a dedicated goroutine
+// so a slow output can't hold up the mixer or the other outputs
+type outputQueue struct {
+	output MixerOutput
+	tier   *encoderTier
+	policy SlowConsumerPolicy
+	mixer  *Mixer
+
+	frames chan *opusFrame
+	stop   chan bool
+
+	// Set if the output can go quiet during silence. silenced is owned by the mixer and is whether
+	// endOfSpeech has been queued, speaking is owned by run
+	speaker  SpeakingOutput
+	silenced bool
+	speaking bool
+
+	// Played before the live feed if set, owned by run. prerollFrames is the number of frames
+	// left of it, owned by the mixer
+	preroll       *preroll
+	prerollFrames int
+
+	sent    int64
+	dropped int64
+}
+
+func newOutputQueue(mixer *Mixer, output MixerOutput, tier *encoderTier, size int, policy SlowConsumerPolicy) *outputQueue {
+	speaker, _ := output.(SpeakingOutput)
+
+	return &outputQueue{
+		output:  output,
+		tier:    tier,
+		policy:  policy,
+		mixer:   mixer,
+		frames:  make(chan *opusFrame, size),
+		stop:    make(chan bool),
+		speaker: speaker,
+	}
+}
+
+// push queues a frame without blocking, taking a reference to it if it's queued.
+// Returns false if the output should be disconnected
+func (q *outputQueue) push(frame *opusFrame) bool {
+	frame.retain()
+
+	select {
+	case q.frames <- frame:
+		return true
+	default:
+	}
+
+	// Full
+	atomic.AddInt64(&q.dropped, 1)
+
+	switch q.policy {
+	case DropOldest:
+		select {
+		case oldest := <-q.frames:
+			releaseQueued(oldest)
+		default:
+		}
+
+		// Only the mixer pushes, so there's always room after taking one out
+		q.frames <- frame
+		return true
+	case Disconnect:
+		frame.release()
+		return false
+	}
+
+	frame.release()
+	return true
+}
+
+// pushEndOfSpeech queues endOfSpeech, dropping the oldest frame if the queue is full as the output
+// would otherwise be left speaking
+func (q *outputQueue) pushEndOfSpeech() {
+	select {
+	case q.frames <- endOfSpeech:
+		return
+	default:
+	}
+
+	atomic.AddInt64(&q.dropped, 1)
+	select {
+	case oldest := <-q.frames:
+		releaseQueued(oldest)
+	default:
+	}
+	q.frames <- endOfSpeech
+}
+
+// setSpeaking updates the speaking state of the output if it changed
+func (q *outputQueue) setSpeaking(speaking bool) {
+	if q.speaking == speaking {
+		return
+	}
+	q.speaking = speaking
+
+	err := q.speaker.SetSpeaking(speaking)
+	if err != nil {
+		log("Failed setting speaking state: ", err)
+	}
+}
+
+func (q *outputQueue) run() {
+	for {
+		select {
+		case frame := <-q.frames:
+			if frame == endOfSpeech {
+				q.setSpeaking(false)
+				continue
+			}
+			if q.speaker != nil {
+				q.setSpeaking(true)
+			}
+
+			data := frame.data
+			if q.preroll != nil {
+				data = q.preroll.process(data)
+				if q.preroll.done() {
+					q.preroll = nil
+				}
+			}
+
+			err := q.output.WriteOpus(data)
+			frame.release()
+			if err != nil {
+				log("Failed sending to output: ", err)
+				q.mixer.RemoveOutput(q.output)
+				q.drain()
+				return
+			}
+			atomic.AddInt64(&q.sent, 1)
+		case <-q.stop:
+			q.drain()
+			return
+		}
+	}
+}
+
+// drain releases the frames left in the queue
+func (q *outputQueue) drain() {
+	for {
+		select {
+		case frame := <-q.frames:
+			releaseQueued(frame)
+		default:
+			return
+		}
+	}
+}
+
+func (q *outputQueue) stats() OutputStats {
+	return OutputStats{
+		Output:  q.output,
+		Tier:    q.tier.profile.Name,
+		Depth:   len(q.frames),
+		Sent:    atomic.LoadInt64(&q.sent),
+		Dropped: atomic.LoadInt64(&q.dropped),
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestOutputQueuePolicies(t *testing.T) {
+	frames := []*opusFrame{wrapOpusFrame([]byte{1}), wrapOpusFrame([]byte{2}), wrapOpusFrame([]byte{3})}
+
+	q := newOutputQueue(nil, &DummyOutput{}, &encoderTier{}, 2, DropOldest)
+	for _, f := range frames {
+		if !q.push(f) {
+			t.Fatal("DropOldest disconnected")
+		}
+	}
+	if first := <-q.frames; first.data[0] != 2 {
+		t.Error("DropOldest kept frame ", first.data[0], ", expected 2")
+	}
+
+	q = newOutputQueue(nil, &DummyOutput{}, &encoderTier{}, 2, DropNewest)
+	for _, f := range frames {
+		q.push(f)
+	}
+	if first := <-q.frames; first.data[0] != 1 {
+		t.Error("DropNewest kept frame ", first.data[0], ", expected 1")
+	}
+
+	q = newOutputQueue(nil, &DummyOutput{}, &encoderTier{}, 2, Disconnect)
+	if !q.push(frames[0]) || !q.push(frames[1]) {
+		t.Fatal("Disconnect disconnected before the queue was full")
+	}
+	if q.push(frames[2]) {
+		t.Error("Disconnect didn't disconnect with a full queue")
+	}
+
+	if q.stats().Dropped != 1 {
+		t.Error("Dropped: ", q.stats().Dropped)
+	}
+}
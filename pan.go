@@ -0,0 +1,60 @@
+package main
+
+import (
+	"math"
+)
+
+// Positions handed out to speakers as they join with auto panning, in order,
+// alternating sides so the first few speakers are spread out evenly
+var autoPanPositions = []float32{0, -40, 40, -70, 70, -20, 20, -55, 55}
+
+// panGains returns the left and right gain for a pan position from -100 (left) to 100 (right).
+// Uses a constant power pan law normalized to unity in the center
+func panGains(pan float32) (left, right float32) {
+	if pan < -100 {
+		pan = -100
+	} else if pan > 100 {
+		pan = 100
+	}
+
+	angle := (float64(pan)/100 + 1) * math.Pi / 4
+	return float32(math.Cos(angle) * math.Sqrt2), float32(math.Sin(angle) * math.Sqrt2)
+}
+
+// applyPan folds the interleaved stereo pcm down to mono and places it at the pan position
+func applyPan(pcm []float32, pan float32) {
+	left, right := panGains(pan)
+	for i := 0; i+1 < len(pcm); i += 2 {
+		mono := (pcm[i] + pcm[i+1]) / 2
+		pcm[i] = mono * left
+		pcm[i+1] = mono * right
+	}
+}
+
+// assignAutoPanLocked hands out the next free auto pan position to the user if they don't have one yet,
+// and haven't been placed by hand. Called as speakers show up in the mix, usersLock has to be held
+func (mix *Mixer) assignAutoPanLocked(userID string) {
+	if _, ok := mix.autoPans[userID]; ok {
+		return
+	}
+	if settings, ok := mix.userSettings[userID]; ok && settings.PanSet {
+		return
+	}
+
+	// The least used position, the first in order on ties
+	best, bestUses := float32(0), -1
+	for _, pos := range autoPanPositions {
+		uses := 0
+		for _, v := range mix.autoPans {
+			if v == pos {
+				uses++
+			}
+		}
+
+		if bestUses == -1 || uses < bestUses {
+			best, bestUses = pos, uses
+		}
+	}
+
+	mix.autoPans[userID] = best
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"github.com/jonas747/discordgo"
+	"math"
+	"testing"
+)
+
+func TestPan(t *testing.T) {
+	left, right := panGains(0)
+	if math.Abs(float64(left-1)) > 1e-6 || math.Abs(float64(right-1)) > 1e-6 {
+		t.Errorf("Center should be unity, got %f, %f", left, right)
+	}
+
+	left, right = panGains(-100)
+	if right > 1e-6 || left < 1.4 {
+		t.Errorf("Hard left should only be on the left, got %f, %f", left, right)
+	}
+
+	pcm := []float32{0.5, 0.5}
+	applyPan(pcm, 50)
+	if pcm[0] >= pcm[1] {
+		t.Errorf("Panned right but the left is louder: %v", pcm)
+	}
+
+	mix := NewMixer()
+	mix.JitterTarget = 1
+	mix.SetAutoPan(true)
+	mix.SetPan("3", -100)
+
+	// Looking at the settings doesn't hand out positions
+	if pan := mix.UserSettings("1").Pan; pan != 0 || len(mix.autoPans) != 0 {
+		t.Errorf("Auto pan position %f handed out by a settings query", pan)
+	}
+
+	// Positions are handed out as speakers show up in the mix
+	users := []string{"1", "2", "3", "4"}
+	for i, userID := range users {
+		mix.Identities.Set(uint32(i+1), userID)
+		mix.Queue(&discordgo.Packet{SSRC: uint32(i + 1), Sequence: 0, Opus: Silence})
+	}
+	mix.processQueue()
+
+	positions := map[float32]bool{}
+	for _, userID := range users {
+		positions[mix.UserSettings(userID).Pan] = true
+	}
+	if len(positions) != 4 || !positions[-100] {
+		t.Errorf("Speakers weren't spread out: %v", positions)
+	}
+	if len(mix.autoPans) != 3 {
+		t.Errorf("Expected 3 auto pan positions, the speaker placed by hand doesn't take one, got %v", mix.autoPans)
+	}
+
+	// Positions stick
+	before := mix.UserSettings("2").Pan
+	mix.Queue(&discordgo.Packet{SSRC: 2, Sequence: 1, Opus: Silence})
+	mix.processQueue()
+	if a, b := before, mix.UserSettings("2").Pan; a != b {
+		t.Errorf("Auto pan position changed from %f to %f", a, b)
+	}
+}
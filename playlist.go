@@ -0,0 +1,187 @@
+package main
+
+import (
+	"github.com/pkg/errors"
+	"math/rand"
+	"path/filepath"
+	"strings"
+)
+
+// Frames decoded ahead of the mixer, a second
+const playlistQueueSize = 50
+
+var (
+	ErrEmptyPlaylist = errors.New("Empty playlist")
+
+	// Returned to DecodeSound to stop decoding when the player is stopped
+	errPlaylistStopped = errors.New("Playlist stopped")
+)
+
+// playlistFrame is a decoded frame of a playlist, and the name of the track it started in
+type playlistFrame struct {
+	pcm   []int16
+	track string
+}
+
+// playlistPlayer decodes the tracks of a playlist on repeat in a goroutine, ahead of the mixer so it never waits on the disk.
+// The frames are taken with next and handed back with done.
+type playlistPlayer struct {
+	Tracks  []string
+	Shuffle bool
+
+	// Plays the tracks once instead of on repeat, the last frame may be short
+	Once bool
+
+	paths []string
+
+	frames chan playlistFrame
+	free   chan []int16
+	stop   chan bool
+
+	// Set by next once the decoder is done and every frame has been taken
+	ended bool
+}
+
+// newPlaylistPlayer looks up the tracks in the library dir and starts decoding them,
+// the order is shuffled every time around if shuffle is set
+func newPlaylistPlayer(dir string, tracks []string, shuffle bool) (*playlistPlayer, error) {
+	return startPlaylistPlayer(dir, tracks, shuffle, false)
+}
+
+// newSoundPlayer looks up the sound in the library dir and starts decoding it, playing it once
+func newSoundPlayer(dir, name string) (*playlistPlayer, error) {
+	return startPlaylistPlayer(dir, []string{name}, false, true)
+}
+
+func startPlaylistPlayer(dir string, tracks []string, shuffle, once bool) (*playlistPlayer, error) {
+	if len(tracks) < 1 {
+		return nil, ErrEmptyPlaylist
+	}
+
+	p := &playlistPlayer{
+		Tracks:  make([]string, len(tracks)),
+		Shuffle: shuffle,
+		Once:    once,
+		paths:   make([]string, len(tracks)),
+		frames:  make(chan playlistFrame, playlistQueueSize),
+		free:    make(chan []int16, playlistQueueSize+2),
+		stop:    make(chan bool),
+	}
+
+	for i, name := range tracks {
+		path, err := findSound(dir, name)
+		if err != nil {
+			return nil, err
+		}
+		p.paths[i] = path
+		p.Tracks[i] = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+
+	for i := 0; i < cap(p.free); i++ {
+		p.free <- make([]int16, 0, FrameSamples)
+	}
+
+	go p.decode()
+	return p, nil
+}
+
+// Stop stops the decoder
+func (p *playlistPlayer) Stop() {
+	close(p.stop)
+}
+
+// next returns the next frame without blocking, ok is false if the decoder is behind or done
+func (p *playlistPlayer) next() (frame playlistFrame, ok bool) {
+	select {
+	case frame, ok = <-p.frames:
+		if !ok {
+			p.ended = true
+		}
+		return frame, ok
+	default:
+		return frame, false
+	}
+}
+
+// done hands a frame returned by next back to the decoder
+func (p *playlistPlayer) done(frame playlistFrame) {
+	p.free <- frame.pcm
+}
+
+// decode decodes the tracks into frames, on repeat unless Once is set, until stopped. It gives up if none of them can be played
+func (p *playlistPlayer) decode() {
+	defer close(p.frames)
+
+	var frame playlistFrame
+	order := make([]int, len(p.paths))
+	for i := range order {
+		order[i] = i
+	}
+	failed := 0
+
+	for {
+		if p.Shuffle {
+			order = rand.Perm(len(p.paths))
+		}
+
+		for _, i := range order {
+			decoded := false
+			err := DecodeSound(p.paths[i], func(pcm []int16) error {
+				decoded = true
+				for len(pcm) > 0 {
+					if frame.pcm == nil {
+						select {
+						case frame.pcm = <-p.free:
+							frame.pcm = frame.pcm[:0]
+							frame.track = p.Tracks[i]
+						case <-p.stop:
+							return errPlaylistStopped
+						}
+					}
+
+					// Frames continue across tracks so there's no gap between them
+					n := copy(frame.pcm[len(frame.pcm):FrameSamples], pcm)
+					frame.pcm = frame.pcm[:len(frame.pcm)+n]
+					pcm = pcm[n:]
+
+					if len(frame.pcm) == FrameSamples {
+						select {
+						case p.frames <- frame:
+							frame.pcm = nil
+						case <-p.stop:
+							return errPlaylistStopped
+						}
+					}
+				}
+				return nil
+			})
+
+			if err == errPlaylistStopped {
+				return
+			}
+			if err != nil {
+				log("Failed playing track ", p.paths[i], ": ", err)
+			}
+
+			if err != nil || !decoded {
+				failed++
+				if failed >= len(p.paths) {
+					log("None of the tracks of the playlist could be played, stopping")
+					return
+				}
+				continue
+			}
+			failed = 0
+		}
+
+		if p.Once {
+			if len(frame.pcm) > 0 {
+				select {
+				case p.frames <- frame:
+				case <-p.stop:
+				}
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPlaylistPlaysLongWAV(t *testing.T) {
+	dir, err := ioutil.TempDir("", "playlist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A long song, at 8khz mono to keep the file small
+	const length = time.Minute * 6
+	frames := int(length/time.Second) * 8000
+	var buf bytes.Buffer
+	buf.Write(wavHeader(frames, 1, 8000))
+	io.Copy(&buf, io.LimitReader(&rampReader{}, int64(frames*2)))
+	err = ioutil.WriteFile(filepath.Join(dir, "song.wav"), buf.Bytes(), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := newPlaylistPlayer(dir, []string{"song"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+
+	// Play most of it
+	deadline := time.Now().Add(time.Second * 10)
+	for played := 0; played < int((length-time.Second*5)/FrameDuration); {
+		frame, ok := p.next()
+		if !ok {
+			if time.Now().After(deadline) {
+				t.Fatalf("Stopped playing after %d frames", played)
+			}
+			time.Sleep(time.Millisecond)
+			continue
+		}
+
+		if frame.track != "song" {
+			t.Fatal("Unexpected track ", frame.track)
+		}
+		p.done(frame)
+		played++
+	}
+}
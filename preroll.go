@@ -0,0 +1,120 @@
+package main
+
+import (
+	"github.com/hraban/opus"
+	"github.com/pkg/errors"
+	"time"
+)
+
+const (
+	// MaxIdentLength is the longest ident a station can play to new listeners
+	MaxIdentLength = time.Second * 30
+
+	// The live feed fades in over the last this many frames of the ident, 500ms
+	prerollCrossfadeFrames = 25
+)
+
+var ErrIdentTooLong = errors.New("Ident too long")
+
+// preroll plays a clip to a single output before it gets the live feed, mixed on top of the live frames
+// it gets in the meantime and re-encoded with its own encoder, crossfading into the live feed at the end.
+// It's only used by the goroutine of the output's queue.
+type preroll struct {
+	ident []int16
+	pos   int
+
+	decoder *opus.Decoder
+	encoder *opus.Encoder
+
+	live []int16
+	pcm  []int16
+	out  []byte
+}
+
+// newPreroll returns a preroll of the 48khz interleaved stereo ident, encoded with the profile's settings
+func newPreroll(ident []int16, profile EncoderProfile) (*preroll, error) {
+	dec, err := opus.NewDecoder(SampleRate, 2)
+	if err != nil {
+		return nil, errors.WithMessage(err, "newPreroll, opus.NewDecoder")
+	}
+
+	enc, err := profile.newEncoder()
+	if err != nil {
+		return nil, errors.WithMessage(err, "newPreroll")
+	}
+
+	return &preroll{
+		ident:   ident,
+		decoder: dec,
+		encoder: enc,
+		live:    make([]int16, maxOpusPacketSamples*2),
+		pcm:     make([]int16, FrameSamples),
+		out:     make([]byte, maxOpusFrameSize),
+	}, nil
+}
+
+// prerollFrames returns the number of frames the ident takes up
+func prerollFrames(ident []int16) int {
+	return (len(ident) + FrameSamples - 1) / FrameSamples
+}
+
+// done returns true once the whole ident has been played
+func (p *preroll) done() bool {
+	return p.pos >= len(p.ident)
+}
+
+// process mixes the next frame of the ident with the live frame, and returns the encoded result.
+// The returned packet is reused by the next call.
+func (p *preroll) process(live []byte) []byte {
+	n, err := p.decoder.Decode(live, p.live)
+	if err != nil || n*2 != FrameSamples {
+		// Carry on with the ident over silence
+		n = 0
+	}
+	livePCM := p.live[:n*2]
+
+	// The live feed fades in, and the ident out, over the last frames
+	fadeStart := (prerollFrames(p.ident) - prerollCrossfadeFrames) * FrameSamples
+	if fadeStart < 0 {
+		fadeStart = 0
+	}
+	fadeLength := float32(prerollFrames(p.ident)*FrameSamples - fadeStart)
+
+	for i := range p.pcm {
+		pos := p.pos + i
+
+		var ident float32
+		if pos < len(p.ident) {
+			ident = float32(p.ident[pos])
+		}
+
+		liveGain := float32(0)
+		if pos >= fadeStart {
+			liveGain = float32(pos-fadeStart) / fadeLength
+		}
+
+		mixed := ident * (1 - liveGain)
+		if i < len(livePCM) {
+			mixed += float32(livePCM[i]) * liveGain
+		}
+		p.pcm[i] = clampInt16(mixed)
+	}
+	p.pos += FrameSamples
+
+	n, err = p.encoder.Encode(p.pcm, p.out)
+	if err != nil {
+		log("Failed encoding preroll: ", err)
+		return live
+	}
+	return p.out[:n]
+}
+
+func clampInt16(v float32) int16 {
+	if v > 0x7fff {
+		return 0x7fff
+	}
+	if v < -0x8000 {
+		return -0x8000
+	}
+	return int16(v)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPreroll(t *testing.T) {
+	ident := make([]int16, FrameSamples*30)
+	for i := range ident {
+		ident[i] = 1000
+	}
+
+	p, err := newPreroll(ident, DefaultEncoderProfiles[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frames := 0
+	for !p.done() {
+		if len(p.process(Silence)) < 1 {
+			t.Fatal("Empty packet")
+		}
+		frames++
+
+		if frames == 1 && p.pcm[0] != 1000 {
+			t.Error("Ident not played as is before the crossfade: ", p.pcm[0])
+		}
+	}
+
+	if frames != 30 {
+		t.Error("Expected 30 frames, got ", frames)
+	}
+	if last := p.pcm[FrameSamples-1]; last > 10 {
+		t.Error("Ident not faded out at the end: ", last)
+	}
+}
+
+func TestPrerollPlaysThroughSilence(t *testing.T) {
+	mix := NewMixer()
+	mix.SetSilenceSuppression(true)
+	mix.OutputQueueSize = 100
+
+	const identFrames = silenceHangoverFrames + silenceTailFrames + 10
+	out := &speakingOutput{events: make(chan string, 100)}
+	err := mix.AddOutputPreroll(out, DefaultTier, make([]int16, FrameSamples*identFrames))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	silent := make([]int16, FrameSamples)
+	for i := 0; i < identFrames+10; i++ {
+		mix.broadcastAudio(silent, nil)
+	}
+
+	expected := []string{"start"}
+	for i := 0; i < identFrames; i++ {
+		expected = append(expected, "frame")
+	}
+	expected = append(expected, "stop")
+
+	for i, e := range expected {
+		select {
+		case got := <-out.events:
+			if got != e {
+				t.Fatalf("Event %d: got %s, expected %s", i, got, e)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Event %d: timed out waiting for %s", i, e)
+		}
+	}
+}
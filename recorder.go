@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var (
+	ErrAlreadyRecording = errors.New("Already recording")
+	ErrNotRecording     = errors.New("Not recording")
+	ErrRecorderClosed   = errors.New("Recorder is closed")
+)
+
+// If the recording falls this far behind wall clock time, the gap is filled with silence
+const recorderGapThreshold = FrameDuration * 3
+
+// Recorder is a MixerOutput that writes the mix to Ogg Opus files,
+// starting a new file when the current one exceeds MaxSize or MaxDuration
+type Recorder struct {
+	sync.Mutex
+
+	Dir         string
+	Name        string
+	MaxSize     int64         // Bytes, 0 for no limit
+	MaxDuration time.Duration // 0 for no limit
+
+	file         *os.File
+	counter      *countingWriter
+	ogg          *OggOpusWriter
+	fileStarted  time.Time
+	fileDuration time.Duration
+
+	files  []string
+	closed bool
+}
+
+// NewRecorder returns a new recorder writing files named after name into dir
+func NewRecorder(dir, name string) *Recorder {
+	return &Recorder{
+		Dir:  dir,
+		Name: name,
+	}
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	return n, err
+}
+
+// safeFileName replaces everything but letters, digits, dashes and underscores
+func safeFileName(name string) string {
+	out := []rune(name)
+	for i, r := range out {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			out[i] = '_'
+		}
+	}
+	return string(out)
+}
+
+func (r *Recorder) String() string {
+	return "Recorder"
+}
+
+// WriteOpus implements MixerOutput
+func (r *Recorder) WriteOpus(opus []byte) error {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.closed {
+		return ErrRecorderClosed
+	}
+
+	if r.ogg == nil {
+		err := r.openFile()
+		if err != nil {
+			return errors.WithMessage(err, "Recorder.WriteOpus")
+		}
+	}
+
+	err := r.fillGap()
+	if err != nil {
+		return errors.WithMessage(err, "Recorder.WriteOpus")
+	}
+
+	err = r.writePacket(opus)
+	if err != nil {
+		return errors.WithMessage(err, "Recorder.WriteOpus")
+	}
+
+	if (r.MaxSize > 0 && r.counter.n >= r.MaxSize) || (r.MaxDuration > 0 && r.fileDuration >= r.MaxDuration) {
+		// The next write starts a new file
+		err = r.closeFile()
+		if err != nil {
+			return errors.WithMessage(err, "Recorder.WriteOpus, rotating")
+		}
+	}
+
+	return nil
+}
+
+func (r *Recorder) writePacket(opus []byte) error {
+	samples, err := opusPacketSamples(opus)
+	if err != nil {
+		return err
+	}
+
+	err = r.ogg.WritePacket(opus, samples)
+	if err != nil {
+		return err
+	}
+
+	r.fileDuration += time.Duration(samples) * time.Second / SampleRate
+	return nil
+}
+
+// fillGap writes silence for the frames the mixer didn't send us, so the recording stays in sync with the broadcast
+func (r *Recorder) fillGap() error {
+	behind := time.Since(r.fileStarted) - r.fileDuration
+	if behind < recorderGapThreshold {
+		return nil
+	}
+
+	for n := int(behind / FrameDuration); n > 0; n-- {
+		err := r.writePacket(OpusSilence)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *Recorder) openFile() error {
+	err := os.MkdirAll(r.Dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	started := time.Now()
+	path, file, err := createUniqueFile(r.Dir, fmt.Sprintf("%s-%s", safeFileName(r.Name), started.Format("2006-01-02_15-04-05")), ".opus")
+	if err != nil {
+		return err
+	}
+
+	counter := &countingWriter{w: file}
+	ogg, err := NewOggOpusWriter(counter, 2, map[string]string{
+		"TITLE": r.Name,
+		"DATE":  started.Format(time.RFC3339),
+	})
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	r.file = file
+	r.counter = counter
+	r.ogg = ogg
+	r.fileStarted = started
+	r.fileDuration = 0
+	r.files = append(r.files, path)
+	return nil
+}
+
+// createUniqueFile creates a new file named name+ext in dir, never overwriting an existing one.
+// If the name is taken, a sequence number is added: name-2+ext, name-3+ext and so on.
+func createUniqueFile(dir, name, ext string) (string, *os.File, error) {
+	for i := 1; ; i++ {
+		path := filepath.Join(dir, name+ext)
+		if i > 1 {
+			path = filepath.Join(dir, fmt.Sprintf("%s-%d%s", name, i, ext))
+		}
+
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if os.IsExist(err) {
+			continue
+		}
+
+		return path, file, err
+	}
+}
+
+func (r *Recorder) closeFile() error {
+	if r.ogg == nil {
+		return nil
+	}
+
+	err := r.ogg.Close()
+	if cerr := r.file.Close(); err == nil {
+		err = cerr
+	}
+
+	r.ogg = nil
+	r.file = nil
+	r.counter = nil
+	return err
+}
+
+// Close finishes the current file, further writes will fail
+func (r *Recorder) Close() error {
+	r.Lock()
+	r.closed = true
+	err := r.closeFile()
+	r.Unlock()
+	return err
+}
+
+// Files returns the paths of all the files written so far
+func (r *Recorder) Files() []string {
+	r.Lock()
+	files := make([]string, len(r.files))
+	copy(files, r.files)
+	r.Unlock()
+	return files
+}
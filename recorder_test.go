@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// oggPageInfo is the granule position of a page and the number of packets ended on it
+type oggPageInfo struct {
+	granule uint64
+	packets int
+}
+
+// readOggPages returns the audio pages of the ogg file, skipping the 2 header pages
+func readOggPages(t *testing.T, path string) []oggPageInfo {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var pages []oggPageInfo
+	for len(data) > 0 {
+		if !bytes.HasPrefix(data, []byte("OggS")) {
+			t.Fatal(path, ": page does not start with OggS")
+		}
+
+		numSegments := int(data[26])
+		size := 27 + numSegments
+		packets := 0
+		for _, lacing := range data[27 : 27+numSegments] {
+			size += int(lacing)
+			if lacing < 255 {
+				packets++
+			}
+		}
+
+		pages = append(pages, oggPageInfo{granule: binary.LittleEndian.Uint64(data[6:]), packets: packets})
+		data = data[size:]
+	}
+
+	if len(pages) < 2 {
+		t.Fatal(path, ": missing the header pages")
+	}
+	return pages[2:]
+}
+
+// countOggPackets returns the number of audio packets in the file, checking the granule position of every page
+func countOggPackets(t *testing.T, path string) int {
+	total := 0
+	for i, p := range readOggPages(t, path) {
+		total += p.packets
+		if p.granule != uint64(total*FrameSize) {
+			t.Errorf("%s: page %d has granule position %d after %d packets", path, i, p.granule, total)
+		}
+	}
+	return total
+}
+
+func newTestRecorder(t *testing.T) (*Recorder, string) {
+	dir, err := ioutil.TempDir("", "recorder")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return NewRecorder(dir, "test station"), dir
+}
+
+func writeTestPackets(t *testing.T, r *Recorder, n int) {
+	for i := 0; i < n; i++ {
+		err := r.WriteOpus(Silence)
+		if err != nil {
+			t.Fatal("Failed writing packet ", i, ": ", err)
+		}
+	}
+}
+
+func TestRecorderRotatesByDuration(t *testing.T) {
+	r, dir := newTestRecorder(t)
+	defer os.RemoveAll(dir)
+
+	r.MaxDuration = time.Second
+	writeTestPackets(t, r, 120)
+	r.Close()
+
+	// All 3 files are started within the same second, none may overwrite another
+	files := r.Files()
+	expected := []int{50, 50, 20}
+	if len(files) != len(expected) {
+		t.Fatalf("Expected %d files, got %d: %v", len(expected), len(files), files)
+	}
+
+	for i, f := range files {
+		if n := countOggPackets(t, f); n != expected[i] {
+			t.Errorf("Expected %d packets in file %d, got %d", expected[i], i, n)
+		}
+	}
+}
+
+func TestRecorderRotatesBySize(t *testing.T) {
+	r, dir := newTestRecorder(t)
+	defer os.RemoveAll(dir)
+
+	r.MaxSize = 512
+	writeTestPackets(t, r, 200)
+	r.Close()
+
+	files := r.Files()
+	if len(files) < 2 {
+		t.Fatal("Expected the recording to be split up into multiple files, got ", files)
+	}
+
+	total := 0
+	for _, f := range files {
+		total += countOggPackets(t, f)
+	}
+	if total != 200 {
+		t.Errorf("Expected 200 packets across all the files, got %d", total)
+	}
+}
+
+func TestRecorderFillsGaps(t *testing.T) {
+	r, dir := newTestRecorder(t)
+	defer os.RemoveAll(dir)
+
+	writeTestPackets(t, r, 10)
+
+	// Pretend the mixer didn't send anything for the last 800ms
+	r.Lock()
+	r.fileStarted = r.fileStarted.Add(-time.Second)
+	r.Unlock()
+
+	writeTestPackets(t, r, 1)
+	r.Close()
+
+	files := r.Files()
+	if len(files) != 1 {
+		t.Fatal("Expected a single file, got ", files)
+	}
+
+	// 10 packets, around 40 frames of silence and the last packet
+	n := countOggPackets(t, files[0])
+	if n < 50 || n > 52 {
+		t.Errorf("Expected around 51 packets with the gap filled, got %d", n)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"github.com/pkg/errors"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNoReplayAudio = errors.New("Nothing to clip yet")
+)
+
+type replayPacket struct {
+	at      time.Time
+	samples int
+	opus    []byte
+}
+
+// ReplayBuffer is a MixerOutput that keeps a rolling window of the station's encoded output,
+// so the last few seconds can be saved as a clip at any time
+type ReplayBuffer struct {
+	sync.Mutex
+
+	MaxLength time.Duration
+
+	// Ring of packets, packets[pos] is the oldest once it's wrapped around
+	packets []replayPacket
+	pos     int
+	filled  bool
+}
+
+// NewReplayBuffer returns a new replay buffer holding up to maxLength of audio
+func NewReplayBuffer(maxLength time.Duration) *ReplayBuffer {
+	frames := int(maxLength / FrameDuration)
+	if frames < 1 {
+		frames = 1
+	}
+
+	return &ReplayBuffer{
+		MaxLength: maxLength,
+		packets:   make([]replayPacket, frames),
+	}
+}
+
+func (rb *ReplayBuffer) String() string {
+	return "Replay buffer"
+}
+
+// WriteOpus implements MixerOutput
+func (rb *ReplayBuffer) WriteOpus(opus []byte) error {
+	samples, err := opusPacketSamples(opus)
+	if err != nil {
+		return errors.WithMessage(err, "ReplayBuffer.WriteOpus")
+	}
+
+	rb.Lock()
+	p := &rb.packets[rb.pos]
+	p.at = time.Now()
+	p.samples = samples
+	// Reuse the slot's buffer
+	p.opus = append(p.opus[:0], opus...)
+
+	rb.pos++
+	if rb.pos >= len(rb.packets) {
+		rb.pos = 0
+		rb.filled = true
+	}
+	rb.Unlock()
+
+	return nil
+}
+
+// Clip returns the last d of audio as an Ogg Opus file, gaps where nothing
+// was sent are filled with silence
+func (rb *ReplayBuffer) Clip(d time.Duration, title string) ([]byte, error) {
+	if d > rb.MaxLength {
+		d = rb.MaxLength
+	}
+
+	var buf bytes.Buffer
+	ogg, err := NewOggOpusWriter(&buf, 2, map[string]string{
+		"TITLE": title,
+		"DATE":  time.Now().Format(time.RFC3339),
+	})
+	if err != nil {
+		return nil, errors.WithMessage(err, "ReplayBuffer.Clip")
+	}
+
+	rb.Lock()
+	defer rb.Unlock()
+
+	start := time.Now().Add(-d)
+
+	n := rb.pos
+	first := 0
+	if rb.filled {
+		n = len(rb.packets)
+		first = rb.pos
+	}
+
+	var last time.Time
+	written := 0
+	for i := 0; i < n; i++ {
+		p := &rb.packets[(first+i)%len(rb.packets)]
+		if p.at.Before(start) {
+			continue
+		}
+
+		if !last.IsZero() {
+			for gap := p.at.Sub(last) - FrameDuration; gap >= FrameDuration*3/2; gap -= FrameDuration {
+				err = ogg.WritePacket(OpusSilence, FrameSize)
+				if err != nil {
+					return nil, errors.WithMessage(err, "ReplayBuffer.Clip")
+				}
+			}
+		}
+
+		err = ogg.WritePacket(p.opus, p.samples)
+		if err != nil {
+			return nil, errors.WithMessage(err, "ReplayBuffer.Clip")
+		}
+
+		last = p.at
+		written++
+	}
+
+	if written < 1 {
+		return nil, ErrNoReplayAudio
+	}
+
+	err = ogg.Close()
+	if err != nil {
+		return nil, errors.WithMessage(err, "ReplayBuffer.Clip")
+	}
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// readClip returns the second byte of every packet in the clip, which the test packets are numbered by
+func readClip(t *testing.T, clip []byte) []byte {
+	var numbers []byte
+	pages := 0
+	for len(clip) > 0 {
+		if !bytes.HasPrefix(clip, []byte("OggS")) || len(clip) < 27 {
+			t.Fatal("Clip page does not start with OggS")
+		}
+
+		numSegments := int(clip[26])
+		lacing := clip[27 : 27+numSegments]
+		data := clip[27+numSegments:]
+
+		// Every test packet fits in a single segment
+		for _, l := range lacing {
+			if pages >= 2 {
+				numbers = append(numbers, data[1])
+			}
+			data = data[l:]
+		}
+
+		clip = data
+		pages++
+	}
+
+	return numbers
+}
+
+func TestReplayBufferWrapsAround(t *testing.T) {
+	rb := NewReplayBuffer(FrameDuration * 10)
+
+	if _, err := rb.Clip(rb.MaxLength, "test"); err != ErrNoReplayAudio {
+		t.Error("Expected ErrNoReplayAudio from an empty buffer, got ", err)
+	}
+
+	for i := 0; i < 25; i++ {
+		// Single 20ms CELT frame, numbered by the second byte
+		err := rb.WriteOpus([]byte{0xF8, byte(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	clip, err := rb.Clip(rb.MaxLength, "test")
+	if err != nil {
+		t.Fatal("Failed clipping: ", err)
+	}
+
+	expected := []byte{15, 16, 17, 18, 19, 20, 21, 22, 23, 24}
+	if got := readClip(t, clip); !bytes.Equal(got, expected) {
+		t.Errorf("Expected packets %v, got %v", expected, got)
+	}
+
+	// Spread the packets out over the last 200ms, as if they were sent in real time
+	now := time.Now()
+	for i := 0; i < len(rb.packets); i++ {
+		rb.packets[(rb.pos+i)%len(rb.packets)].at = now.Add(-FrameDuration*time.Duration(len(rb.packets)-i) + FrameDuration/2)
+	}
+
+	clip, err = rb.Clip(FrameDuration*5, "test")
+	if err != nil {
+		t.Fatal("Failed clipping: ", err)
+	}
+
+	expected = []byte{20, 21, 22, 23, 24}
+	if got := readClip(t, clip); !bytes.Equal(got, expected) {
+		t.Errorf("Expected the last 5 packets %v, got %v", expected, got)
+	}
+}
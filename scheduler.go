@@ -0,0 +1,198 @@
+package main
+
+import (
+	"runtime"
+	"sync"
+	"time"
+)
+
+const (
+	// If the scheduler falls behind by up to this many frames it runs them back to back to catch up,
+	// anything further behind is skipped
+	maxCatchUpFrames = 5
+
+	// Frames started later than this after they were due count as late
+	lateFrameThreshold = FrameDuration / 2
+)
+
+// Clock is the time source of the FrameScheduler, tests use their own to control time
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// RealClock is the wall clock
+var RealClock Clock = realClock{}
+
+// FrameProcessor is ticked by the FrameScheduler once every frame
+type FrameProcessor interface {
+	ProcessFrame()
+}
+
+// SchedulerStats contains the frame counters of a FrameScheduler
+type SchedulerStats struct {
+	Processors int
+
+	Frames      int64         // Frames ticked
+	Late        int64         // Frames started more than lateFrameThreshold after they were due
+	Skipped     int64         // Frames skipped because we fell too far behind to catch up
+	MaxLateness time.Duration // Latest a frame has been started
+	LastTick    time.Duration // Time it took to tick every processor in the last frame
+}
+
+// FrameScheduler ticks every registered processor once a frame on a shared pool of workers.
+// Frames are due at fixed offsets from the start, so it doesn't drift, and when it falls
+// behind it catches up by running frames back to back, or skips them if it's too far behind.
+type FrameScheduler struct {
+	sync.Mutex
+
+	clock      Clock
+	processors []FrameProcessor
+
+	// The processors of the current frame, reused every frame
+	ticking []FrameProcessor
+	jobs    chan FrameProcessor
+	wg      sync.WaitGroup
+
+	// When the next frame is due, zero until the first one
+	next time.Time
+
+	stats SchedulerStats
+	stop  chan bool
+}
+
+// NewFrameScheduler returns a new scheduler using the clock and number of workers, 0 workers uses one per cpu
+func NewFrameScheduler(clock Clock, workers int) *FrameScheduler {
+	if workers < 1 {
+		workers = runtime.NumCPU()
+	}
+
+	s := &FrameScheduler{
+		clock: clock,
+		jobs:  make(chan FrameProcessor, workers),
+		stop:  make(chan bool),
+	}
+
+	for i := 0; i < workers; i++ {
+		go s.worker()
+	}
+
+	return s
+}
+
+// Add starts ticking the processor from the next frame on
+func (s *FrameScheduler) Add(p FrameProcessor) {
+	s.Lock()
+	s.processors = append(s.processors, p)
+	s.Unlock()
+}
+
+// Remove stops ticking the processor, it may still be ticked once if a frame is in progress
+func (s *FrameScheduler) Remove(p FrameProcessor) {
+	s.Lock()
+	for k, v := range s.processors {
+		if v == p {
+			s.processors = append(s.processors[:k], s.processors[k+1:]...)
+			break
+		}
+	}
+	s.Unlock()
+}
+
+// Stats returns the frame counters
+func (s *FrameScheduler) Stats() SchedulerStats {
+	s.Lock()
+	stats := s.stats
+	stats.Processors = len(s.processors)
+	s.Unlock()
+	return stats
+}
+
+// Run ticks the processors until Stop is called
+func (s *FrameScheduler) Run() {
+	log("Frame scheduler running")
+	for {
+		s.runDue(s.clock.Now())
+
+		select {
+		case <-s.clock.After(s.next.Sub(s.clock.Now())):
+		case <-s.stop:
+			log("Frame scheduler stopping")
+			close(s.jobs)
+			return
+		}
+	}
+}
+
+// Stop stops Run
+func (s *FrameScheduler) Stop() {
+	close(s.stop)
+}
+
+// runDue runs all the frames due by now
+func (s *FrameScheduler) runDue(now time.Time) {
+	if s.next.IsZero() {
+		s.next = now
+	}
+
+	behind := now.Sub(s.next)
+	if behind < 0 {
+		return
+	}
+
+	frames := int(behind/FrameDuration) + 1
+	if frames > maxCatchUpFrames {
+		skipped := frames - maxCatchUpFrames
+		s.next = s.next.Add(time.Duration(skipped) * FrameDuration)
+		frames = maxCatchUpFrames
+
+		s.Lock()
+		s.stats.Skipped += int64(skipped)
+		s.Unlock()
+	}
+
+	for i := 0; i < frames; i++ {
+		started := s.clock.Now()
+		s.tick()
+		took := s.clock.Now().Sub(started)
+
+		lateness := started.Sub(s.next)
+		s.Lock()
+		s.stats.Frames++
+		if lateness > lateFrameThreshold {
+			s.stats.Late++
+		}
+		if lateness > s.stats.MaxLateness {
+			s.stats.MaxLateness = lateness
+		}
+		s.stats.LastTick = took
+		s.Unlock()
+
+		s.next = s.next.Add(FrameDuration)
+	}
+}
+
+// tick runs a single frame of every processor on the workers and waits for them to finish
+func (s *FrameScheduler) tick() {
+	s.Lock()
+	s.ticking = append(s.ticking[:0], s.processors...)
+	s.Unlock()
+
+	s.wg.Add(len(s.ticking))
+	for _, p := range s.ticking {
+		s.jobs <- p
+	}
+	s.wg.Wait()
+}
+
+func (s *FrameScheduler) worker() {
+	for p := range s.jobs {
+		p.ProcessFrame()
+		s.wg.Done()
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeClock only moves when told to
+type fakeClock struct {
+	sync.Mutex
+	now     time.Time
+	waiters []fakeWaiter
+}
+
+type fakeWaiter struct {
+	at time.Time
+	c  chan time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.Lock()
+	defer c.Unlock()
+
+	ch := make(chan time.Time, 1)
+	c.waiters = append(c.waiters, fakeWaiter{at: c.now.Add(d), c: ch})
+	return ch
+}
+
+// Advance moves the clock forward and fires the waiters that are due
+func (c *fakeClock) Advance(d time.Duration) {
+	c.Lock()
+	c.now = c.now.Add(d)
+	waiting := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.at.After(c.now) {
+			waiting = append(waiting, w)
+		} else {
+			w.c <- c.now
+		}
+	}
+	c.waiters = waiting
+	c.Unlock()
+}
+
+func (c *fakeClock) waitersSnapshot() []fakeWaiter {
+	c.Lock()
+	defer c.Unlock()
+	return append([]fakeWaiter(nil), c.waiters...)
+}
+
+type countingProcessor struct {
+	frames int64
+}
+
+func (p *countingProcessor) ProcessFrame() {
+	atomic.AddInt64(&p.frames, 1)
+}
+
+func TestFrameSchedulerCatchUp(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	s := NewFrameScheduler(clock, 2)
+	defer close(s.jobs)
+
+	a, b := &countingProcessor{}, &countingProcessor{}
+	s.Add(a)
+	s.Add(b)
+
+	check := func(frames, late, skipped int64) {
+		stats := s.Stats()
+		if a.frames != frames || b.frames != frames || stats.Frames != frames || stats.Late != late || stats.Skipped != skipped {
+			t.Fatalf("Expected %d frames (%d late, %d skipped), processors got %d and %d, stats: %+v", frames, late, skipped, a.frames, b.frames, stats)
+		}
+	}
+
+	s.runDue(clock.Now())
+	check(1, 0, 0)
+
+	// Not due yet
+	clock.Advance(FrameDuration / 2)
+	s.runDue(clock.Now())
+	check(1, 0, 0)
+
+	// 3 frames due, the 2 older ones are late
+	clock.Advance(FrameDuration/2 + FrameDuration*2)
+	s.runDue(clock.Now())
+	check(4, 2, 0)
+
+	// Too far behind, only the last maxCatchUpFrames frames are run
+	clock.Advance(time.Second)
+	s.runDue(clock.Now())
+	check(4+maxCatchUpFrames, 2+maxCatchUpFrames-1, 50-maxCatchUpFrames)
+
+	// Still on the original grid
+	if want := time.Unix(0, 0).Add(FrameDuration * 54); !s.next.Equal(want) {
+		t.Errorf("Next frame due at %s, expected %s", s.next, want)
+	}
+
+	s.Remove(b)
+	clock.Advance(FrameDuration)
+	s.runDue(clock.Now())
+	if a.frames != 5+maxCatchUpFrames || b.frames != 4+maxCatchUpFrames {
+		t.Errorf("Removed processor still ticked: %d, %d", a.frames, b.frames)
+	}
+}
+
+func TestFrameSchedulerRun(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	s := NewFrameScheduler(clock, 1)
+	p := &countingProcessor{}
+	s.Add(p)
+
+	go s.Run()
+	defer s.Stop()
+
+	for i := int64(1); i <= 10; i++ {
+		// Wait for the scheduler to run the frame and go back to waiting on the clock
+		deadline := time.Now().Add(time.Second)
+		for atomic.LoadInt64(&p.frames) < i || len(clock.waitersSnapshot()) < 1 {
+			if time.Now().After(deadline) {
+				t.Fatalf("Frame %d never ran, got %d", i, atomic.LoadInt64(&p.frames))
+			}
+			time.Sleep(time.Millisecond)
+		}
+		clock.Advance(FrameDuration)
+	}
+}
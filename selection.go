@@ -0,0 +1,137 @@
+package main
+
+import (
+	"math"
+)
+
+const (
+	// Speakers whose level is below this in dBFS aren't competing for a slot
+	speakerActiveLevel = -55.0
+
+	// How fast the level of a speaker falls once they go quiet, in dB per frame (20dB/s)
+	speakerLevelRelease = 0.4
+
+	// How much louder in dB a speaker has to be than the quietest selected one to take their slot
+	speakerSelectHysteresis = 6.0
+
+	// Frames a speaker keeps their slot before someone louder can take it, 500ms
+	speakerMinSelectFrames = 25
+)
+
+// updateLevel updates the peak hold level of the speaker in dBFS with the pcm they played this frame,
+// pcm is empty if they didn't play anything
+func (ud *UserDecoder) updateLevel(pcm []int16) {
+	level := math.Inf(-1)
+	if len(pcm) > 0 {
+		var sum float64
+		for _, v := range pcm {
+			f := float64(v) / 0x8000
+			sum += f * f
+		}
+
+		if sum > 0 {
+			level = 10 * math.Log10(sum/float64(len(pcm)))
+		}
+	}
+
+	released := ud.level - speakerLevelRelease
+	if level > released {
+		ud.level = level
+	} else {
+		ud.level = released
+	}
+
+	if ud.selected {
+		ud.selectedFrames++
+	}
+}
+
+// selectSpeakers picks the max loudest speakers to be mixed in, hosts are always mixed in and don't take up a slot.
+// Selected speakers keep their slot until they go quiet or someone clearly louder comes along, so they don't flap.
+// usersLock has to be held.
+func (mix *Mixer) selectSpeakers(max int) {
+	candidates := mix.candidates[:0]
+	selected := 0
+
+	for _, st := range mix.users {
+		if st.host || !st.allowed || st.level < speakerActiveLevel {
+			st.selected = false
+			continue
+		}
+
+		if st.selected {
+			selected++
+		}
+		candidates = append(candidates, st)
+	}
+	mix.candidates = candidates
+
+	// Loudest first, insertion sort as there's usually only a handful
+	for i := 1; i < len(candidates); i++ {
+		for j := i; j > 0 && candidates[j].level > candidates[j-1].level; j-- {
+			candidates[j], candidates[j-1] = candidates[j-1], candidates[j]
+		}
+	}
+
+	// The max may have been lowered
+	for i := len(candidates) - 1; i >= 0 && selected > max; i-- {
+		if candidates[i].selected {
+			candidates[i].selected = false
+			selected--
+		}
+	}
+
+	for _, st := range candidates {
+		if st.selected {
+			continue
+		}
+
+		if selected < max {
+			st.selected = true
+			st.selectedFrames = 0
+			selected++
+			continue
+		}
+
+		// Full, take the slot of the quietest selected speaker if they've had it for long enough
+		var quietest *UserDecoder
+		for i := len(candidates) - 1; i >= 0; i-- {
+			if candidates[i].selected && candidates[i].selectedFrames >= speakerMinSelectFrames {
+				quietest = candidates[i]
+				break
+			}
+		}
+
+		if quietest == nil || st.level < quietest.level+speakerSelectHysteresis {
+			// Candidates are sorted, nobody after this one is going to be loud enough either
+			break
+		}
+
+		quietest.selected = false
+		st.selected = true
+		st.selectedFrames = 0
+	}
+}
+
+// inMixLocked returns true if the speaker is mixed in, which is everyone allowed to speak
+// if there's no max. usersLock has to be held
+func (mix *Mixer) inMixLocked(st *UserDecoder) bool {
+	return mix.maxSpeakers == 0 || st.host || st.selected
+}
+
+// talkingLocked returns whether any of the speakers mixed in is talking, and whether a host or priority
+// speaker is. Speakers left out of the mix don't count, so they can't duck the music nobody hears them over.
+// usersLock has to be held
+func (mix *Mixer) talkingLocked() (speaking, talkover bool) {
+	for _, st := range mix.users {
+		if !st.allowed || st.level <= talkoverThreshold || !mix.inMixLocked(st) {
+			continue
+		}
+
+		speaking = true
+		if st.priority {
+			talkover = true
+		}
+	}
+	return
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestSelectSpeakers(t *testing.T) {
+	mix := NewMixer()
+
+	speakers := make([]*UserDecoder, 4)
+	for i := range speakers {
+		st := NewUserDecoder(uint32(i + 1))
+		st.allowed = true
+		mix.users[st.SSRC] = st
+		speakers[i] = st
+	}
+
+	// The host is quiet, but always mixed in without taking a slot
+	speakers[0].host = true
+	speakers[0].level = -40
+	speakers[1].level = -20
+	speakers[2].level = -25
+	speakers[3].level = -30
+
+	selected := func() (out []uint32) {
+		for _, st := range speakers {
+			if st.selected {
+				out = append(out, st.SSRC)
+			}
+		}
+		return
+	}
+
+	expect := func(ssrcs ...uint32) {
+		got := selected()
+		if len(got) != len(ssrcs) {
+			t.Fatalf("Selected %v, expected %v", got, ssrcs)
+		}
+		for i := range got {
+			if got[i] != ssrcs[i] {
+				t.Fatalf("Selected %v, expected %v", got, ssrcs)
+			}
+		}
+	}
+
+	mix.selectSpeakers(2)
+	expect(2, 3)
+
+	// Slightly louder isn't enough to take a slot
+	speakers[3].level = -22
+	for i := 0; i < speakerMinSelectFrames; i++ {
+		for _, st := range speakers {
+			st.selectedFrames++
+		}
+		mix.selectSpeakers(2)
+	}
+	expect(2, 3)
+
+	// Clearly louder takes the quietest speaker's slot
+	speakers[3].level = -10
+	mix.selectSpeakers(2)
+	expect(2, 4)
+
+	// Going quiet frees the slot
+	speakers[1].level = speakerActiveLevel - 1
+	mix.selectSpeakers(2)
+	expect(3, 4)
+
+	// Lowering the max drops the quietest
+	mix.selectSpeakers(1)
+	expect(4)
+}
+
+func TestTalkingOnlyCountsMixedSpeakers(t *testing.T) {
+	mix := NewMixer()
+
+	speakers := make([]*UserDecoder, 3)
+	for i := range speakers {
+		st := NewUserDecoder(uint32(i + 1))
+		st.allowed = true
+		mix.users[st.SSRC] = st
+		speakers[i] = st
+	}
+
+	// A quiet speaker holds the only slot, a loud priority speaker hasn't taken it yet
+	speakers[0].level = -50
+	speakers[0].selected = true
+	speakers[1].level = -20
+	speakers[1].priority = true
+	speakers[2].level = -100
+	mix.SetMaxSpeakers(1)
+
+	if speaking, talkover := mix.talkingLocked(); speaking || talkover {
+		t.Errorf("Speaker left out of the mix counted as talking (speaking %v, talkover %v)", speaking, talkover)
+	}
+
+	// Once they're in the mix they do count
+	speakers[0].selected, speakers[1].selected = false, true
+	if speaking, talkover := mix.talkingLocked(); !speaking || !talkover {
+		t.Errorf("Mixed in priority speaker not counted as talking (speaking %v, talkover %v)", speaking, talkover)
+	}
+
+	// Without a max everyone allowed counts
+	mix.SetMaxSpeakers(0)
+	speakers[1].selected = false
+	if speaking, _ := mix.talkingLocked(); !speaking {
+		t.Error("Speaker not counted as talking without a max")
+	}
+}
+
+func TestUpdateLevel(t *testing.T) {
+	st := NewUserDecoder(1)
+
+	pcm := make([]int16, FrameSamples)
+	for i := range pcm {
+		pcm[i] = 0x4000
+	}
+
+	st.updateLevel(pcm)
+	if st.level < -6.1 || st.level > -5.9 {
+		t.Error("Half scale should be around -6 dBFS, got ", st.level)
+	}
+
+	// Falls slowly once quiet
+	st.updateLevel(nil)
+	if st.level < -6.1-speakerLevelRelease || st.level > -5.9-speakerLevelRelease {
+		t.Error("Level didn't release by the expected amount, got ", st.level)
+	}
+}
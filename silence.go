@@ -0,0 +1,42 @@
+package main
+
+const (
+	// The mix counts as silent while its peak is below this, around -60 dBFS
+	silencePeak = 32
+
+	// Silent frames sent as usual before the tail, so the pauses between words aren't cut, 300ms
+	silenceHangoverFrames = 15
+
+	// Opus silence frames sent after the hangover before going quiet, so the decoders on the other end
+	// don't interpolate the last frame, discord wants 5
+	silenceTailFrames = 5
+)
+
+// pcmSilent returns true if the pcm is below the silence threshold
+func pcmSilent(pcm []int16) bool {
+	for _, v := range pcm {
+		if v > silencePeak || v < -silencePeak {
+			return false
+		}
+	}
+	return true
+}
+
+// SetSilenceSuppression enables or disables suppressing silence, which stops sending to outputs
+// implementing SpeakingOutput while the broadcast is silent
+func (mix *Mixer) SetSilenceSuppression(enabled bool) {
+	mix.outputLock.Lock()
+	mix.suppressSilence = enabled
+	mix.outputLock.Unlock()
+}
+
+// SilenceSuppression returns whether silence suppression is enabled, and whether the default tier is currently suppressed
+func (mix *Mixer) SilenceSuppression() (enabled, suppressed bool) {
+	mix.outputLock.Lock()
+	enabled = mix.suppressSilence
+	if t := mix.tierLocked(DefaultTier); t != nil {
+		suppressed = t.suppressed
+	}
+	mix.outputLock.Unlock()
+	return
+}
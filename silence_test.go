@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+type speakingOutput struct {
+	events chan string
+}
+
+func (s *speakingOutput) WriteOpus(data []byte) error {
+	s.events <- "frame"
+	return nil
+}
+
+func (s *speakingOutput) SetSpeaking(speaking bool) error {
+	if speaking {
+		s.events <- "start"
+	} else {
+		s.events <- "stop"
+	}
+	return nil
+}
+
+func TestSilenceSuppression(t *testing.T) {
+	mix := NewMixer()
+	mix.SetSilenceSuppression(true)
+
+	out := &speakingOutput{events: make(chan string, 100)}
+	mix.AddOutput(out)
+
+	voiced := make([]int16, FrameSamples)
+	for i := range voiced {
+		voiced[i] = 1000
+	}
+	silent := make([]int16, FrameSamples)
+
+	mix.broadcastAudio(voiced, nil)
+	for i := 0; i < silenceHangoverFrames+silenceTailFrames+10; i++ {
+		mix.broadcastAudio(silent, nil)
+	}
+	mix.broadcastAudio(voiced, nil)
+
+	expected := []string{"start"}
+	for i := 0; i < 1+silenceHangoverFrames+silenceTailFrames; i++ {
+		expected = append(expected, "frame")
+	}
+	expected = append(expected, "stop", "start", "frame")
+
+	for i, e := range expected {
+		select {
+		case got := <-out.events:
+			if got != e {
+				t.Fatalf("Event %d: got %s, expected %s", i, got, e)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Event %d: timed out waiting for %s", i, e)
+		}
+	}
+
+	if _, suppressed := mix.SilenceSuppression(); suppressed {
+		t.Error("Still suppressed after a voiced frame")
+	}
+}
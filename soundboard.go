@@ -0,0 +1,566 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"github.com/hraban/opus"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrUnknownSound           = errors.New("Unknown sound")
+	ErrUnsupportedSoundFormat = errors.New("Unsupported sound format")
+	ErrSoundTooLong           = errors.New("Sound too long")
+	ErrSoundQueueFull         = errors.New("Sound queue full")
+)
+
+// MaxSoundQueue is the max number of sounds waiting to be played
+const MaxSoundQueue = 10
+
+// The file formats of the sound library
+var soundExtensions = []string{".dca", ".ogg", ".opus", ".wav"}
+
+// SoundNames returns the names of the sounds in the library dir without their extensions, sorted
+func SoundNames(dir string) ([]string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.WithMessage(err, "SoundNames")
+	}
+
+	names := make([]string, 0, len(files))
+	for _, f := range files {
+		ext := strings.ToLower(filepath.Ext(f.Name()))
+		if f.IsDir() || !isSoundExtension(ext) {
+			continue
+		}
+		names = append(names, strings.TrimSuffix(f.Name(), filepath.Ext(f.Name())))
+	}
+
+	sort.Strings(names)
+	return names, nil
+}
+
+func isSoundExtension(ext string) bool {
+	for _, e := range soundExtensions {
+		if e == ext {
+			return true
+		}
+	}
+	return false
+}
+
+// findSound returns the path of the sound by name, it's looked up in the listing of the dir
+// so names can't point outside of it
+func findSound(dir, name string) (string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "", errors.WithMessage(err, "findSound")
+	}
+
+	for _, f := range files {
+		ext := filepath.Ext(f.Name())
+		if !f.IsDir() && isSoundExtension(strings.ToLower(ext)) && strings.EqualFold(strings.TrimSuffix(f.Name(), ext), name) {
+			return filepath.Join(dir, f.Name()), nil
+		}
+	}
+
+	return "", ErrUnknownSound
+}
+
+// LoadSound decodes the DCA, Ogg Opus or WAV file into memory as 48khz interleaved stereo pcm,
+// sounds longer than max give ErrSoundTooLong
+func LoadSound(path string, max time.Duration) ([]int16, error) {
+	maxSamples := int(max/FrameDuration) * FrameSamples
+
+	var pcm []int16
+	err := DecodeSound(path, func(decoded []int16) error {
+		pcm = append(pcm, decoded...)
+		if len(pcm) > maxSamples {
+			return ErrSoundTooLong
+		}
+		return nil
+	})
+
+	return pcm, err
+}
+
+// DecodeSound decodes the DCA, Ogg Opus or WAV file, calling emit with the 48khz interleaved stereo pcm as it goes.
+// Opus is decoded a packet at a time and WAV files a chunk at a time, so there's no limit on their length.
+// The pcm passed to emit is reused once it returns, decoding stops if it returns an error.
+func DecodeSound(path string, emit func(pcm []int16) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return errors.WithMessage(err, "DecodeSound")
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".dca":
+		return decodeDCA(r, emit)
+	case ".ogg", ".opus":
+		return decodeOggOpus(r, emit)
+	case ".wav":
+		return decodeWAV(r, emit)
+	}
+
+	return ErrUnsupportedSoundFormat
+}
+
+// decodeOpusPackets decodes the packets returned by next until it returns io.EOF, skipping the first preSkip samples
+func decodeOpusPackets(next func() ([]byte, error), preSkip int, emit func(pcm []int16) error) error {
+	dec, err := opus.NewDecoder(SampleRate, 2)
+	if err != nil {
+		return errors.WithMessage(err, "opus.NewDecoder")
+	}
+
+	buf := make([]int16, maxOpusPacketSamples*2)
+	for {
+		packet, err := next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		n, err := dec.Decode(packet, buf)
+		if err != nil {
+			return errors.WithMessage(err, "dec.Decode")
+		}
+
+		pcm := buf[:n*2]
+		if preSkip > 0 {
+			skip := preSkip
+			if skip > n {
+				skip = n
+			}
+			pcm = pcm[skip*2:]
+			preSkip -= skip
+		}
+
+		if len(pcm) > 0 {
+			err = emit(pcm)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func decodeOggOpus(r io.Reader, emit func(pcm []int16) error) error {
+	or, err := NewOggOpusReader(r)
+	if err != nil {
+		return err
+	}
+
+	return decodeOpusPackets(or.ReadPacket, or.PreSkip, emit)
+}
+
+// decodeDCA decodes a DCA file, version 1 with its json metadata header or the headerless version 0:
+// a series of opus packets each prefixed with their length as a little endian int16
+func decodeDCA(r *bufio.Reader, emit func(pcm []int16) error) error {
+	if magic, _ := r.Peek(4); string(magic) == "DCA1" {
+		var metaSize int32
+		r.Discard(4)
+		err := binary.Read(r, binary.LittleEndian, &metaSize)
+		if err != nil {
+			return errors.WithMessage(err, "decodeDCA, metadata size")
+		}
+
+		_, err = r.Discard(int(metaSize))
+		if err != nil {
+			return errors.WithMessage(err, "decodeDCA, metadata")
+		}
+	}
+
+	next := func() ([]byte, error) {
+		var size int16
+		err := binary.Read(r, binary.LittleEndian, &size)
+		if err != nil {
+			// EOF is only returned by binary.Read if nothing was read
+			return nil, err
+		}
+		if size <= 0 {
+			return nil, errors.New("decodeDCA, invalid frame size")
+		}
+
+		packet := make([]byte, size)
+		_, err = io.ReadFull(r, packet)
+		if err != nil {
+			return nil, errors.WithMessage(err, "decodeDCA, frame")
+		}
+		return packet, nil
+	}
+
+	return decodeOpusPackets(next, 0, emit)
+}
+
+// decodeWAV decodes a 16 bit PCM WAV file with 1 or 2 channels, resampling it to 48khz if needed
+func decodeWAV(r io.Reader, emit func(pcm []int16) error) error {
+	var riff [12]byte
+	_, err := io.ReadFull(r, riff[:])
+	if err != nil {
+		return errors.WithMessage(err, "decodeWAV")
+	}
+	if string(riff[:4]) != "RIFF" || string(riff[8:]) != "WAVE" {
+		return ErrUnsupportedSoundFormat
+	}
+
+	var channels, bits, rate int
+	for {
+		var chunk [8]byte
+		_, err = io.ReadFull(r, chunk[:])
+		if err != nil {
+			return errors.WithMessage(err, "decodeWAV, no data chunk")
+		}
+		size := int64(binary.LittleEndian.Uint32(chunk[4:]))
+
+		switch string(chunk[:4]) {
+		case "fmt ":
+			if size < 16 {
+				return ErrUnsupportedSoundFormat
+			}
+			var format [16]byte
+			_, err = io.ReadFull(r, format[:])
+			if err != nil {
+				return errors.WithMessage(err, "decodeWAV, fmt")
+			}
+
+			// PCM, or WAVE_FORMAT_EXTENSIBLE which is used for PCM as well
+			tag := binary.LittleEndian.Uint16(format[0:])
+			if tag != 1 && tag != 0xFFFE {
+				return ErrUnsupportedSoundFormat
+			}
+			channels = int(binary.LittleEndian.Uint16(format[2:]))
+			rate = int(binary.LittleEndian.Uint32(format[4:]))
+			bits = int(binary.LittleEndian.Uint16(format[14:]))
+
+			size -= 16
+		case "data":
+			if bits != 16 || channels < 1 || channels > 2 || rate < 1 {
+				return ErrUnsupportedSoundFormat
+			}
+
+			return decodeWAVData(r, size/int64(channels*2), channels, rate, emit)
+		}
+
+		// Skip the rest of the chunk, chunks are padded to an even size
+		_, err = io.CopyN(ioutil.Discard, r, size+size&1)
+		if err != nil {
+			return errors.WithMessage(err, "decodeWAV, skipping chunk")
+		}
+	}
+}
+
+// Frames of a WAV file read and emitted at a time, 100ms at 48khz
+const wavChunkFrames = 4800
+
+// decodeWAVData decodes the frames of 16 bit pcm in the data chunk a bit at a time, converting it to 48khz stereo
+func decodeWAVData(r io.Reader, frames int64, channels, rate int, emit func(pcm []int16) error) error {
+	data := make([]byte, wavChunkFrames*channels*2)
+	pcm := make([]int16, wavChunkFrames*2)
+
+	var resampler *linearResampler
+	if rate != SampleRate {
+		resampler = newLinearResampler(rate)
+	}
+
+	for frames > 0 {
+		n := int64(wavChunkFrames)
+		if n > frames {
+			n = frames
+		}
+		frames -= n
+
+		chunk := data[:int(n)*channels*2]
+		_, err := io.ReadFull(r, chunk)
+		if err != nil {
+			return errors.WithMessage(err, "decodeWAV, data")
+		}
+
+		stereo := pcm[:n*2]
+		for i := range stereo {
+			ch := i & 1
+			if channels == 1 {
+				ch = 0
+			}
+			stereo[i] = int16(binary.LittleEndian.Uint16(chunk[((i/2)*channels+ch)*2:]))
+		}
+
+		if resampler != nil {
+			stereo = resampler.resample(stereo)
+		}
+
+		err = emit(stereo)
+		if err != nil {
+			return err
+		}
+	}
+
+	if resampler != nil {
+		if tail := resampler.flush(); len(tail) > 0 {
+			return emit(tail)
+		}
+	}
+
+	return nil
+}
+
+// linearResampler resamples interleaved stereo pcm to 48khz with linear interpolation,
+// a chunk at a time carrying the interpolation over from one chunk to the next
+type linearResampler struct {
+	rate int
+	step float64 // Input frames per output frame
+
+	// Position of the next output frame relative to the first frame of the next chunk,
+	// and the last frame of the previous chunk which is at position -1
+	pos  float64
+	prev [2]int16
+
+	inFrames  int64
+	outFrames int64
+
+	out []int16
+}
+
+func newLinearResampler(rate int) *linearResampler {
+	return &linearResampler{
+		rate: rate,
+		step: float64(rate) / SampleRate,
+	}
+}
+
+// resample returns the output frames that fall within in, the returned pcm is reused by the next call
+func (r *linearResampler) resample(in []int16) []int16 {
+	frames := len(in) / 2
+	if frames < 1 {
+		return nil
+	}
+
+	sample := func(j, ch int) float64 {
+		if j < 0 {
+			return float64(r.prev[ch])
+		}
+		return float64(in[j*2+ch])
+	}
+
+	out := r.out[:0]
+	for {
+		j := int(math.Floor(r.pos))
+		if j+1 >= frames {
+			break
+		}
+
+		frac := r.pos - float64(j)
+		for ch := 0; ch < 2; ch++ {
+			a := sample(j, ch)
+			b := sample(j+1, ch)
+			out = append(out, int16(a+(b-a)*frac))
+		}
+		r.pos += r.step
+	}
+
+	r.pos -= float64(frames)
+	r.prev = [2]int16{in[(frames-1)*2], in[(frames-1)*2+1]}
+	r.inFrames += int64(frames)
+	r.outFrames += int64(len(out) / 2)
+	r.out = out
+	return out
+}
+
+// flush returns the output frames past the last input frame, holding its value
+func (r *linearResampler) flush() []int16 {
+	out := r.out[:0]
+	for total := r.inFrames * SampleRate / int64(r.rate); r.outFrames < total; r.outFrames++ {
+		out = append(out, r.prev[0], r.prev[1])
+	}
+	r.out = out
+	return out
+}
+
+// sound is a sound being played or waiting in the queue, decoded ahead by its player
+type sound struct {
+	name   string
+	player *playlistPlayer
+}
+
+// Soundboard plays sounds from a local library into a station's mix, it's added to the mixer as a source.
+// Sounds are decoded as they play, so they can be of any length.
+type Soundboard struct {
+	Dir string
+
+	lock     sync.Mutex
+	volume   float32
+	current  *sound
+	queue    []*sound
+	stopping bool
+}
+
+// NewSoundboard returns a new soundboard playing sounds from the library dir
+func NewSoundboard(dir string) *Soundboard {
+	return &Soundboard{
+		Dir:    dir,
+		volume: 1,
+	}
+}
+
+// open finds the sound and starts decoding it
+func (sb *Soundboard) open(name string) (*sound, error) {
+	player, err := newSoundPlayer(sb.Dir, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sound{name: player.Tracks[0], player: player}, nil
+}
+
+// Play plays the sound right away, cutting off what's currently playing. The queue is left as is.
+func (sb *Soundboard) Play(name string) error {
+	s, err := sb.open(name)
+	if err != nil {
+		return err
+	}
+
+	sb.lock.Lock()
+	if sb.current != nil {
+		sb.current.player.Stop()
+	}
+	sb.current = s
+	sb.stopping = false
+	sb.lock.Unlock()
+	return nil
+}
+
+// Queue plays the sound after the current one and the ones already queued
+func (sb *Soundboard) Queue(name string) error {
+	s, err := sb.open(name)
+	if err != nil {
+		return err
+	}
+
+	sb.lock.Lock()
+	if len(sb.queue) >= MaxSoundQueue {
+		sb.lock.Unlock()
+		s.player.Stop()
+		return ErrSoundQueueFull
+	}
+	sb.queue = append(sb.queue, s)
+	sb.lock.Unlock()
+	return nil
+}
+
+// Stop fades out the current sound and clears the queue, returns false if nothing was playing
+func (sb *Soundboard) Stop() bool {
+	sb.lock.Lock()
+	playing := sb.current != nil || len(sb.queue) > 0
+	sb.clearQueueLocked()
+	if sb.current != nil {
+		sb.stopping = true
+	}
+	sb.lock.Unlock()
+	return playing
+}
+
+// Clear stops the current sound right away and clears the queue
+func (sb *Soundboard) Clear() {
+	sb.lock.Lock()
+	sb.clearQueueLocked()
+	if sb.current != nil {
+		sb.current.player.Stop()
+		sb.current = nil
+	}
+	sb.stopping = false
+	sb.lock.Unlock()
+}
+
+func (sb *Soundboard) clearQueueLocked() {
+	for _, s := range sb.queue {
+		s.player.Stop()
+	}
+	sb.queue = nil
+}
+
+// SetVolume sets the volume of the sounds, 1 being unchanged
+func (sb *Soundboard) SetVolume(volume float32) {
+	sb.lock.Lock()
+	sb.volume = volume
+	sb.lock.Unlock()
+}
+
+// Status returns the volume, the name of the sound playing and the names of the queued ones
+func (sb *Soundboard) Status() (volume float32, playing string, queued []string) {
+	sb.lock.Lock()
+	volume = sb.volume
+	if sb.current != nil {
+		playing = sb.current.name
+	}
+	for _, s := range sb.queue {
+		queued = append(queued, s.name)
+	}
+	sb.lock.Unlock()
+	return
+}
+
+// MixFrame implements MixerSource
+func (sb *Soundboard) MixFrame(bus []float32, speaking bool) bool {
+	sb.lock.Lock()
+	defer sb.lock.Unlock()
+
+	var frame playlistFrame
+	for {
+		if sb.current == nil {
+			if len(sb.queue) < 1 {
+				return false
+			}
+			sb.current = sb.queue[0]
+			sb.queue = sb.queue[1:]
+		}
+
+		var ok bool
+		frame, ok = sb.current.player.next()
+		if ok {
+			break
+		}
+
+		if !sb.current.player.ended && !sb.stopping {
+			// The decoder is behind
+			return false
+		}
+
+		// Ended, the next one in the queue starts right away
+		sb.current.player.Stop()
+		sb.current = nil
+		sb.stopping = false
+	}
+
+	n := len(frame.pcm)
+	if n > len(bus) {
+		n = len(bus)
+	}
+	for i, v := range frame.pcm[:n] {
+		gain := sb.volume
+		if sb.stopping {
+			// Fade out over the frame so it doesn't click
+			gain *= 1 - float32(i)/float32(n)
+		}
+		bus[i] += float32(v) / 0x8000 * gain
+	}
+	sb.current.player.done(frame)
+
+	if sb.stopping {
+		sb.current.player.Stop()
+		sb.current = nil
+		sb.stopping = false
+	}
+	return true
+}
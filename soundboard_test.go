@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// collectPCM returns an emit func appending the decoded pcm to pcm
+func collectPCM(pcm *[]int16) func([]int16) error {
+	return func(decoded []int16) error {
+		*pcm = append(*pcm, decoded...)
+		return nil
+	}
+}
+
+func TestDecodeWAV(t *testing.T) {
+	// 100ms of mono 24khz
+	const frames = 2400
+	var buf bytes.Buffer
+	buf.WriteString("RIFF")
+	binary.Write(&buf, binary.LittleEndian, uint32(36+frames*2))
+	buf.WriteString("WAVEfmt ")
+	binary.Write(&buf, binary.LittleEndian, []uint32{16})
+	binary.Write(&buf, binary.LittleEndian, []uint16{1, 1})
+	binary.Write(&buf, binary.LittleEndian, []uint32{24000, 48000})
+	binary.Write(&buf, binary.LittleEndian, []uint16{2, 16})
+	buf.WriteString("data")
+	binary.Write(&buf, binary.LittleEndian, uint32(frames*2))
+	for i := 0; i < frames; i++ {
+		binary.Write(&buf, binary.LittleEndian, int16(1000))
+	}
+
+	var pcm []int16
+	err := decodeWAV(&buf, collectPCM(&pcm))
+	if err != nil {
+		t.Fatal("Failed decoding: ", err)
+	}
+
+	if len(pcm) != frames*2*2 {
+		t.Error("Expected ", frames*2*2, " samples after resampling to 48khz stereo, got ", len(pcm))
+	}
+	if pcm[0] != 1000 || pcm[1] != 1000 {
+		t.Error("Mono not copied to both channels: ", pcm[:2])
+	}
+}
+
+// wavHeader returns the header of a 16 bit pcm WAV file, followed by the data chunk header
+func wavHeader(frames, channels, rate int) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("RIFF")
+	binary.Write(&buf, binary.LittleEndian, uint32(36+frames*channels*2))
+	buf.WriteString("WAVEfmt ")
+	binary.Write(&buf, binary.LittleEndian, []uint32{16})
+	binary.Write(&buf, binary.LittleEndian, []uint16{1, uint16(channels)})
+	binary.Write(&buf, binary.LittleEndian, []uint32{uint32(rate), uint32(rate * channels * 2)})
+	binary.Write(&buf, binary.LittleEndian, []uint16{uint16(channels * 2), 16})
+	buf.WriteString("data")
+	binary.Write(&buf, binary.LittleEndian, uint32(frames*channels*2))
+	return buf.Bytes()
+}
+
+// rampReader generates mono 16 bit samples going up by one every frame
+type rampReader struct {
+	frame uint16
+}
+
+func (r *rampReader) Read(b []byte) (int, error) {
+	n := len(b) &^ 1
+	for i := 0; i < n; i += 2 {
+		binary.LittleEndian.PutUint16(b[i:], r.frame&0x7fff)
+		r.frame++
+	}
+	return n, nil
+}
+
+func TestDecodeLongWAV(t *testing.T) {
+	// Six minutes, at 8khz to keep it quick
+	frames := 6 * 60 * 8000
+	r := io.MultiReader(bytes.NewReader(wavHeader(frames, 1, 8000)), &rampReader{})
+
+	samples := 0
+	calls := 0
+	err := decodeWAV(r, func(pcm []int16) error {
+		samples += len(pcm)
+		calls++
+		return nil
+	})
+	if err != nil {
+		t.Fatal("Failed decoding: ", err)
+	}
+
+	if samples != frames*6*2 {
+		t.Errorf("Expected %d samples, got %d", frames*6*2, samples)
+	}
+	if calls < 2 {
+		t.Error("Expected the data to be decoded in chunks")
+	}
+}
+
+func TestDecodeWAVResamplesAcrossChunks(t *testing.T) {
+	// Spans a few chunks, every output frame lands halfway between two input frames
+	const frames = wavChunkFrames*2 + 1000
+	r := io.MultiReader(bytes.NewReader(wavHeader(frames, 1, 24000)), io.LimitReader(&rampReader{}, frames*2))
+
+	var pcm []int16
+	err := decodeWAV(r, collectPCM(&pcm))
+	if err != nil {
+		t.Fatal("Failed decoding: ", err)
+	}
+
+	if len(pcm) != frames*2*2 {
+		t.Fatalf("Expected %d samples, got %d", frames*2*2, len(pcm))
+	}
+
+	// The last frame is held at the end
+	for i := 0; i < len(pcm)/2-2; i++ {
+		if expected := int16(i / 2); pcm[i*2] != expected || pcm[i*2+1] != expected {
+			t.Fatalf("Frame %d is %d, expected %d", i, pcm[i*2], expected)
+		}
+	}
+}
+
+func TestDecodeDCA(t *testing.T) {
+	var buf bytes.Buffer
+	buf.WriteString("DCA1")
+	meta := []byte(`{"dca":{"version":1}}`)
+	binary.Write(&buf, binary.LittleEndian, int32(len(meta)))
+	buf.Write(meta)
+	for i := 0; i < 10; i++ {
+		binary.Write(&buf, binary.LittleEndian, int16(len(Silence)))
+		buf.Write(Silence)
+	}
+
+	var pcm []int16
+	err := decodeDCA(bufio.NewReader(&buf), collectPCM(&pcm))
+	if err != nil {
+		t.Fatal("Failed decoding: ", err)
+	}
+	if len(pcm) != 10*FrameSamples {
+		t.Error("Expected 10 frames, got ", len(pcm), " samples")
+	}
+}
+
+func newTestSoundboard(t *testing.T) (*Soundboard, string) {
+	dir, err := ioutil.TempDir("", "soundboard")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Both a frame and a half long
+	writeTestWAV(t, filepath.Join(dir, "a.wav"), FrameSize*3/2, 0x4000)
+	writeTestWAV(t, filepath.Join(dir, "b.wav"), FrameSize*3/2, 0x4000)
+	return NewSoundboard(dir), dir
+}
+
+func TestSoundboardMixFrame(t *testing.T) {
+	sb, dir := newTestSoundboard(t)
+	defer os.RemoveAll(dir)
+	sb.SetVolume(0.5)
+
+	if err := sb.Queue("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sb.Queue("b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sb.Queue("c"); err != ErrUnknownSound {
+		t.Error("Queueing an unknown sound gave ", err)
+	}
+
+	// Let the players decode ahead
+	time.Sleep(time.Millisecond * 50)
+
+	bus := make([]float32, FrameSamples)
+	if !sb.MixFrame(bus, false) || bus[0] != 0.25 {
+		t.Fatal("First frame not mixed at half volume: ", bus[0])
+	}
+
+	// Half a frame left of the first sound
+	bus = make([]float32, FrameSamples)
+	sb.MixFrame(bus, false)
+	if bus[FrameSamples/2-1] == 0 || bus[FrameSamples/2] != 0 {
+		t.Error("Expected the rest of the first sound in the first half of the frame only")
+	}
+
+	// The queued one starts once the first ends
+	bus = make([]float32, FrameSamples)
+	if !sb.MixFrame(bus, false) || bus[FrameSamples-1] != 0.25 {
+		t.Fatal("Queued sound didn't start right after the first")
+	}
+	if _, playing, _ := sb.Status(); playing != "b" {
+		t.Error("Expected b to be playing, got ", playing)
+	}
+
+	sb.Stop()
+	bus = make([]float32, FrameSamples)
+	sb.MixFrame(bus, false)
+	if bus[0] != 0.25 || bus[FrameSamples/2-1] > 0.01 {
+		t.Error("Expected a fade out over the frame: ", bus[0], bus[FrameSamples/2-1])
+	}
+	if sb.MixFrame(bus, false) {
+		t.Error("Still playing after being stopped")
+	}
+}
+
+func TestSoundboardQueueLimit(t *testing.T) {
+	sb, dir := newTestSoundboard(t)
+	defer os.RemoveAll(dir)
+	defer sb.Clear()
+
+	// Queued all at once, exactly the max make it in
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	full := 0
+	for i := 0; i < MaxSoundQueue*2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := sb.Queue("a")
+			if err == ErrSoundQueueFull {
+				lock.Lock()
+				full++
+				lock.Unlock()
+			} else if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if _, _, queued := sb.Status(); len(queued) != MaxSoundQueue || full != MaxSoundQueue {
+		t.Errorf("Expected %d sounds queued and %d refused, got %d and %d", MaxSoundQueue, MaxSoundQueue, len(queued), full)
+	}
+}
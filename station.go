@@ -3,6 +3,7 @@ package main
 import (
 	"github.com/jonas747/discordgo"
 	"github.com/pkg/errors"
+	"path/filepath"
 	"strings"
 	"sync"
 	"time"
@@ -12,6 +13,7 @@ var (
 	ErrGuildHostTaken    = errors.New("Server has a station")
 	ErrGuildReceiveTaken = errors.New("Server has a receiver")
 	ErrNameTaken         = errors.New("Name taken")
+	ErrClipCooldown      = errors.New("Clip on cooldown")
 )
 
 var (
@@ -33,17 +35,33 @@ type StationMeta struct {
 	Host          *discordgo.User
 	TextChannelID string
 	Listeners     []*Listener
+
+	// User ID's of the co-hosts, trusted with moderating the broadcast
+	CoHosts []string
 }
 
 type Station struct {
 	sync.RWMutex
 
-	queuedSetVolumes map[string]float32
-	meta             *StationMeta
-	mixer            *Mixer
+	meta  *StationMeta
+	mixer *Mixer
 
 	stop chan bool
 	vc   *discordgo.VoiceConnection
+
+	recorder   *Recorder
+	multitrack *MultitrackRecorder
+
+	replay   *ReplayBuffer
+	lastClip time.Time
+
+	soundboard *Soundboard
+	bed        *MusicBed
+	autoDJ     *AutoDJ
+
+	// Played to new listeners before they get the live feed, from the soundboard library
+	ident     []int16
+	identName string
 }
 
 // FindStation searches for a station by name, or if the name is contained in the stations name with only 1 result
@@ -96,10 +114,22 @@ func StartStation(name, description string, guild *discordgo.Guild, textChannelI
 			Host:          host,
 			TextChannelID: textChannelID,
 		},
-		stop:             make(chan bool),
-		queuedSetVolumes: make(map[string]float32),
-		mixer:            NewMixer(),
+		stop:       make(chan bool),
+		mixer:      NewMixer(),
+		replay:     NewReplayBuffer(ClipMaxLength),
+		soundboard: NewSoundboard(SoundsDir),
+		bed:        NewMusicBed(MusicDir),
+		autoDJ:     NewAutoDJ(MusicDir),
 	}
+	station.autoDJ.OnTrack = station.announceTrack
+
+	station.mixer.Access.SetHost(host.ID, true)
+	station.mixer.OutputQueueSize = OutputQueueSize
+	station.mixer.SlowConsumerPolicy = SlowPolicy
+	station.mixer.SetPassthrough(Passthrough)
+	station.mixer.SetSilenceSuppression(SuppressSilence)
+	station.mixer.SetMaxSpeakers(MaxSpeakers)
+	station.mixer.SetAutoPan(AutoPan)
 
 	ActiveStations = append(ActiveStations, station)
 	ActiveGuilds[guild.ID] = station
@@ -138,22 +168,64 @@ func (s *Station) Start(voiceChannelId string) error {
 	}
 	s.vc = vc
 
+	// Pick up the speakers we got to know before the handler was added
+	vc.RLock()
+	for userID, ssrc := range vc.UsersToSSRC {
+		s.mixer.Identities.Set(ssrc, userID)
+	}
+	vc.RUnlock()
+
+	s.mixer.AddOutput(s.replay)
+	s.mixer.AddSource(s.bed)
+	s.mixer.AddSource(s.soundboard)
+	s.mixer.AddSource(s.autoDJ)
+
 	go s.voiceRecv()
-	go s.mixer.Run()
+	Scheduler.Add(s.mixer)
 	return nil
 }
 
+// VoiceSpeakingUpdateHandler keeps track of which user is behind which ssrc
 func (s *Station) VoiceSpeakingUpdateHandler(vc *discordgo.VoiceConnection, vs *discordgo.VoiceSpeakingUpdate) {
-	// log("Vocie updt my dude")
-	// s.Lock()
-	// if vol, ok := s.queuedSetVolumes[vs.UserID]; ok {
-	// 	delete(s.queuedSetVolumes, vs.UserID)
-	// 	s.Unlock()
-	// 	log("Setting volume of ", uint32(vs.SSRC), ", ", vs.SSRC, " to ", vol)
-	// 	s.mixer.SetVolume(uint32(vs.SSRC), vol)
-	// } else {
-	// 	s.Unlock()
-	// }
+	s.mixer.Identities.Set(uint32(vs.SSRC), vs.UserID)
+
+	member, err := DG.State.Member(s.meta.GuildID, vs.UserID)
+	if err == nil && member.User != nil && member.User.Bot {
+		s.mixer.Access.SetBot(vs.UserID)
+	}
+}
+
+// VoiceStateUpdateHandler evicts the decoders of users leaving the station's voice channel
+func (s *Station) VoiceStateUpdateHandler(vs *discordgo.VoiceStateUpdate) {
+	if s.vc == nil {
+		return
+	}
+
+	s.vc.RLock()
+	channelID := s.vc.ChannelID
+	s.vc.RUnlock()
+
+	if vs.ChannelID != channelID {
+		s.mixer.RemoveSpeaker(vs.UserID)
+	}
+}
+
+// announceTrack posts the track the AutoDJ started playing to the text channels of the listeners
+func (s *Station) announceTrack(track string) {
+	s.RLock()
+	name := s.meta.Name
+	channels := make(map[string]bool)
+	for _, l := range s.meta.Listeners {
+		channels[l.TextChannelID] = true
+	}
+	s.RUnlock()
+
+	for channelID := range channels {
+		_, err := DG.ChannelMessageSend(channelID, "AutoDJ on **"+name+"** is now playing: "+track)
+		if err != nil {
+			log("Failed announcing AutoDJ track: ", err)
+		}
+	}
 }
 
 func (s *Station) Stop() {
@@ -169,13 +241,59 @@ func (s *Station) Meta() *StationMeta {
 	mCop.Listeners = make([]*Listener, len(s.meta.Listeners))
 	copy(mCop.Listeners, s.meta.Listeners)
 
+	mCop.CoHosts = make([]string, len(s.meta.CoHosts))
+	copy(mCop.CoHosts, s.meta.CoHosts)
+
 	s.RUnlock()
 
 	return mCop
 }
 
-// ListenIn listens in on the station from a voice channel
-func (s *Station) ListenIn(guildID, voiceChannelID string, textChannelID string) (*Listener, error) {
+// IsHost returns true if the user is the host or a co-host of the station
+func (s *Station) IsHost(userID string, includeCoHosts bool) bool {
+	s.RLock()
+	defer s.RUnlock()
+
+	if s.meta.Host.ID == userID {
+		return true
+	}
+
+	if includeCoHosts {
+		for _, v := range s.meta.CoHosts {
+			if v == userID {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// ToggleCoHost adds the user as a co-host, or removes them if they already are one.
+// Returns true if they were added
+func (s *Station) ToggleCoHost(userID string) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	for k, v := range s.meta.CoHosts {
+		if v == userID {
+			s.meta.CoHosts = append(s.meta.CoHosts[:k], s.meta.CoHosts[k+1:]...)
+			s.mixer.Access.SetHost(userID, false)
+			return false
+		}
+	}
+
+	s.meta.CoHosts = append(s.meta.CoHosts, userID)
+	s.mixer.Access.SetHost(userID, true)
+	return true
+}
+
+// ListenIn listens in on the station from a voice channel, getting the named encoder tier
+func (s *Station) ListenIn(guildID, voiceChannelID string, textChannelID string, tier string) (*Listener, error) {
+	if !s.HasTier(tier) {
+		return nil, ErrUnknownTier
+	}
+
 	ActiveLock.Lock()
 	if existing, ok := ActiveGuilds[guildID]; ok {
 		ActiveLock.Unlock()
@@ -208,11 +326,67 @@ func (s *Station) ListenIn(guildID, voiceChannelID string, textChannelID string)
 	s.meta.Listeners = append(s.meta.Listeners, listener)
 	s.Unlock()
 
-	s.mixer.AddOutput(listener)
+	s.RLock()
+	ident := s.ident
+	s.RUnlock()
+
+	err = s.mixer.AddOutputPreroll(listener, tier, ident)
+	if err != nil {
+		log("Failed adding listener with the ident: ", err)
+		err = s.mixer.AddOutputTier(listener, tier)
+	}
+	if err != nil {
+		// The tier was validated above and tiers can't be removed, so this shouldn't happen
+		log("Failed adding listener: ", err)
+	}
 
 	return listener, nil
 }
 
+// SetIdent sets the sound from the soundboard library played to new listeners before the live feed, an empty name removes it
+func (s *Station) SetIdent(name string) error {
+	var ident []int16
+	if name != "" {
+		path, err := findSound(s.soundboard.Dir, name)
+		if err != nil {
+			return err
+		}
+
+		ident, err = LoadSound(path, MaxIdentLength)
+		if err != nil {
+			if err == ErrSoundTooLong {
+				return ErrIdentTooLong
+			}
+			return err
+		}
+		name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+
+	s.Lock()
+	s.ident = ident
+	s.identName = name
+	s.Unlock()
+	return nil
+}
+
+// Ident returns the name of the ident, or an empty string if there's none
+func (s *Station) Ident() string {
+	s.RLock()
+	name := s.identName
+	s.RUnlock()
+	return name
+}
+
+// HasTier returns true if the station has an encoder tier by the name
+func (s *Station) HasTier(name string) bool {
+	for _, t := range s.mixer.Tiers() {
+		if t.Name == strings.ToLower(name) {
+			return true
+		}
+	}
+	return false
+}
+
 // TODO stuff
 func (s *Station) voiceRecv() {
 	for {
@@ -225,8 +399,138 @@ func (s *Station) voiceRecv() {
 	}
 }
 
+// StartRecording starts recording the station's mix to disk
+func (s *Station) StartRecording() (*Recorder, error) {
+	s.Lock()
+	if s.recorder != nil {
+		s.Unlock()
+		return nil, ErrAlreadyRecording
+	}
+
+	rec := NewRecorder(RecordingsDir, s.meta.Name)
+	rec.MaxSize = RecordMaxSize * 1000000
+	rec.MaxDuration = RecordMaxDuration
+	s.recorder = rec
+	s.Unlock()
+
+	err := s.mixer.AddOutputTier(rec, RecordingTier)
+	if err != nil {
+		s.mixer.AddOutput(rec)
+	}
+	return rec, nil
+}
+
+// StopRecording stops the current recording and returns the files written
+func (s *Station) StopRecording() ([]string, error) {
+	s.Lock()
+	rec := s.recorder
+	s.recorder = nil
+	s.Unlock()
+
+	if rec == nil {
+		return nil, ErrNotRecording
+	}
+
+	s.mixer.RemoveOutput(rec)
+	err := rec.Close()
+	return rec.Files(), err
+}
+
+// Clip returns the last d of the broadcast as an Ogg Opus file, at most once every ClipCooldown.
+// Failed clips don't count towards the cooldown
+func (s *Station) Clip(d time.Duration) ([]byte, error) {
+	s.Lock()
+	if time.Since(s.lastClip) < ClipCooldown {
+		s.Unlock()
+		return nil, ErrClipCooldown
+	}
+	// Claimed up front so concurrent clips can't both get through, given back if the clip fails
+	prev := s.lastClip
+	s.lastClip = time.Now()
+	s.Unlock()
+
+	clip, err := s.replay.Clip(d, s.meta.Name)
+	if err != nil {
+		s.Lock()
+		s.lastClip = prev
+		s.Unlock()
+		return nil, err
+	}
+
+	return clip, nil
+}
+
+// StartMultitrack starts recording every speaker into their own file
+func (s *Station) StartMultitrack() (*MultitrackRecorder, error) {
+	s.Lock()
+	if s.multitrack != nil {
+		s.Unlock()
+		return nil, ErrAlreadyRecording
+	}
+
+	rec, err := NewMultitrackRecorder(RecordingsDir, s.meta.Name, s.resolveSpeaker)
+	if err != nil {
+		s.Unlock()
+		return nil, err
+	}
+	s.multitrack = rec
+	s.Unlock()
+
+	s.mixer.SetSpeakerTap(rec)
+	return rec, nil
+}
+
+// StopMultitrack stops the multitrack recording and returns its directory
+func (s *Station) StopMultitrack() (string, error) {
+	s.Lock()
+	rec := s.multitrack
+	s.multitrack = nil
+	s.Unlock()
+
+	if rec == nil {
+		return "", ErrNotRecording
+	}
+
+	s.mixer.SetSpeakerTap(nil)
+	err := rec.Close()
+	return rec.Dir, err
+}
+
+// resolveSpeaker returns the discord user behind a ssrc in the host voice channel
+func (s *Station) resolveSpeaker(ssrc uint32) (userID, username string, ok bool) {
+	userID, ok = s.mixer.Identities.User(ssrc)
+	if !ok {
+		return
+	}
+
+	return userID, s.username(userID), true
+}
+
+// username returns the name of the user in the station's server, or their ID if they're not in the state
+func (s *Station) username(userID string) string {
+	member, err := DG.State.Member(s.meta.GuildID, userID)
+	if err == nil && member.User != nil {
+		return member.User.Username
+	}
+	return userID
+}
+
 func (s *Station) shutDown() {
+	Scheduler.Remove(s.mixer)
 	s.vc.Disconnect()
+	s.bed.Stop()
+	s.autoDJ.Stop()
+	s.soundboard.Clear()
+
+	_, err := s.StopRecording()
+	if err != nil && err != ErrNotRecording {
+		log("Failed finishing recording: ", err)
+	}
+
+	_, err = s.StopMultitrack()
+	if err != nil && err != ErrNotRecording {
+		log("Failed finishing multitrack recording: ", err)
+	}
 
 	s.Lock()
 	for _, v := range s.meta.Listeners {
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"fmt"
+	"github.com/hraban/opus"
+	"github.com/pkg/errors"
+	"strings"
+	"time"
+)
+
+var (
+	ErrUnknownTier = errors.New("Unknown encoder tier")
+)
+
+const (
+	// DefaultTier is the tier outputs get unless they ask for another one
+	DefaultTier = "standard"
+
+	// RecordingTier is the tier recordings are made from
+	RecordingTier = "high"
+)
+
+// EncoderProfile are the settings of one of a station's encoders
+type EncoderProfile struct {
+	Name        string
+	Bitrate     int // Bits per second
+	Complexity  int // 0-10
+	Application opus.Application
+	FEC         bool // In-band forward error correction, at the cost of some bitrate
+	DTX         bool // Discontinuous transmission, sending almost nothing during silence
+}
+
+// DefaultEncoderProfiles are the tiers every station starts out with
+var DefaultEncoderProfiles = []EncoderProfile{
+	{Name: "high", Bitrate: 128000, Complexity: 10, Application: opus.AppAudio},
+	{Name: "standard", Bitrate: 64000, Complexity: 10, Application: opus.AppAudio},
+	{Name: "low", Bitrate: 24000, Complexity: 5, Application: opus.AppVoIP, FEC: true},
+}
+
+// String returns a short description of the profile
+func (p EncoderProfile) String() string {
+	out := p.Name + ": " + formatBitrate(p.Bitrate)
+	if p.Application == opus.AppVoIP {
+		out += ", voip"
+	} else {
+		out += ", audio"
+	}
+	if p.FEC {
+		out += ", fec"
+	}
+	if p.DTX {
+		out += ", dtx"
+	}
+	return out
+}
+
+func formatBitrate(bitrate int) string {
+	return fmt.Sprintf("%gkbps", float64(bitrate)/1000)
+}
+
+// newEncoder creates an encoder with the profile's settings
+func (p EncoderProfile) newEncoder() (*opus.Encoder, error) {
+	enc, err := opus.NewEncoder(SampleRate, 2, p.Application)
+	if err != nil {
+		return nil, errors.WithMessage(err, "opus.NewEncoder")
+	}
+
+	err = enc.SetBitrate(p.Bitrate)
+	if err == nil {
+		err = enc.SetComplexity(p.Complexity)
+	}
+	if err == nil {
+		err = enc.SetInBandFEC(p.FEC)
+	}
+	if err == nil && p.FEC {
+		// FEC only kicks in if the encoder expects loss
+		err = enc.SetPacketLossPerc(10)
+	}
+	if err == nil {
+		err = enc.SetDTX(p.DTX)
+	}
+	if err != nil {
+		return nil, errors.WithMessage(err, "Configuring encoder")
+	}
+
+	return enc, nil
+}
+
+// frameEncoder encodes a frame of the mix, it's an *opus.Encoder outside of the tests
+type frameEncoder interface {
+	Encode(pcm []int16, data []byte) (int, error)
+}
+
+// encoderPrimeFrames is the number of recent frames of the mix run through an encoder that's been skipped,
+// before it encodes the next frame for real
+const encoderPrimeFrames = 2
+
+// encoderTier is an encoder and the outputs subscribed to it, every frame is encoded once per tier with subscribers
+type encoderTier struct {
+	profile EncoderProfile
+	encoder frameEncoder
+
+	// stale is set when the encoder skipped frames of the mix, while passing through or sitting idle
+	stale bool
+
+	// Broadcast delay, every tier has its own as they hold encoded frames.
+	// idle is set once it's been emptied while nobody's subscribed
+	delay *DelayLine
+	idle  bool
+
+	subscribers int
+
+	// The frame being sent out this frame
+	frame *opusFrame
+
+	// Consecutive silent frames coming out of the delay line, and whether the silence has
+	// gone on long enough that outputs implementing SpeakingOutput get nothing
+	silentFrames int
+	suppressed   bool
+}
+
+// canPassthrough returns true if the packet fits within the tier's bitrate, so we don't
+// pass high bitrate packets through to a tier that's meant to save bandwidth
+func (t *encoderTier) canPassthrough(packet []byte) bool {
+	return len(packet)*8*int(time.Second/FrameDuration) <= t.profile.Bitrate
+}
+
+// tierLocked returns the tier by name, outputLock has to be held
+func (mix *Mixer) tierLocked(name string) *encoderTier {
+	for _, t := range mix.tiers {
+		if t.profile.Name == name {
+			return t
+		}
+	}
+	return nil
+}
+
+// SetEncoderProfile adds a tier with the profile, or replaces the settings of the tier with the same name
+func (mix *Mixer) SetEncoderProfile(profile EncoderProfile) error {
+	profile.Name = strings.ToLower(profile.Name)
+
+	enc, err := profile.newEncoder()
+	if err != nil {
+		return errors.WithMessage(err, "SetEncoderProfile")
+	}
+
+	mix.outputLock.Lock()
+	defer mix.outputLock.Unlock()
+
+	if t := mix.tierLocked(profile.Name); t != nil {
+		t.profile = profile
+		t.encoder = enc
+		t.stale = true
+		return nil
+	}
+
+	t := &encoderTier{
+		profile: profile,
+		encoder: enc,
+	}
+	if mix.delayLength >= FrameDuration {
+		t.delay = NewDelayLine(mix.delayLength)
+	}
+	mix.tiers = append(mix.tiers, t)
+	return nil
+}
+
+// TierInfo contains the profile of a tier and the number of outputs subscribed to it
+type TierInfo struct {
+	EncoderProfile
+	Subscribers int
+}
+
+// Tiers returns all the encoder tiers
+func (mix *Mixer) Tiers() []TierInfo {
+	mix.outputLock.Lock()
+	tiers := make([]TierInfo, len(mix.tiers))
+	for i, t := range mix.tiers {
+		tiers[i] = TierInfo{EncoderProfile: t.profile, Subscribers: t.subscribers}
+	}
+	mix.outputLock.Unlock()
+	return tiers
+}
+
+// encodeTiers encodes the frame once for every tier with subscribers and runs it through their delay lines,
+// passthrough is the packet of the only speaker if it can be sent as is. outputLock has to be held.
+func (mix *Mixer) encodeTiers(pcm []int16, passthrough []byte) {
+	silent := pcmSilent(pcm)
+
+	for _, t := range mix.tiers {
+		if t.subscribers < 1 {
+			// Nobody would hear what's in the delay line, and it's stale by the time anyone subscribes
+			if t.delay != nil && !t.idle {
+				t.delay.Dump()
+			}
+			t.idle = true
+			t.stale = true
+			t.silentFrames = 0
+			t.suppressed = false
+			continue
+		}
+		t.idle = false
+
+		var frame *opusFrame
+		if passthrough != nil && t.canPassthrough(passthrough) {
+			frame = wrapOpusFrame(passthrough)
+			t.stale = true
+		} else {
+			if t.stale {
+				mix.primeEncoder(t)
+			}
+
+			frame = newOpusFrame()
+			n, err := t.encoder.Encode(pcm, frame.buf)
+			if err != nil {
+				log("Failed encode: ", err)
+			}
+			frame.data = frame.buf[:n]
+		}
+		frame.silent = silent
+
+		if t.delay != nil {
+			frame = t.delay.Push(frame)
+		}
+
+		if frame == nil || frame.silent {
+			t.silentFrames++
+		} else {
+			t.silentFrames = 0
+		}
+
+		// Past the hangover everyone gets opus silence frames, the outputs that can go quiet stop after the tail
+		if frame != nil && t.silentFrames > silenceHangoverFrames {
+			frame.release()
+			frame = nil
+		}
+		if frame == nil {
+			frame = wrapOpusFrame(OpusSilence)
+		}
+
+		t.frame = frame
+		t.suppressed = t.silentFrames > silenceHangoverFrames+silenceTailFrames
+	}
+
+	// Keep the last frames around for priming the encoders
+	recent := mix.recentPCM[mix.recentPos]
+	if len(recent) != len(pcm) {
+		recent = make([]int16, len(pcm))
+		mix.recentPCM[mix.recentPos] = recent
+	}
+	copy(recent, pcm)
+	mix.recentPos = (mix.recentPos + 1) % len(mix.recentPCM)
+}
+
+// primeEncoder runs the last frames of the mix through the tier's stale encoder and throws away the result,
+// so the first frame it encodes for real after passing through or sitting idle doesn't start from old state.
+// outputLock has to be held.
+func (mix *Mixer) primeEncoder(t *encoderTier) {
+	frame := newOpusFrame()
+	for i := range mix.recentPCM {
+		pcm := mix.recentPCM[(mix.recentPos+i)%len(mix.recentPCM)]
+		if pcm == nil {
+			continue
+		}
+
+		_, err := t.encoder.Encode(pcm, frame.buf)
+		if err != nil {
+			log("Failed priming encoder: ", err)
+			break
+		}
+	}
+	frame.release()
+
+	t.stale = false
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestEncodeTiers(t *testing.T) {
+	mix := NewMixer()
+
+	err := mix.AddOutputTier(&DummyOutput{}, "high")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = mix.AddOutputTier(&DummyOutput{}, "Standard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = mix.AddOutputTier(&DummyOutput{}, "nope"); err != ErrUnknownTier {
+		t.Error("Unknown tier gave: ", err)
+	}
+
+	// 80kbps, fits in high but not in standard
+	packet := make([]byte, 200)
+	pcm := make([]int16, FrameSamples)
+
+	mix.outputLock.Lock()
+	mix.encodeTiers(pcm, packet)
+	high, standard, low := mix.tierLocked("high"), mix.tierLocked("standard"), mix.tierLocked("low")
+	mix.outputLock.Unlock()
+
+	if len(high.frame.data) != len(packet) {
+		t.Error("Packet not passed through to the high tier")
+	}
+	if len(standard.frame.data) == len(packet) {
+		t.Error("Packet passed through to the standard tier above its bitrate")
+	}
+	if !low.idle || low.frame != nil {
+		t.Error("Tier without subscribers was encoded")
+	}
+
+	tiers := mix.Tiers()
+	if len(tiers) != len(DefaultEncoderProfiles) || tiers[0].Subscribers != 1 || tiers[2].Subscribers != 0 {
+		t.Error("Unexpected tiers: ", tiers)
+	}
+}
+
+// countingEncoder records the first sample of every frame it encodes
+type countingEncoder struct {
+	frameEncoder
+	encoded []int16
+}
+
+func (e *countingEncoder) Encode(pcm []int16, data []byte) (int, error) {
+	e.encoded = append(e.encoded, pcm[0])
+	return e.frameEncoder.Encode(pcm, data)
+}
+
+func TestPassthroughSkipsEncoder(t *testing.T) {
+	mix := NewMixer()
+	err := mix.AddOutputTier(&DummyOutput{}, "standard")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mix.outputLock.Lock()
+	tier := mix.tierLocked("standard")
+	enc := &countingEncoder{frameEncoder: tier.encoder}
+	tier.encoder = enc
+	mix.outputLock.Unlock()
+
+	// Every frame is numbered by its first sample, the rest is loud enough to not be silence
+	packet := make([]byte, 20)
+	pcm := make([]int16, FrameSamples)
+	for i := range pcm {
+		pcm[i] = 0x1000
+	}
+	for i := 1; i <= 50; i++ {
+		pcm[0] = int16(i)
+
+		// A second voice joins on the last frame
+		last := i == 50
+		mix.outputLock.Lock()
+		if last {
+			mix.encodeTiers(pcm, nil)
+		} else {
+			mix.encodeTiers(pcm, packet)
+		}
+		frame := tier.frame
+		tier.frame = nil
+		mix.outputLock.Unlock()
+
+		if !last && !bytes.Equal(frame.data, packet) {
+			t.Fatal("Packet not passed through")
+		}
+		if !last && len(enc.encoded) > 0 {
+			t.Fatalf("Encoder ran while passing through frame %d", i)
+		}
+		frame.release()
+	}
+
+	// The encoder is primed with the frames before the one it encodes
+	expected := []int16{48, 49, 50}
+	if !reflect.DeepEqual(enc.encoded, expected) {
+		t.Errorf("Expected frames %v to be encoded after passthrough, got %v", expected, enc.encoded)
+	}
+	if tier.stale {
+		t.Error("Encoder still stale after priming")
+	}
+}